@@ -0,0 +1,70 @@
+package main
+
+import (
+	"github.com/nitrous-io/ot.go/demo/protocol"
+	"github.com/nitrous-io/ot.go/ot/session"
+)
+
+func (s *Session) handleComment(c *Connection, m *protocol.Comment) *EventError {
+	if !c.Identity.Role.CanComment() {
+		return newEventError(ErrCodeForbidden, c.Identity.Role.String()+" may not comment")
+	}
+	a, err := s.AddAnnotation(m.Revision, m.From, m.To, s.displayName(c.ID), m.Text)
+	if err != nil {
+		return annotationError(err)
+	}
+	s.broadcast(&protocol.Annotated{Annotation: *a}, nil)
+	return nil
+}
+
+func (s *Session) handleReply(c *Connection, m *protocol.Reply) *EventError {
+	if !c.Identity.Role.CanComment() {
+		return newEventError(ErrCodeForbidden, c.Identity.Role.String()+" may not comment")
+	}
+	a, err := s.ReplyToAnnotation(m.ID, s.displayName(c.ID), m.Text)
+	if err != nil {
+		return annotationError(err)
+	}
+	s.broadcast(&protocol.Annotated{Annotation: *a}, nil)
+	return nil
+}
+
+func (s *Session) handleResolve(c *Connection, m *protocol.Resolve) *EventError {
+	if !c.Identity.Role.CanComment() {
+		return newEventError(ErrCodeForbidden, c.Identity.Role.String()+" may not resolve comments")
+	}
+	a, err := s.ResolveAnnotation(m.ID)
+	if err != nil {
+		return annotationError(err)
+	}
+	s.broadcast(&protocol.Annotated{Annotation: *a}, nil)
+	return nil
+}
+
+// sendAnnotations sends c the annotations of the current revision, if any
+func (s *Session) sendAnnotations(c *Connection) {
+	if len(s.Annotations) > 0 {
+		c.Send(&protocol.Annotations{Annotations: s.annotationList()})
+	}
+}
+
+// annotationList returns copies of the annotations, which can be sent while
+// the originals change. Comments are only ever appended, so the copies can
+// share them.
+func (s *Session) annotationList() []session.Annotation {
+	sorted := s.SortedAnnotations()
+	annotations := make([]session.Annotation, len(sorted))
+	for i, a := range sorted {
+		annotations[i] = *a
+	}
+	return annotations
+}
+
+// displayName returns the name of the client id, or the id if it has not
+// joined
+func (s *Session) displayName(id string) string {
+	if cl := s.Clients[id]; cl != nil && cl.Name != "" {
+		return cl.Name
+	}
+	return id
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/nitrous-io/ot.go/demo/wsclient"
+	"github.com/nitrous-io/ot.go/ot/operation"
+	"github.com/nitrous-io/ot.go/ot/session"
+)
+
+func TestAnnotations(t *testing.T) {
+	srv, _ := newTestServer(t, "Lorem Ipsum Dolor", nil)
+	defer srv.Close()
+
+	alice := dialAndJoin(t, srv, "alice")
+	defer alice.Close()
+	bob := dialAndJoin(t, srv, "bob")
+	defer bob.Close()
+
+	if err := alice.Comment(6, 11, "typo?"); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	err := bob.Wait(testTimeout, func(c *wsclient.Client) bool {
+		return len(c.Annotations()) == 1
+	})
+	if err != nil {
+		t.Fatalf("expected bob to see the comment, got %v", err)
+	}
+	a := bob.Annotations()[0]
+	expected := session.Annotation{ID: a.ID, From: 6, To: 11, Comments: []session.Comment{{Author: "alice", Text: "typo?"}}}
+	if actual := a; !reflect.DeepEqual(actual, expected) {
+		t.Errorf("expected %+v, got %+v", expected, actual)
+	}
+
+	// the range follows the text
+	if err = bob.Submit(operation.New().Insert(">> ").Retain(17), nil); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if err = alice.WaitRevision(1, testTimeout); err != nil {
+		t.Fatalf("expected alice to get bob's edit, got %v", err)
+	}
+	expected.From, expected.To = 9, 14
+	for _, c := range []*wsclient.Client{alice, bob} {
+		if actual := c.Annotations()[0]; !reflect.DeepEqual(actual, expected) {
+			t.Errorf("expected %+v, got %+v", expected, actual)
+		}
+	}
+
+	if err = bob.Reply(a.ID, "no, Latin"); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if err = alice.Resolve(a.ID); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	expected.Resolved = true
+	expected.Comments = append(expected.Comments, session.Comment{Author: "bob", Text: "no, Latin"})
+	err = bob.Wait(testTimeout, func(c *wsclient.Client) bool {
+		return reflect.DeepEqual(c.Annotations()[0], expected)
+	})
+	if err != nil {
+		t.Errorf("expected %+v, got %+v", expected, bob.Annotations()[0])
+	}
+
+	// late joiners get them too
+	if err = alice.WaitSynchronized(testTimeout); err != nil {
+		t.Fatalf("expected alice to synchronize, got %v", err)
+	}
+	carol := dialAndJoin(t, srv, "carol")
+	defer carol.Close()
+	err = carol.Wait(testTimeout, func(c *wsclient.Client) bool {
+		annotations := c.Annotations()
+		return len(annotations) == 1 && reflect.DeepEqual(annotations[0], expected)
+	})
+	if err != nil {
+		t.Errorf("expected carol to get %+v, got %+v", expected, carol.Annotations())
+	}
+}
+
+func TestAnnotationOrphaned(t *testing.T) {
+	srv, _ := newTestServer(t, "Lorem Ipsum Dolor", nil)
+	defer srv.Close()
+
+	alice := dialAndJoin(t, srv, "alice")
+	defer alice.Close()
+
+	if err := alice.Comment(6, 11, "typo?"); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	err := alice.Wait(testTimeout, func(c *wsclient.Client) bool {
+		return len(c.Annotations()) == 1
+	})
+	if err != nil {
+		t.Fatalf("expected the comment, got %v", err)
+	}
+
+	if err = alice.Submit(operation.New().Retain(5).Delete(6).Retain(6), nil); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if a := alice.Annotations()[0]; a.From != 5 || a.To != 5 || !a.Orphaned {
+		t.Errorf("expected an orphaned annotation at 5, got %+v", a)
+	}
+}
+
+func TestAnnotationErrors(t *testing.T) {
+	srv, _ := newTestServer(t, "Lorem Ipsum", nil)
+	defer srv.Close()
+
+	viewer, err := wsclient.Dial(wsURL(srv) + "?role=viewer")
+	if err != nil {
+		t.Fatalf("expected no error dialing, got %v", err)
+	}
+	defer viewer.Close()
+	commenter, err := wsclient.Dial(wsURL(srv) + "?role=commenter")
+	if err != nil {
+		t.Fatalf("expected no error dialing, got %v", err)
+	}
+	defer commenter.Close()
+
+	viewer.Comment(0, 5, "nice")
+	commenter.Comment(0, 12, "too long")
+	commenter.Reply("7", "who?")
+	// commenters may comment even though they may not edit
+	commenter.Comment(0, 5, "nice")
+
+	err = commenter.Wait(testTimeout, func(c *wsclient.Client) bool {
+		return len(c.ServerErrors()) >= 2 && len(c.Annotations()) == 1
+	})
+	if err != nil {
+		t.Fatalf("expected two errors and a comment, got %+v and %+v", commenter.ServerErrors(), commenter.Annotations())
+	}
+	if actual, expected := commenter.ServerErrors(), []wsclient.ServerError{
+		{Code: ErrCodeInvalidRange, Message: session.ErrInvalidRange.Error(), Event: "comment"},
+		{Code: ErrCodeUnknownAnnotation, Message: session.ErrUnknownAnnotation.Error(), Event: "reply"},
+	}; !reflect.DeepEqual(actual, expected) {
+		t.Errorf("expected %+v, got %+v", expected, actual)
+	}
+
+	err = viewer.Wait(testTimeout, func(c *wsclient.Client) bool {
+		return len(c.ServerErrors()) > 0 && len(c.Annotations()) == 1
+	})
+	if err != nil {
+		t.Fatalf("expected an error and the commenter's comment, got %v", err)
+	}
+	if actual, expected := viewer.ServerErrors()[0].Code, ErrCodeForbidden; actual != expected {
+		t.Errorf("expected %q, got %q", expected, actual)
+	}
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+	"github.com/nitrous-io/ot.go/ot/operation"
+)
+
+// The http api lets server-side tools read and edit documents without a
+// websocket:
+//
+//	GET  /api/docs/{docID}                   {"document": ..., "revision": ...}
+//	GET  /api/docs/{docID}/ops?since=rev     {"revision": ..., "ops": [op, ...]}
+//	GET  /api/docs/{docID}/revisions/{rev}   {"document": ..., "revision": rev}
+//	POST /api/docs/{docID}/ops               {"revision": rev, "op": op}
+//
+// POST answers with the revision of the edit and the op transformed against
+// the edits it was concurrent to. Requests run on the session's event loop,
+// so they are serialized with websocket edits. Errors are EventErrors.
+func addAPIRoutes(r *mux.Router, registry *Registry) {
+	r.Handle("", documentHandler(registry, getDocument)).Methods("GET")
+	r.Handle("/ops", documentHandler(registry, getOperations)).Methods("GET")
+	r.Handle("/ops", documentHandler(registry, postOperation)).Methods("POST")
+	r.Handle("/revisions/{revision:[0-9]+}", documentHandler(registry, getRevision)).Methods("GET")
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeAPIError(w http.ResponseWriter, err *EventError) {
+	status := http.StatusBadRequest
+	switch err.Code {
+	case ErrCodeForbidden:
+		status = http.StatusForbidden
+	case ErrCodeInvalidRevision, ErrCodeBaseLenMismatch:
+		status = http.StatusConflict
+	case ErrCodeDocumentTooLong:
+		status = http.StatusRequestEntityTooLarge
+	case ErrCodeRateLimited:
+		status = http.StatusTooManyRequests
+	case ErrCodeVetoed:
+		status = http.StatusUnprocessableEntity
+	case ErrCodeUnavailable:
+		status = http.StatusServiceUnavailable
+	}
+	writeJSON(w, status, err)
+}
+
+var errSessionUnavailable = newEventError(ErrCodeUnavailable, ErrSessionClosed.Error())
+
+func getDocument(s *Session, identity *Identity, w http.ResponseWriter, r *http.Request) {
+	var doc string
+	var revision int
+	err := s.Call(func() {
+		doc, revision = s.Document, len(s.Operations)
+	})
+	if err != nil {
+		writeAPIError(w, errSessionUnavailable)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"document": doc,
+		"revision": revision,
+	})
+}
+
+func getOperations(s *Session, identity *Identity, w http.ResponseWriter, r *http.Request) {
+	since, err := strconv.Atoi(r.URL.Query().Get("since"))
+	if err != nil {
+		writeAPIError(w, newEventError(ErrCodeInvalidRevision, "since must be an integer"))
+		return
+	}
+
+	var ops []*operation.Operation
+	var authors []string
+	var revision int
+	var opsErr error
+	err = s.Call(func() {
+		if ops, opsErr = s.OperationsSince(since); opsErr == nil {
+			authors = s.authors[since:]
+		}
+		revision = len(s.Operations)
+	})
+	if err != nil {
+		writeAPIError(w, errSessionUnavailable)
+		return
+	}
+	if opsErr != nil {
+		writeAPIError(w, operationError(opsErr))
+		return
+	}
+
+	// operations are never modified once applied, so they can be marshalled
+	// off the event loop
+	marshalled := make([]interface{}, len(ops))
+	for i, op := range ops {
+		marshalled[i] = op.Marshal()
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"revision": revision,
+		"ops":      marshalled,
+		"authors":  authors, // client id of each op's author, empty for the api
+	})
+}
+
+func getRevision(s *Session, identity *Identity, w http.ResponseWriter, r *http.Request) {
+	revision, err := strconv.Atoi(mux.Vars(r)["revision"])
+	if err != nil {
+		writeAPIError(w, newEventError(ErrCodeInvalidRevision, "revision must be an integer"))
+		return
+	}
+
+	var doc string
+	var ops []*operation.Operation
+	err = s.Call(func() {
+		if revision <= len(s.Operations) {
+			doc, ops = s.initial, s.Operations[:revision]
+		}
+	})
+	if err != nil {
+		writeAPIError(w, errSessionUnavailable)
+		return
+	}
+	if ops == nil {
+		writeAPIError(w, newEventError(ErrCodeInvalidRevision, "no such revision"))
+		return
+	}
+
+	// replay the history off the event loop
+	for _, op := range ops {
+		if doc, err = op.Apply(doc); err != nil {
+			writeAPIError(w, newEventError(ErrCodeMalformedOp, err.Error()))
+			return
+		}
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"document": doc,
+		"revision": revision,
+	})
+}
+
+func postOperation(s *Session, identity *Identity, w http.ResponseWriter, r *http.Request) {
+	if !identity.Role.CanEdit() {
+		writeAPIError(w, newEventError(ErrCodeForbidden, identity.Role.String()+" may not edit the document"))
+		return
+	}
+
+	var body io.Reader = r.Body
+	if n := s.Limits.MaxMessageBytes; n > 0 {
+		body = http.MaxBytesReader(w, r.Body, n)
+	}
+	var data struct {
+		Revision *int          `json:"revision"`
+		Op       []interface{} `json:"op"`
+	}
+	if err := json.NewDecoder(body).Decode(&data); err != nil {
+		writeAPIError(w, newEventError(ErrCodeMalformedOp, err.Error()))
+		return
+	}
+	if data.Revision == nil {
+		writeAPIError(w, newEventError(ErrCodeInvalidRevision, "revision is required"))
+		return
+	}
+	op, err := operation.Unmarshal(data.Op)
+	if err != nil {
+		writeAPIError(w, newEventError(ErrCodeMalformedOp, err.Error()))
+		return
+	}
+
+	var top *operation.Operation
+	var eerr *EventError
+	var revision int
+	err = s.Call(func() {
+		top, eerr = s.applyOperation("", nil, *data.Revision, op)
+		revision = len(s.Operations)
+	})
+	if err != nil {
+		writeAPIError(w, errSessionUnavailable)
+		return
+	}
+	if eerr != nil {
+		writeAPIError(w, eerr)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"revision": revision,
+		"op":       top.Marshal(),
+	})
+}
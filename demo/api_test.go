@@ -0,0 +1,150 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/nitrous-io/ot.go/demo/wsclient"
+	"github.com/nitrous-io/ot.go/ot/operation"
+)
+
+// apiRequest sends body, if any, and decodes the response into v
+func apiRequest(t *testing.T, method, url, body string, v interface{}) int {
+	req, err := http.NewRequest(method, url, strings.NewReader(body))
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("expected no error requesting %s %s, got %v", method, url, err)
+	}
+	defer resp.Body.Close()
+	if err = json.NewDecoder(resp.Body).Decode(v); err != nil {
+		t.Fatalf("expected json from %s %s, got %v", method, url, err)
+	}
+	return resp.StatusCode
+}
+
+type apiDocument struct {
+	Document string `json:"document"`
+	Revision int    `json:"revision"`
+}
+
+func TestAPI(t *testing.T) {
+	srv := httptest.NewServer(newRouter(NewRegistry(StaticSource("hello"))))
+	defer srv.Close()
+	api := srv.URL + "/api/docs/foo"
+
+	var doc apiDocument
+	if status := apiRequest(t, "GET", api, "", &doc); status != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", status)
+	}
+	if actual, expected := doc, (apiDocument{"hello", 0}); actual != expected {
+		t.Errorf("expected %+v, got %+v", expected, actual)
+	}
+
+	// a websocket client edits concurrently with the api
+	alice, err := wsclient.Dial(wsURL(srv) + "/ws/foo")
+	if err != nil {
+		t.Fatalf("expected no error dialing, got %v", err)
+	}
+	defer alice.Close()
+	if err = alice.Submit(operation.New().Retain(5).Insert(" world"), nil); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if err = alice.WaitSynchronized(testTimeout); err != nil {
+		t.Fatalf("expected alice to synchronize, got %v", err)
+	}
+
+	// the api edit is transformed against alice's
+	var posted struct {
+		Revision int           `json:"revision"`
+		Op       []interface{} `json:"op"`
+	}
+	status := apiRequest(t, "POST", api+"/ops", `{"revision": 0, "op": [-1, "H", 4]}`, &posted)
+	if status != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", status)
+	}
+	if actual, expected := posted.Revision, 2; actual != expected {
+		t.Errorf("expected revision %d, got %d", expected, actual)
+	}
+	if actual, expected := posted.Op, []interface{}{"H", -1.0, 10.0}; !reflect.DeepEqual(actual, expected) {
+		t.Errorf("expected transformed op %v, got %v", expected, actual)
+	}
+
+	if err = alice.WaitRevision(2, testTimeout); err != nil {
+		t.Fatalf("expected alice to receive the api edit, got %v", err)
+	}
+	if actual, expected := alice.Document(), "Hello world"; actual != expected {
+		t.Errorf("expected document to be %s, got %s", expected, actual)
+	}
+
+	var ops struct {
+		Revision int             `json:"revision"`
+		Ops      [][]interface{} `json:"ops"`
+		Authors  []string        `json:"authors"`
+	}
+	if status = apiRequest(t, "GET", api+"/ops?since=1", "", &ops); status != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", status)
+	}
+	if actual, expected := ops.Ops, [][]interface{}{{"H", -1.0, 10.0}}; !reflect.DeepEqual(actual, expected) {
+		t.Errorf("expected ops %v, got %v", expected, actual)
+	}
+	if actual, expected := ops.Authors, []string{""}; !reflect.DeepEqual(actual, expected) {
+		t.Errorf("expected authors %v, got %v", expected, actual)
+	}
+
+	for rev, expected := range []string{"hello", "hello world", "Hello world"} {
+		if status = apiRequest(t, "GET", api+"/revisions/"+strconv.Itoa(rev), "", &doc); status != http.StatusOK {
+			t.Fatalf("expected status 200, got %d", status)
+		}
+		if actual := doc.Document; actual != expected {
+			t.Errorf("expected document at revision %d to be %s, got %s", rev, expected, actual)
+		}
+	}
+
+	for _, tc := range []struct {
+		method, path, body string
+		status             int
+		code               string
+	}{
+		{"GET", "/revisions/3", "", http.StatusConflict, ErrCodeInvalidRevision},
+		{"GET", "/ops?since=x", "", http.StatusConflict, ErrCodeInvalidRevision},
+		{"GET", "/ops?since=3", "", http.StatusConflict, ErrCodeInvalidRevision},
+		{"POST", "/ops", `{"op": [11]}`, http.StatusConflict, ErrCodeInvalidRevision},
+		{"POST", "/ops", `{"revision": 2, "op": [5]}`, http.StatusConflict, ErrCodeBaseLenMismatch},
+		{"POST", "/ops", `{"revision": 2, "op": [true]}`, http.StatusBadRequest, ErrCodeMalformedOp},
+		{"POST", "/ops", `not json`, http.StatusBadRequest, ErrCodeMalformedOp},
+	} {
+		var eerr EventError
+		if actual, expected := apiRequest(t, tc.method, api+tc.path, tc.body, &eerr), tc.status; actual != expected {
+			t.Errorf("expected status %d for %s %s, got %d", expected, tc.method, tc.path, actual)
+		}
+		if actual, expected := eerr.Code, tc.code; actual != expected {
+			t.Errorf("expected code %s for %s %s %s, got %s", expected, tc.method, tc.path, tc.body, actual)
+		}
+	}
+}
+
+func TestAPIPermissions(t *testing.T) {
+	r := NewRegistry(StaticSource("hello"))
+	r.Authenticator = Anonymous(RoleViewer)
+	srv := httptest.NewServer(newRouter(r))
+	defer srv.Close()
+
+	var eerr EventError
+	status := apiRequest(t, "POST", srv.URL+"/api/docs/foo/ops", `{"revision": 0, "op": [5, "!"]}`, &eerr)
+	if actual, expected := status, http.StatusForbidden; actual != expected {
+		t.Errorf("expected status %d, got %d", expected, actual)
+	}
+
+	var doc apiDocument
+	if status = apiRequest(t, "GET", srv.URL+"/api/docs/foo", "", &doc); status != http.StatusOK {
+		t.Errorf("expected viewers to read the document, got status %d", status)
+	}
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+)
+
+var (
+	ErrUnauthorized = errors.New("demo: unauthorized")
+	ErrInvalidToken = errors.New("demo: invalid token")
+	ErrTokenExpired = errors.New("demo: token expired")
+	ErrInvalidRole  = errors.New("demo: invalid role")
+)
+
+// Role is what a client may do with a document. Roles are ordered, each one
+// can do everything the previous ones can.
+type Role int
+
+const (
+	RoleViewer Role = iota
+	RoleCommenter
+	RoleEditor
+	RoleOwner
+)
+
+var roleNames = []string{"viewer", "commenter", "editor", "owner"}
+
+func (r Role) String() string {
+	if r < 0 || int(r) >= len(roleNames) {
+		return "unknown"
+	}
+	return roleNames[r]
+}
+
+func ParseRole(s string) (Role, error) {
+	for i, name := range roleNames {
+		if name == s {
+			return Role(i), nil
+		}
+	}
+	return 0, ErrInvalidRole
+}
+
+// CanEdit reports whether clients with role r may send operations.
+func (r Role) CanEdit() bool {
+	return r >= RoleEditor
+}
+
+// CanComment reports whether clients with role r may comment on the document.
+func (r Role) CanComment() bool {
+	return r >= RoleCommenter
+}
+
+func (r Role) MarshalText() ([]byte, error) {
+	if r < 0 || int(r) >= len(roleNames) {
+		return nil, ErrInvalidRole
+	}
+	return []byte(r.String()), nil
+}
+
+func (r *Role) UnmarshalText(b []byte) error {
+	role, err := ParseRole(string(b))
+	if err != nil {
+		return err
+	}
+	*r = role
+	return nil
+}
+
+// Identity is who a connection belongs to, as established by an
+// Authenticator.
+type Identity struct {
+	Name string // verified user name, empty if the client picks its own
+	Role Role
+}
+
+// Authenticator decides who is opening a connection to a document before the
+// websocket is upgraded. It returns ErrUnauthorized, or another error, to
+// refuse the connection.
+type Authenticator interface {
+	Authenticate(r *http.Request, docID string) (*Identity, error)
+}
+
+type AuthenticatorFunc func(r *http.Request, docID string) (*Identity, error)
+
+func (f AuthenticatorFunc) Authenticate(r *http.Request, docID string) (*Identity, error) {
+	return f(r, docID)
+}
+
+// Anonymous lets everyone in with the same role and their own user name.
+type Anonymous Role
+
+func (a Anonymous) Authenticate(r *http.Request, docID string) (*Identity, error) {
+	return &Identity{Role: Role(a)}, nil
+}
+
+// Claims are what a token vouches for.
+type Claims struct {
+	Name    string `json:"name"`
+	Doc     string `json:"doc,omitempty"` // empty for all documents
+	Role    Role   `json:"role"`
+	Expires int64  `json:"exp,omitempty"` // unix time, 0 for never
+}
+
+// TokenAuthenticator accepts tokens signed with Key, so that an application
+// can hand out access to documents without the server calling back to it. The
+// token is read from the access_token query parameter, since browsers cannot
+// set headers on websocket requests, or from a bearer Authorization header.
+//
+// A token is the base64url encoded JSON claims and their HMAC-SHA256, joined
+// by a dot.
+type TokenAuthenticator struct {
+	Key []byte
+}
+
+var tokenEncoding = base64.RawURLEncoding
+
+func (a *TokenAuthenticator) sign(payload string) string {
+	mac := hmac.New(sha256.New, a.Key)
+	mac.Write([]byte(payload))
+	return tokenEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// NewToken returns a token for claims.
+func (a *TokenAuthenticator) NewToken(claims *Claims) (string, error) {
+	j, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	payload := tokenEncoding.EncodeToString(j)
+	return payload + "." + a.sign(payload), nil
+}
+
+// Verify checks the signature and expiry of token and returns its claims.
+func (a *TokenAuthenticator) Verify(token string) (*Claims, error) {
+	i := strings.IndexByte(token, '.')
+	if i < 0 {
+		return nil, ErrInvalidToken
+	}
+	payload, sig := token[:i], token[i+1:]
+	if !hmac.Equal([]byte(sig), []byte(a.sign(payload))) {
+		return nil, ErrInvalidToken
+	}
+
+	j, err := tokenEncoding.DecodeString(payload)
+	if err != nil {
+		return nil, ErrInvalidToken
+	}
+	claims := &Claims{}
+	if err = json.Unmarshal(j, claims); err != nil {
+		return nil, ErrInvalidToken
+	}
+	if claims.Expires != 0 && time.Now().Unix() >= claims.Expires {
+		return nil, ErrTokenExpired
+	}
+	return claims, nil
+}
+
+func (a *TokenAuthenticator) Authenticate(r *http.Request, docID string) (*Identity, error) {
+	token := r.URL.Query().Get("access_token")
+	if h := r.Header.Get("Authorization"); token == "" && strings.HasPrefix(h, "Bearer ") {
+		token = strings.TrimPrefix(h, "Bearer ")
+	}
+	if token == "" {
+		return nil, ErrUnauthorized
+	}
+
+	claims, err := a.Verify(token)
+	if err != nil {
+		return nil, err
+	}
+	if claims.Name == "" || (claims.Doc != "" && claims.Doc != docID) {
+		return nil, ErrUnauthorized
+	}
+	return &Identity{Name: claims.Name, Role: claims.Role}, nil
+}
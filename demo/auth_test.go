@@ -0,0 +1,154 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/nitrous-io/ot.go/demo/wsclient"
+	"github.com/nitrous-io/ot.go/ot/operation"
+)
+
+func TestRole(t *testing.T) {
+	for _, role := range []Role{RoleViewer, RoleCommenter, RoleEditor, RoleOwner} {
+		b, err := role.MarshalText()
+		if err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		var parsed Role
+		if err = parsed.UnmarshalText(b); err != nil || parsed != role {
+			t.Errorf("expected %s to round trip, got %s and %v", role, parsed, err)
+		}
+	}
+
+	if _, err := ParseRole("admin"); err != ErrInvalidRole {
+		t.Errorf("expected ErrInvalidRole, got %v", err)
+	}
+
+	if RoleCommenter.CanEdit() || !RoleEditor.CanEdit() {
+		t.Errorf("expected only editors and owners to edit")
+	}
+}
+
+func TestTokenAuthenticator(t *testing.T) {
+	a := &TokenAuthenticator{Key: []byte("secret")}
+
+	token, err := a.NewToken(&Claims{Name: "alice", Doc: "foo", Role: RoleCommenter})
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	claims, err := a.Verify(token)
+	if err != nil {
+		t.Fatalf("expected no error verifying, got %v", err)
+	}
+	if actual, expected := *claims, (Claims{Name: "alice", Doc: "foo", Role: RoleCommenter}); actual != expected {
+		t.Errorf("expected %+v, got %+v", expected, actual)
+	}
+
+	other := &TokenAuthenticator{Key: []byte("other")}
+	for _, bad := range []string{"", "abc", token + "x", "x" + token} {
+		if _, err = a.Verify(bad); err != ErrInvalidToken {
+			t.Errorf("expected ErrInvalidToken for %q, got %v", bad, err)
+		}
+	}
+	if _, err = other.Verify(token); err != ErrInvalidToken {
+		t.Errorf("expected ErrInvalidToken with another key, got %v", err)
+	}
+
+	expired, _ := a.NewToken(&Claims{Name: "alice", Expires: time.Now().Add(-time.Minute).Unix()})
+	if _, err = a.Verify(expired); err != ErrTokenExpired {
+		t.Errorf("expected ErrTokenExpired, got %v", err)
+	}
+
+	// the token only grants access to its document
+	r := httptest.NewRequest("GET", "/ws/foo?access_token="+token, nil)
+	if id, err := a.Authenticate(r, "foo"); err != nil || *id != (Identity{"alice", RoleCommenter}) {
+		t.Errorf("expected alice as commenter, got %+v and %v", id, err)
+	}
+	if _, err = a.Authenticate(r, "bar"); err != ErrUnauthorized {
+		t.Errorf("expected ErrUnauthorized for another document, got %v", err)
+	}
+
+	r = httptest.NewRequest("GET", "/ws/foo", nil)
+	if _, err = a.Authenticate(r, "foo"); err != ErrUnauthorized {
+		t.Errorf("expected ErrUnauthorized without a token, got %v", err)
+	}
+	r.Header.Set("Authorization", "Bearer "+token)
+	if _, err = a.Authenticate(r, "foo"); err != nil {
+		t.Errorf("expected bearer token to be accepted, got %v", err)
+	}
+}
+
+func TestPermissions(t *testing.T) {
+	auth := &TokenAuthenticator{Key: []byte("secret")}
+	r := NewRegistry(StaticSource("hello"))
+	r.Authenticator = auth
+	srv := httptest.NewServer(newRouter(r))
+	defer srv.Close()
+
+	dial := func(name string, role Role) *wsclient.Client {
+		token, _ := auth.NewToken(&Claims{Name: name, Role: role})
+		c, err := wsclient.Dial(wsURL(srv) + "/ws/foo?access_token=" + token)
+		if err != nil {
+			t.Fatalf("expected no error dialing, got %v", err)
+		}
+		// the verified name wins over the one the client picks
+		if err = c.Join("mallory", testTimeout); err != nil {
+			t.Fatalf("expected no error joining, got %v", err)
+		}
+		return c
+	}
+
+	if _, err := wsclient.Dial(wsURL(srv) + "/ws/foo"); err == nil {
+		t.Fatalf("expected dialing without a token to fail")
+	}
+
+	bob := dial("bob", RoleEditor)
+	defer bob.Close()
+	alice := dial("alice", RoleViewer)
+	defer alice.Close()
+
+	if actual, expected := alice.Role(), "viewer"; actual != expected {
+		t.Errorf("expected role %s, got %s", expected, actual)
+	}
+
+	err := bob.Wait(testTimeout, func(c *wsclient.Client) bool {
+		return c.Clients()[alice.ID()].Name == "alice"
+	})
+	if err != nil {
+		t.Fatalf("expected bob to see alice under the verified name, got %v", err)
+	}
+
+	// a viewer cannot edit
+	alice.Submit(operation.New().Retain(5).Insert("!"), nil)
+	var errs []wsclient.ServerError
+	err = alice.Wait(testTimeout, func(c *wsclient.Client) bool {
+		errs = c.ServerErrors()
+		return len(errs) > 0
+	})
+	if err != nil {
+		t.Fatalf("expected alice to receive an error, got %v", err)
+	}
+	if actual, expected := errs[0].Code, ErrCodeForbidden; actual != expected {
+		t.Errorf("expected code %s, got %s", expected, actual)
+	}
+	// and alice is back in sync without the edit
+	if err = alice.WaitSynchronized(testTimeout); err != nil {
+		t.Fatalf("expected alice to resync, got %v", err)
+	}
+	if actual, expected := alice.Document(), "hello"; actual != expected {
+		t.Errorf("expected document to be %s, got %s", expected, actual)
+	}
+
+	// an editor can
+	if err = bob.Submit(operation.New().Retain(5).Insert("?"), nil); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if err = bob.WaitSynchronized(testTimeout); err != nil {
+		t.Fatalf("expected bob's edit to be acknowledged, got %v", err)
+	}
+	if actual, expected := bob.Document(), "hello?"; actual != expected {
+		t.Errorf("expected document to be %s, got %s", expected, actual)
+	}
+}
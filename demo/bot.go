@@ -0,0 +1,121 @@
+package main
+
+import (
+	"errors"
+	"strconv"
+
+	"github.com/nitrous-io/ot.go/demo/protocol"
+	"github.com/nitrous-io/ot.go/ot/operation"
+	"github.com/nitrous-io/ot.go/ot/selection"
+)
+
+var (
+	ErrBotLeft = errors.New("demo: bot has left the session")
+)
+
+// Bot is a participant that lives on the server, such as a formatter, a
+// linter or an assistant. It has no connection, but other clients see it
+// join, edit, move its cursor and quit like any other client.
+type Bot struct {
+	ID      string
+	Name    string
+	session *Session
+}
+
+// AddBot adds a bot named name to s.
+func (s *Session) AddBot(name string) (*Bot, error) {
+	b := &Bot{Name: name, session: s}
+	var err error
+	if cerr := s.Call(func() {
+		if s.shutdown != nil {
+			err = ErrSessionClosed
+			return
+		}
+		b.ID = "bot-" + strconv.Itoa(s.nextConnID)
+		s.nextConnID++
+		s.AddClient(b.ID)
+		s.SetName(b.ID, name)
+		s.broadcast(&protocol.Joined{ClientID: b.ID, Username: name}, nil)
+	}); cerr != nil {
+		return nil, cerr
+	}
+	if err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// Document returns the document and its revision, which bots base their
+// operations on.
+func (b *Bot) Document() (doc string, revision int, err error) {
+	s := b.session
+	err = s.Call(func() {
+		doc, revision = s.Document, len(s.Operations)
+	})
+	return doc, revision, err
+}
+
+// Submit transforms op, which is based on revision, applies it and
+// broadcasts it as an edit of b. sel, if not nil, is b's selection after the
+// edit. It returns the operation as it was applied; an *EventError tells why
+// it was rejected.
+func (b *Bot) Submit(revision int, op *operation.Operation, sel *selection.Selection) (*operation.Operation, error) {
+	var top *operation.Operation
+	var err error
+	if cerr := b.call(func(s *Session) {
+		if sel != nil {
+			if eerr := s.checkSelection(sel); eerr != nil {
+				err = eerr
+				return
+			}
+			op.Meta = sel
+		}
+		var eerr *EventError
+		if top, eerr = s.applyOperation(b.ID, nil, revision, op); eerr != nil {
+			err = eerr
+		}
+	}); cerr != nil {
+		return nil, cerr
+	}
+	return top, err
+}
+
+// SetSelection moves b's cursor. A nil selection clears it.
+func (b *Bot) SetSelection(sel *selection.Selection) error {
+	var err error
+	if cerr := b.call(func(s *Session) {
+		sel, eerr := s.setSelection(b.ID, sel)
+		if eerr != nil {
+			err = eerr
+			return
+		}
+		s.broadcast(&protocol.RemoteSel{ClientID: b.ID, Selection: sel}, nil)
+	}); cerr != nil {
+		return cerr
+	}
+	return err
+}
+
+// Leave removes b from the session.
+func (b *Bot) Leave() error {
+	return b.call(func(s *Session) {
+		s.removeClient(b.ID)
+	})
+}
+
+// call runs f on the event loop if b is still in the session
+func (b *Bot) call(f func(s *Session)) error {
+	s := b.session
+	left := false
+	err := s.Call(func() {
+		if s.Clients[b.ID] == nil {
+			left = true
+			return
+		}
+		f(s)
+	})
+	if err == nil && left {
+		err = ErrBotLeft
+	}
+	return err
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/nitrous-io/ot.go/demo/wsclient"
+	"github.com/nitrous-io/ot.go/ot/operation"
+	"github.com/nitrous-io/ot.go/ot/selection"
+)
+
+func TestBot(t *testing.T) {
+	srv, s := newTestServer(t, "hello", nil)
+	defer srv.Close()
+
+	alice := dialAndJoin(t, srv, "alice")
+	defer alice.Close()
+
+	bot, err := s.AddBot("formatter")
+	if err != nil {
+		t.Fatalf("expected no error adding bot, got %v", err)
+	}
+	err = alice.Wait(testTimeout, func(c *wsclient.Client) bool {
+		return c.Clients()[bot.ID].Name == "formatter"
+	})
+	if err != nil {
+		t.Fatalf("expected alice to see the bot join, got %v", err)
+	}
+
+	// the bot edits an old revision concurrently with alice
+	_, revision, err := bot.Document()
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if err = alice.Submit(operation.New().Insert(">").Retain(5), nil); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if err = alice.WaitSynchronized(testTimeout); err != nil {
+		t.Fatalf("expected alice to synchronize, got %v", err)
+	}
+	sel := &selection.Selection{Ranges: []selection.Range{{Anchor: 6, Head: 6}}}
+	top, err := bot.Submit(revision, operation.New().Retain(5).Insert("!"), sel)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if actual, expected := top.BaseLen, 6; actual != expected {
+		t.Errorf("expected the op to be transformed to base length %d, got %d", expected, actual)
+	}
+
+	if err = alice.WaitRevision(2, testTimeout); err != nil {
+		t.Fatalf("expected alice to receive the bot's edit, got %v", err)
+	}
+	if actual, expected := alice.Document(), ">hello!"; actual != expected {
+		t.Errorf("expected document %q, got %q", expected, actual)
+	}
+	// alice sees the bot's cursor, transformed past alice's own insert
+	if actual, expected := alice.Clients()[bot.ID].Selection.Ranges, []selection.Range{{Anchor: 7, Head: 7}}; len(actual) != 1 || actual[0] != expected[0] {
+		t.Errorf("expected bot selection %v, got %v", expected, actual)
+	}
+
+	var authors []string
+	s.Call(func() { authors = s.authors })
+	if actual, expected := authors[1], bot.ID; actual != expected {
+		t.Errorf("expected the edit to be attributed to %s, got %s", expected, actual)
+	}
+
+	if err = bot.SetSelection(nil); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	err = alice.Wait(testTimeout, func(c *wsclient.Client) bool {
+		return len(c.Clients()[bot.ID].Selection.Ranges) == 0
+	})
+	if err != nil {
+		t.Fatalf("expected alice to see the bot's cursor cleared, got %v", err)
+	}
+
+	if err = bot.Leave(); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	err = alice.Wait(testTimeout, func(c *wsclient.Client) bool {
+		_, ok := c.Clients()[bot.ID]
+		return !ok
+	})
+	if err != nil {
+		t.Fatalf("expected alice to see the bot quit, got %v", err)
+	}
+	if _, err = bot.Submit(2, operation.New().Retain(7), nil); err != ErrBotLeft {
+		t.Errorf("expected %v, got %v", ErrBotLeft, err)
+	}
+}
@@ -1,9 +1,16 @@
 package main
 
 import (
-	"encoding/json"
+	"errors"
+	"sync"
+	"time"
 
-	"github.com/gorilla/websocket"
+	"github.com/nitrous-io/ot.go/demo/protocol"
+)
+
+var (
+	ErrConnectionClosed = errors.New("demo: connection closed")
+	ErrSendQueueFull    = errors.New("demo: send queue full")
 )
 
 type Event struct {
@@ -11,77 +18,360 @@ type Event struct {
 	Data interface{} `json:"d,omitempty"`
 }
 
+// QueueFullPolicy decides what happens when a client does not read its
+// events fast enough and its send queue fills up.
+type QueueFullPolicy int
+
+const (
+	// QueueFullDisconnect closes the connection. The client can resume.
+	QueueFullDisconnect QueueFullPolicy = iota
+	// QueueFullResync drops the queued events and sends the whole document
+	// once the client catches up.
+	QueueFullResync
+)
+
+type ConnOptions struct {
+	SendQueueSize   int           // number of events buffered per connection
+	WriteTimeout    time.Duration // maximum time a single write may take
+	QueueFullPolicy QueueFullPolicy
+
+	// PingInterval is how often the client is pinged, and PongTimeout how
+	// long it may stay silent before it is considered dead. PongTimeout
+	// should be well above PingInterval. 0 disables either.
+	PingInterval time.Duration
+	PongTimeout  time.Duration
+
+	// Compression enables permessage-deflate for websocket clients that
+	// offer it. It trades cpu for bandwidth.
+	Compression bool
+}
+
+var DefaultConnOptions = ConnOptions{
+	SendQueueSize:   256,
+	WriteTimeout:    10 * time.Second,
+	QueueFullPolicy: QueueFullDisconnect,
+	PingInterval:    25 * time.Second,
+	PongTimeout:     60 * time.Second,
+}
+
 type Connection struct {
-	ID      string
-	Session *Session
-	Ws      *websocket.Conn
+	ID        string
+	Session   *Session
+	Transport Transport
+	Identity  *Identity
+	// Protocol is negotiated when the client connects
+	Protocol protocol.Protocol
+
+	// Spectator connections only watch, see Spectate
+	Spectator bool
+
+	opBucket *tokenBucket // owned by the session's event loop
+
+	options ConnOptions
+
+	queueLock sync.Mutex
+	queue     chan []byte
+	resyncing bool          // queued events were dropped and a resync is pending
+	resync    chan struct{} // wakes up the writer to request a resync
+	goingAway bool          // the close frame is queued, nothing follows it
+	closed    chan struct{}
+	closeOnce sync.Once
 }
 
 type ConnEvent struct {
 	Conn *Connection
 	*Event
+
+	internal bool // posted by the server rather than read from the client
 }
 
-func NewConnection(session *Session, ws *websocket.Conn) *Connection {
-	return &Connection{Session: session, Ws: ws}
+func NewConnection(session *Session, transport Transport) *Connection {
+	return &Connection{
+		Session:   session,
+		Transport: transport,
+		Identity:  &Identity{Role: RoleEditor},
+		Protocol:  protocol.Default,
+		options:   session.ConnOptions,
+		queue:     make(chan []byte, session.ConnOptions.SendQueueSize),
+		resync:    make(chan struct{}, 1),
+		closed:    make(chan struct{}),
+	}
 }
 
-func (c *Connection) Handle() error {
+// Handle serves the connection until it is closed. resume is nil unless the
+// client is reconnecting.
+func (c *Connection) Handle(resume *Resume) error {
 	s := c.Session
 
-	err := c.Send(&Event{"doc", map[string]interface{}{
-		"document": s.Document,
-		"revision": len(c.Session.Operations),
-		"clients":  s.Clients,
-	}})
-	if err != nil {
-		return err
+	go c.writeEvents()
+	defer c.Close()
+
+	if !s.post(ConnEvent{c, &Event{"register", resume}, true}) {
+		return ErrSessionClosed
 	}
 
-	s.RegisterConnection(c)
+	for {
+		e, err := c.ReadEvent()
+		if eerr, ok := err.(*EventError); ok {
+			c.Send(eerr.event())
+			continue
+		}
+		if err != nil {
+			break
+		}
+
+		if !s.post(ConnEvent{c, e, false}) {
+			return ErrSessionClosed
+		}
+	}
+
+	s.post(ConnEvent{c, &Event{Name: "unregister"}, true})
+
+	return nil
+}
+
+// Spectate serves a spectator connection until it is closed. Spectators
+// receive the document and then every op, sel, join and quit event, but are
+// not clients of the session: they cannot send events and nobody sees them.
+func (c *Connection) Spectate() error {
+	s := c.Session
+	c.Spectator = true
+
+	go c.writeEvents()
+	defer c.Close()
+
+	if !s.post(ConnEvent{c, &Event{Name: "spectate"}, true}) {
+		return ErrSessionClosed
+	}
 
 	for {
 		e, err := c.ReadEvent()
+		if eerr, ok := err.(*EventError); ok {
+			c.Send(eerr.event())
+			continue
+		}
 		if err != nil {
 			break
 		}
 
-		s.EventChan <- ConnEvent{c, e}
+		eerr := newEventError(ErrCodeForbidden, "spectators cannot send events")
+		eerr.Event = e.Name
+		c.Send(eerr.event())
 	}
 
-	s.UnregisterConnection(c)
-	c.Broadcast(&Event{"quit", c.ID})
+	s.spectators.send(spectatorCmd{kind: spectatorRemove, conn: c}, s.done)
 
 	return nil
 }
 
+// ReadEvent reads the next message of the client. Its data is the decoded
+// protocol.Message. Messages that cannot be decoded are *EventErrors.
 func (c *Connection) ReadEvent() (*Event, error) {
-	_, msg, err := c.Ws.ReadMessage()
+	msg, err := c.Transport.ReadMessage()
 	if err != nil {
 		return nil, err
 	}
-	m := &Event{}
-	if err = json.Unmarshal(msg, &m); err != nil {
-		return nil, err
+	m, err := protocol.DecodeClient(c.Protocol, msg)
+	if err != nil {
+		return nil, decodeError(err)
 	}
-	return m, nil
+	return &Event{m.Name(), m}, nil
 }
 
-func (c *Connection) Send(msg *Event) error {
-	j, err := json.Marshal(msg)
+// Send queues msg to be written to the client. It never blocks.
+func (c *Connection) Send(msg protocol.Message) error {
+	j, err := protocol.Encode(c.Protocol, msg)
 	if err != nil {
 		return err
 	}
-	if err = c.Ws.WriteMessage(websocket.TextMessage, j); err != nil {
+	return c.enqueue(j)
+}
+
+// encoded caches a message in each protocol it is sent in, so that a
+// broadcast encodes it once per protocol rather than once per connection.
+type encoded struct {
+	msg   protocol.Message
+	bytes map[protocol.Protocol][]byte
+}
+
+func newEncoded(msg protocol.Message) *encoded {
+	return &encoded{msg: msg, bytes: map[protocol.Protocol][]byte{}}
+}
+
+func (e *encoded) in(p protocol.Protocol) ([]byte, error) {
+	if j, ok := e.bytes[p]; ok {
+		return j, nil
+	}
+	j, err := protocol.Encode(p, e.msg)
+	if err != nil {
+		return nil, err
+	}
+	e.bytes[p] = j
+	return j, nil
+}
+
+// encodeAll encodes msg in every supported protocol, for connections whose
+// protocols are not known in advance
+func encodeAll(msg protocol.Message) map[protocol.Protocol][]byte {
+	e := newEncoded(msg)
+	for _, p := range protocol.Supported {
+		e.in(p)
+	}
+	return e.bytes
+}
+
+func (c *Connection) enqueue(msg []byte) error {
+	c.queueLock.Lock()
+	defer c.queueLock.Unlock()
+
+	select {
+	case <-c.closed:
+		return ErrConnectionClosed
+	default:
+	}
+
+	if c.goingAway {
+		return ErrConnectionClosed
+	}
+
+	if c.resyncing {
+		// the client gets the whole document anyway
+		return nil
+	}
+
+	select {
+	case c.queue <- msg:
+		return nil
+	default:
+	}
+
+	if c.options.QueueFullPolicy == QueueFullResync {
+		c.resyncing = true
+		for len(c.queue) > 0 {
+			<-c.queue
+		}
+		select {
+		case c.resync <- struct{}{}:
+		default:
+		}
+		return nil
+	}
+
+	c.close()
+	return ErrSendQueueFull
+}
+
+// closeGoingAway queues a close frame telling the client that the server is
+// going away. The connection is closed once the client answers it, or after
+// the write timeout.
+func (c *Connection) closeGoingAway() {
+	c.queueLock.Lock()
+	defer c.queueLock.Unlock()
+
+	if c.goingAway {
+		return
+	}
+	c.goingAway = true
+
+	select {
+	case c.queue <- nil:
+	default:
+		// the client is too far behind to be told
+		c.close()
+	}
+}
+
+// sendResync queues the document snapshot that ends a resync. It must be
+// called from the session's event loop so that no event is lost or
+// duplicated between the snapshot and the events that follow it.
+func (c *Connection) sendResync(msg protocol.Message) error {
+	j, err := protocol.Encode(c.Protocol, msg)
+	if err != nil {
 		return err
 	}
-	return nil
+	return c.resynced(j)
+}
+
+// resynced is sendResync for an already encoded message
+func (c *Connection) resynced(msg []byte) error {
+	c.queueLock.Lock()
+	c.resyncing = false
+	c.queueLock.Unlock()
+
+	return c.enqueue(msg)
 }
 
-func (c *Connection) Broadcast(msg *Event) {
-	for conn := range c.Session.Connections {
-		if conn != c {
-			conn.Send(msg)
+// writeEvents writes queued events to the transport until the connection is
+// closed. It runs in its own go routine so that a slow client never blocks
+// the session.
+func (c *Connection) writeEvents() {
+	var ping <-chan time.Time
+	if c.options.PingInterval > 0 {
+		ticker := time.NewTicker(c.options.PingInterval)
+		defer ticker.Stop()
+		ping = ticker.C
+	}
+
+	for {
+		select {
+		case msg := <-c.queue:
+			if msg == nil {
+				c.writeClose()
+				ping = nil
+				continue
+			}
+			deadline := time.Now().Add(c.options.WriteTimeout)
+			if err := c.Transport.WriteMessage(msg, deadline); err != nil {
+				c.Close()
+				return
+			}
+		case <-ping:
+			deadline := time.Now().Add(c.options.WriteTimeout)
+			if err := c.Transport.Ping(deadline); err != nil {
+				c.Close()
+				return
+			}
+		case <-c.resync:
+			// ask the event loop for a snapshot
+			c.Session.post(ConnEvent{c, &Event{Name: "resync"}, true})
+		case <-c.closed:
+			return
 		}
 	}
 }
+
+// Close closes the connection. The read loop in Handle notices and
+// unregisters the connection from its session.
+func (c *Connection) Close() error {
+	c.queueLock.Lock()
+	defer c.queueLock.Unlock()
+	return c.close()
+}
+
+// close should be called with c.queueLock held
+func (c *Connection) close() error {
+	var err error
+	c.closeOnce.Do(func() {
+		close(c.closed)
+		err = c.Transport.Close()
+	})
+	return err
+}
+
+func (c *Connection) writeClose() {
+	deadline := time.Now().Add(c.options.WriteTimeout)
+	if err := c.Transport.CloseGoingAway(deadline); err != nil {
+		c.Close()
+		return
+	}
+	// the read loop ends when the client answers
+	time.AfterFunc(c.options.WriteTimeout, func() {
+		c.Close()
+	})
+}
+
+// Broadcast sends msg to all other connections of the session. It must be
+// called from the session's event loop.
+func (c *Connection) Broadcast(msg protocol.Message) {
+	c.Session.broadcast(msg, c)
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/nitrous-io/ot.go/demo/wsclient"
+	"github.com/nitrous-io/ot.go/ot/operation"
+)
+
+// smallBufListener shrinks the kernel buffers of accepted connections so that
+// a client that stops reading stalls the server's writes quickly
+type smallBufListener struct {
+	net.Listener
+}
+
+func (l smallBufListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if tc, ok := conn.(*net.TCPConn); ok {
+		tc.SetWriteBuffer(32 * 1024)
+	}
+	return conn, err
+}
+
+func newStallTestServer(t *testing.T, doc string, options ConnOptions) (*httptest.Server, *Session) {
+	srv, s := newUnstartedTestServer(t, doc, func(s *Session) {
+		s.GracePeriod = 0
+		s.ConnOptions = options
+		s.Limits = Limits{}
+	})
+	srv.Listener = smallBufListener{srv.Listener}
+	srv.Start()
+
+	return srv, s
+}
+
+// dialStalled connects a client that reads the doc event and then stops
+// reading
+func dialStalled(t *testing.T, srv *httptest.Server) (*websocket.Conn, string) {
+	dialer := &websocket.Dialer{
+		NetDial: func(network, addr string) (net.Conn, error) {
+			conn, err := net.Dial(network, addr)
+			if tc, ok := conn.(*net.TCPConn); ok {
+				tc.SetReadBuffer(32 * 1024)
+			}
+			return conn, err
+		},
+	}
+	ws, _, err := dialer.Dial(wsURL(srv), nil)
+	if err != nil {
+		t.Fatalf("expected no error dialing, got %v", err)
+	}
+	e := readRaw(t, ws)
+	var d struct {
+		ClientID string `json:"client_id"`
+	}
+	if err = json.Unmarshal(e.Data, &d); err != nil {
+		t.Fatalf("expected no error decoding doc event, got %v", err)
+	}
+	return ws, d.ClientID
+}
+
+// submitLargeEdits appends n large inserts, waiting for each to be acknowledged
+func submitLargeEdits(t *testing.T, c *wsclient.Client, n int) {
+	big := strings.Repeat("x", 64*1024)
+	for i := 0; i < n; i++ {
+		doc := c.Document()
+		if err := c.Submit(operation.New().Retain(len(doc)).Insert(big), nil); err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		if err := c.WaitSynchronized(testTimeout); err != nil {
+			t.Fatalf("expected edit %d to be acknowledged, got %v", i, err)
+		}
+	}
+}
+
+func TestStalledClientIsDisconnected(t *testing.T) {
+	srv, s := newStallTestServer(t, "", ConnOptions{
+		SendQueueSize:   4,
+		WriteTimeout:    200 * time.Millisecond,
+		QueueFullPolicy: QueueFullDisconnect,
+	})
+	defer srv.Close()
+
+	stalled, stalledID := dialStalled(t, srv)
+	defer stalled.Close()
+
+	bob := dialAndJoin(t, srv, "bob")
+	defer bob.Close()
+
+	// the stalled client does not hold up bob's edits
+	submitLargeEdits(t, bob, 20)
+
+	deadline := time.Now().Add(testTimeout)
+	for {
+		var ok bool
+		s.Call(func() {
+			_, ok = s.Clients[stalledID]
+		})
+		if !ok {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected stalled client to be removed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// once it reads again, the stalled client finds its connection closed
+	stalled.SetReadDeadline(time.Now().Add(testTimeout))
+	for {
+		if _, _, err := stalled.ReadMessage(); err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				t.Fatalf("expected connection to be closed, got %v", err)
+			}
+			break
+		}
+	}
+}
+
+func TestStalledClientIsResynced(t *testing.T) {
+	srv, _ := newStallTestServer(t, "", ConnOptions{
+		SendQueueSize:   2,
+		WriteTimeout:    testTimeout,
+		QueueFullPolicy: QueueFullResync,
+	})
+	defer srv.Close()
+
+	stalled, _ := dialStalled(t, srv)
+	defer stalled.Close()
+
+	bob := dialAndJoin(t, srv, "bob")
+	defer bob.Close()
+
+	submitLargeEdits(t, bob, 20)
+
+	// the stalled client catches up with a snapshot of the document instead
+	// of every operation
+	ops := 0
+	for {
+		e := readRaw(t, stalled)
+		if e.Name == "op" {
+			ops++
+			continue
+		}
+		if e.Name != "doc" {
+			continue
+		}
+
+		var d struct {
+			Document string `json:"document"`
+			Revision int    `json:"revision"`
+		}
+		if err := json.Unmarshal(e.Data, &d); err != nil {
+			t.Fatalf("expected no error decoding doc event, got %v", err)
+		}
+		if actual, expected := d.Revision, 20; actual != expected {
+			t.Errorf("expected revision to be %d, got %d", expected, actual)
+		}
+		if actual, expected := d.Document, bob.Document(); actual != expected {
+			t.Errorf("expected resynced document to have length %d, got %d", len(expected), len(actual))
+		}
+		break
+	}
+
+	if ops >= 20 {
+		t.Errorf("expected some operations to be dropped, got all %d", ops)
+	}
+}
+
+func TestDeadPeerIsRemoved(t *testing.T) {
+	srv, _ := newStallTestServer(t, "hello", ConnOptions{
+		SendQueueSize: 16,
+		WriteTimeout:  testTimeout,
+		PingInterval:  20 * time.Millisecond,
+		PongTimeout:   200 * time.Millisecond,
+	})
+	defer srv.Close()
+
+	// the ghost joins and then stops reading, so it never answers pings
+	ghost := dialRaw(t, srv)
+	defer ghost.Close()
+	ghost.WriteMessage(websocket.TextMessage, []byte(`{"e": "join", "d": {"username": "ghost"}}`))
+	var ghostID string
+	if e := readRaw(t, ghost); e.Name != "registered" || json.Unmarshal(e.Data, &ghostID) != nil {
+		t.Fatalf("expected registered event, got %s", e.Name)
+	}
+
+	bob := dialAndJoin(t, srv, "bob")
+	defer bob.Close()
+
+	// bob sees the ghost quit
+	err := bob.Wait(testTimeout, func(c *wsclient.Client) bool {
+		_, ok := c.Clients()[ghostID]
+		return !ok
+	})
+	if err != nil {
+		t.Fatalf("expected ghost to quit, got %v", err)
+	}
+
+	// bob answers pings, so bob stays connected without sending anything
+	time.Sleep(500 * time.Millisecond)
+	if err = bob.Submit(operation.New().Retain(5).Insert("!"), nil); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if err = bob.WaitSynchronized(testTimeout); err != nil {
+		t.Fatalf("expected bob to stay connected, got %v", err)
+	}
+}
@@ -1,53 +1,322 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
+	"flag"
 	"fmt"
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/gorilla/websocket"
+	"github.com/nitrous-io/ot.go/demo/protocol"
 	"github.com/nitrous-io/ot.go/ot"
 )
 
 var upgrader = websocket.Upgrader{
 	ReadBufferSize:  1024,
 	WriteBufferSize: 1024,
+	CheckOrigin:     checkOrigin(nil),
 }
 
-var defaultSession = NewSession(`package main
+const defaultDocID = "default"
+
+const defaultDocument = `package main
 
 import "fmt"
 
 func main() {
 	fmt.Println("Hello, playground")
-}`)
+}`
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "token" {
+		printToken(os.Args[2:])
+		return
+	}
+
 	ot.TextEncoding = ot.TextEncodingTypeUTF16
 
-	r := mux.NewRouter()
-	r.HandleFunc("/ws", serveWs)
-	r.PathPrefix("/").Handler(http.FileServer(http.Dir("public")))
+	var source DocumentSource = StaticSource(defaultDocument)
+	var sink DocumentSink
+	if dir := os.Getenv("DOCUMENT_DIR"); dir != "" {
+		source = DirSource(dir)
+		sink = DirSource(dir)
+	}
+
+	registry := NewRegistry(source)
+	registry.Sink = sink
+	if secret := os.Getenv("AUTH_SECRET"); secret != "" {
+		registry.Authenticator = &TokenAuthenticator{Key: []byte(secret)}
+	}
+	envDuration("IDLE_TIMEOUT", &registry.IdleTimeout)
+	envInt("MAX_DOCUMENTS", &registry.MaxDocuments)
+	envDuration("GRACE_PERIOD", &registry.GracePeriod)
+	// the demo edits go programs; DIAGNOSTICS_DELAY=0 turns checking them off
+	registry.DiagnosticsDelay = time.Second
+	envDuration("DIAGNOSTICS_DELAY", &registry.DiagnosticsDelay)
+	// any value lets clients run the document, in a sandbox
+	registry.RunOptions.Enabled = os.Getenv("RUN_PROGRAMS") != ""
+	envDuration("RUN_TIMEOUT", &registry.RunOptions.Timeout)
+	envInt64("RUN_MEMORY_LIMIT", &registry.RunOptions.MemoryLimit)
+	envInt("RUN_MAX_OUTPUT", &registry.RunOptions.MaxOutput)
+	envInt("RUN_MAX_PROCESSES", &registry.RunOptions.MaxProcesses)
+	envDuration("RUN_CPU_LIMIT", &registry.RunOptions.CPULimit)
+	envInt("SEND_QUEUE_SIZE", &registry.ConnOptions.SendQueueSize)
+	envDuration("WRITE_TIMEOUT", &registry.ConnOptions.WriteTimeout)
+	envDuration("PING_INTERVAL", &registry.ConnOptions.PingInterval)
+	envDuration("PONG_TIMEOUT", &registry.ConnOptions.PongTimeout)
+	// any value enables permessage-deflate
+	registry.ConnOptions.Compression = os.Getenv("COMPRESSION") != ""
+	envInt64("MAX_MESSAGE_BYTES", &registry.Limits.MaxMessageBytes)
+	envInt("MAX_DOCUMENT_LENGTH", &registry.Limits.MaxDocumentLength)
+	envFloat("OPS_PER_SECOND", &registry.Limits.OpsPerSecond)
+	envInt("OP_BURST", &registry.Limits.OpBurst)
+	envFloat("DOC_OPS_PER_SECOND", &registry.Limits.DocOpsPerSecond)
+	envInt("DOC_OP_BURST", &registry.Limits.DocOpBurst)
+	envInt("MAX_SELECTION_RANGES", &registry.Limits.MaxSelectionRanges)
+	switch v := os.Getenv("QUEUE_FULL_POLICY"); v {
+	case "", "disconnect":
+		registry.ConnOptions.QueueFullPolicy = QueueFullDisconnect
+	case "resync":
+		registry.ConnOptions.QueueFullPolicy = QueueFullResync
+	default:
+		log.Fatal("Error: invalid QUEUE_FULL_POLICY: ", v)
+	}
+
+	go registry.Janitor(time.Minute, nil)
 
 	port := os.Getenv("PORT")
 	if port == "" {
 		port = "8080"
 	}
 
-	go defaultSession.HandleEvents()
+	shutdownTimeout := 10 * time.Second
+	envDuration("SHUTDOWN_TIMEOUT", &shutdownTimeout)
+	retryAfter := 5 * time.Second
+	envDuration("RETRY_AFTER", &retryAfter)
 
-	fmt.Printf("Listening on port %s\n", port)
-	err := http.ListenAndServe(fmt.Sprintf(":%s", port), r)
-	if err != nil {
+	// comma separated origins allowed to open websockets besides the server's
+	// own, e.g. https://example.com, or * for any
+	if origins := os.Getenv("ALLOWED_ORIGINS"); origins != "" {
+		upgrader.CheckOrigin = checkOrigin(splitList(origins))
+	}
+
+	srv := &http.Server{
+		Addr:    fmt.Sprintf(":%s", port),
+		Handler: newRouter(registry),
+	}
+
+	// TLS_CERT and TLS_KEY name pem files; TLS_SELF_SIGNED generates a
+	// certificate for TLS_HOSTS instead, for local development
+	certFile, keyFile := os.Getenv("TLS_CERT"), os.Getenv("TLS_KEY")
+	if (certFile == "") != (keyFile == "") {
+		log.Fatal("Error: TLS_CERT and TLS_KEY must be set together")
+	}
+	useTLS := certFile != ""
+	if os.Getenv("TLS_SELF_SIGNED") != "" && !useTLS {
+		hosts := "localhost,127.0.0.1,::1"
+		if h := os.Getenv("TLS_HOSTS"); h != "" {
+			hosts = h
+		}
+		cert, err := selfSignedCert(splitList(hosts), 365*24*time.Hour)
+		if err != nil {
+			log.Fatal("Error: ", err)
+		}
+		srv.TLSConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+		useTLS = true
+	}
+
+	serveErr := make(chan error, 1)
+	go func() {
+		if useTLS {
+			fmt.Printf("Listening on port %s with TLS\n", port)
+			serveErr <- srv.ListenAndServeTLS(certFile, keyFile)
+		} else {
+			fmt.Printf("Listening on port %s\n", port)
+			serveErr <- srv.ListenAndServe()
+		}
+	}()
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+
+	select {
+	case err := <-serveErr:
 		log.Fatal("Error: ", err)
+	case <-sig:
+	}
+
+	fmt.Println("Shutting down")
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+
+	// close the sessions first, which ends the streaming requests of sse
+	// and long polling clients that would otherwise keep srv.Shutdown
+	// waiting; new connections are refused meanwhile
+	if err := registry.Shutdown(ctx, retryAfter); err != nil {
+		log.Println("Error: ", err)
+	}
+	if err := srv.Shutdown(ctx); err != nil {
+		log.Println("Error: ", err)
 	}
 }
 
-func serveWs(w http.ResponseWriter, r *http.Request) {
+// printToken prints an access token signed with $AUTH_SECRET, e.g.
+// demo token -name alice -role editor -doc notes -ttl 24h
+func printToken(args []string) {
+	flags := flag.NewFlagSet("token", flag.ExitOnError)
+	name := flags.String("name", "", "verified user name")
+	role := flags.String("role", "editor", "viewer, commenter, editor or owner")
+	doc := flags.String("doc", "", "document id, empty for all documents")
+	ttl := flags.Duration("ttl", 24*time.Hour, "validity, 0 for ever")
+	flags.Parse(args)
+
+	secret := os.Getenv("AUTH_SECRET")
+	if secret == "" || *name == "" {
+		log.Fatal("Error: AUTH_SECRET and -name are required")
+	}
+	claims := &Claims{Name: *name, Doc: *doc}
 	var err error
-	conn, err := upgrader.Upgrade(w, r, nil)
+	if claims.Role, err = ParseRole(*role); err != nil {
+		log.Fatal("Error: ", err)
+	}
+	if *ttl > 0 {
+		claims.Expires = time.Now().Add(*ttl).Unix()
+	}
+
+	token, err := (&TokenAuthenticator{Key: []byte(secret)}).NewToken(claims)
+	if err != nil {
+		log.Fatal("Error: ", err)
+	}
+	fmt.Println(token)
+}
+
+// splitList splits a comma separated list, dropping blanks
+func splitList(s string) []string {
+	var list []string
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			list = append(list, v)
+		}
+	}
+	return list
+}
+
+// envInt sets *n from the environment variable name, if it is set
+func envInt(name string, n *int) {
+	if v := os.Getenv(name); v != "" {
+		i, err := strconv.Atoi(v)
+		if err != nil {
+			log.Fatalf("Error: invalid %s: %v", name, err)
+		}
+		*n = i
+	}
+}
+
+// envInt64 sets *n from the environment variable name, if it is set
+func envInt64(name string, n *int64) {
+	if v := os.Getenv(name); v != "" {
+		i, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			log.Fatalf("Error: invalid %s: %v", name, err)
+		}
+		*n = i
+	}
+}
+
+// envFloat sets *f from the environment variable name, if it is set
+func envFloat(name string, f *float64) {
+	if v := os.Getenv(name); v != "" {
+		x, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			log.Fatalf("Error: invalid %s: %v", name, err)
+		}
+		*f = x
+	}
+}
+
+// envDuration sets *d from the environment variable name, if it is set
+func envDuration(name string, d *time.Duration) {
+	if v := os.Getenv(name); v != "" {
+		dur, err := time.ParseDuration(v)
+		if err != nil {
+			log.Fatalf("Error: invalid %s: %v", name, err)
+		}
+		*d = dur
+	}
+}
+
+func newRouter(registry *Registry) *mux.Router {
+	r := mux.NewRouter()
+	r.Handle("/ws", wsHandler(registry))
+	r.Handle("/ws/{docID:[A-Za-z0-9_-]+}", wsHandler(registry))
+	addTransportRoutes(r, registry, newTransportTable())
+	addAPIRoutes(r.PathPrefix("/api/docs/{docID:[A-Za-z0-9_-]+}").Subrouter(), registry)
+	r.PathPrefix("/").Handler(http.FileServer(http.Dir("public")))
+	return r
+}
+
+func wsHandler(registry *Registry) http.HandlerFunc {
+	return documentHandler(registry, serveSession)
+}
+
+// documentHandler authenticates the request and passes the session of the
+// document named in the url to serve.
+func documentHandler(registry *Registry, serve func(s *Session, identity *Identity, w http.ResponseWriter, r *http.Request)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		docID := mux.Vars(r)["docID"]
+		if docID == "" {
+			docID = defaultDocID
+		}
+
+		// authenticate before acquiring, so that strangers cannot open
+		// documents
+		identity, err := registry.Authenticator.Authenticate(r, docID)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+
+		s, err := registry.Acquire(docID)
+		if err != nil {
+			if err == ErrTooManyDocuments || err == ErrShuttingDown {
+				http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			} else {
+				log.Println(err)
+				http.Error(w, "could not open document", http.StatusInternalServerError)
+			}
+			return
+		}
+		defer registry.Release(docID)
+
+		serve(s, identity, w, r)
+	}
+}
+
+func serveSession(s *Session, identity *Identity, w http.ResponseWriter, r *http.Request) {
+	// clients offer the protocols they speak as subprotocols
+	offered := websocket.Subprotocols(r)
+	p, err := protocol.Negotiate(offered)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var header http.Header
+	if len(offered) > 0 {
+		header = http.Header{"Sec-Websocket-Protocol": {p.String()}}
+	}
+
+	u := upgrader
+	u.EnableCompression = s.ConnOptions.Compression
+	conn, err := u.Upgrade(w, r, header)
 	if err != nil {
 		if _, ok := err.(websocket.HandshakeError); !ok {
 			log.Println(err)
@@ -55,5 +324,37 @@ func serveWs(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	NewConnection(defaultSession, conn).Handle()
+	if n := s.Limits.MaxMessageBytes; n > 0 {
+		conn.SetReadLimit(n)
+	}
+
+	c := NewConnection(s, newWebsocketTransport(conn, p, s.ConnOptions.PongTimeout))
+	c.Identity = identity
+	c.Protocol = p.Wire()
+	runConnection(c, r)
+}
+
+// runConnection serves c as a spectator or a client, depending on the query
+// parameters of r.
+func runConnection(c *Connection, r *http.Request) {
+	if r.URL.Query().Get("spectate") != "" {
+		c.Spectate()
+		return
+	}
+	c.Handle(parseResume(r))
+}
+
+// parseResume reads the resume parameters a reconnecting client adds to the
+// websocket url, e.g. /ws/doc?client_id=3&token=abc&revision=42
+func parseResume(r *http.Request) *Resume {
+	q := r.URL.Query()
+	id, token := q.Get("client_id"), q.Get("token")
+	if id == "" || token == "" {
+		return nil
+	}
+	rev, err := strconv.Atoi(q.Get("revision"))
+	if err != nil {
+		return nil
+	}
+	return &Resume{ClientID: id, Token: token, Revision: rev}
 }
@@ -0,0 +1,298 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/nitrous-io/ot.go/demo/protocol"
+	"github.com/nitrous-io/ot.go/demo/wsclient"
+	"github.com/nitrous-io/ot.go/ot/operation"
+	"github.com/nitrous-io/ot.go/ot/selection"
+)
+
+const testTimeout = 5 * time.Second
+
+// newTestServer serves a session of doc to editors, or to the role given by
+// the role query parameter. configure, if not nil,
+// sets the session up before its event loop starts. The session is stopped
+// when the test ends.
+func newTestServer(t *testing.T, doc string, configure func(*Session)) (*httptest.Server, *Session) {
+	srv, s := newUnstartedTestServer(t, doc, configure)
+	srv.Start()
+	return srv, s
+}
+
+// newUnstartedTestServer is like newTestServer, but leaves starting the
+// server to the caller.
+func newUnstartedTestServer(t *testing.T, doc string, configure func(*Session)) (*httptest.Server, *Session) {
+	s := NewSession(doc)
+	if configure != nil {
+		configure(s)
+	}
+	go s.HandleEvents()
+	t.Cleanup(s.Stop)
+
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		identity := &Identity{Role: RoleEditor}
+		if role, err := ParseRole(r.URL.Query().Get("role")); err == nil {
+			identity.Role = role
+		}
+		serveSession(s, identity, w, r)
+	}))
+
+	return srv, s
+}
+
+func wsURL(srv *httptest.Server) string {
+	return "ws" + strings.TrimPrefix(srv.URL, "http")
+}
+
+func dialAndJoin(t *testing.T, srv *httptest.Server, username string) *wsclient.Client {
+	c, err := wsclient.Dial(wsURL(srv))
+	if err != nil {
+		t.Fatalf("expected no error dialing, got %v", err)
+	}
+	if err = c.Join(username, testTimeout); err != nil {
+		t.Fatalf("expected no error joining, got %v", err)
+	}
+	return c
+}
+
+// dialRaw connects without a client library and skips the doc event
+func dialRaw(t *testing.T, srv *httptest.Server) *websocket.Conn {
+	ws, _, err := websocket.DefaultDialer.Dial(wsURL(srv), nil)
+	if err != nil {
+		t.Fatalf("expected no error dialing, got %v", err)
+	}
+	if e := readRaw(t, ws); e.Name != "doc" {
+		t.Fatalf("expected doc event, got %s", e.Name)
+	}
+	return ws
+}
+
+func readRaw(t *testing.T, ws *websocket.Conn) *wsclient.Event {
+	ws.SetReadDeadline(time.Now().Add(testTimeout))
+	e := &wsclient.Event{}
+	if err := ws.ReadJSON(e); err != nil {
+		t.Fatalf("expected no error reading event, got %v", err)
+	}
+	return e
+}
+
+func TestClientEditing(t *testing.T) {
+	srv, _ := newTestServer(t, "hello", nil)
+	defer srv.Close()
+
+	alice := dialAndJoin(t, srv, "alice")
+	defer alice.Close()
+
+	if actual, expected := alice.Document(), "hello"; actual != expected {
+		t.Errorf("expected document to be %s, got %s", expected, actual)
+	}
+
+	if actual, expected := alice.Revision(), 0; actual != expected {
+		t.Errorf("expected revision to be %d, got %d", expected, actual)
+	}
+
+	bob := dialAndJoin(t, srv, "bob")
+	defer bob.Close()
+
+	// alice learns about bob
+	err := alice.Wait(testTimeout, func(c *wsclient.Client) bool {
+		return c.Clients()[bob.ID()].Name == "bob"
+	})
+	if err != nil {
+		t.Fatalf("expected alice to see bob join, got %v", err)
+	}
+
+	// concurrent edits converge
+	sel := &selection.Selection{Ranges: []selection.Range{{Anchor: 6, Head: 6}}}
+	if err = alice.Submit(operation.New().Retain(5).Insert(" world"), sel); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if err = bob.Submit(operation.New().Delete(1).Insert("H").Retain(4), nil); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	for _, c := range []*wsclient.Client{alice, bob} {
+		if err = c.WaitSynchronized(testTimeout); err != nil {
+			t.Fatalf("expected client to synchronize, got %v", err)
+		}
+		if err = c.WaitRevision(2, testTimeout); err != nil {
+			t.Fatalf("expected client to reach revision 2, got %v", err)
+		}
+		if actual, expected := c.Document(), "Hello world"; actual != expected {
+			t.Errorf("expected document to be %s, got %s", expected, actual)
+		}
+	}
+
+	// bob sees alice's cursor
+	err = bob.Wait(testTimeout, func(c *wsclient.Client) bool {
+		return len(c.Clients()[alice.ID()].Selection.Ranges) == 1
+	})
+	if err != nil {
+		t.Fatalf("expected bob to see alice's selection, got %v", err)
+	}
+
+	if actual, expected := bob.Clients()[alice.ID()].Selection.Ranges[0], (selection.Range{Anchor: 6, Head: 6}); actual != expected {
+		t.Errorf("expected alice's selection to be %+v, got %+v", expected, actual)
+	}
+
+	// a late joiner gets the current document
+	carol := dialAndJoin(t, srv, "carol")
+	defer carol.Close()
+
+	if actual, expected := carol.Document(), "Hello world"; actual != expected {
+		t.Errorf("expected document to be %s, got %s", expected, actual)
+	}
+
+	if actual, expected := carol.Revision(), 2; actual != expected {
+		t.Errorf("expected revision to be %d, got %d", expected, actual)
+	}
+}
+
+func TestClientOnEvent(t *testing.T) {
+	srv, _ := newTestServer(t, "hello", nil)
+	defer srv.Close()
+
+	alice := dialAndJoin(t, srv, "alice")
+	defer alice.Close()
+	events := make(chan *wsclient.Event, 16)
+	alice.OnEvent(func(e *wsclient.Event) { events <- e })
+
+	bob := dialAndJoin(t, srv, "bob")
+	defer bob.Close()
+	if err := bob.Submit(operation.New().Retain(5).Insert("!"), nil); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	var names []string
+	for len(names) < 2 {
+		select {
+		case e := <-events:
+			names = append(names, e.Name)
+		case <-time.After(testTimeout):
+			t.Fatalf("timed out waiting for events, got %v", names)
+		}
+	}
+	if actual, expected := strings.Join(names, " "), "join op"; actual != expected {
+		t.Errorf("expected events %s, got %s", expected, actual)
+	}
+	// the state is updated first
+	if actual, expected := alice.Document(), "hello!"; actual != expected {
+		t.Errorf("expected document to be %s, got %s", expected, actual)
+	}
+}
+
+func TestProtocolNegotiation(t *testing.T) {
+	srv, _ := newTestServer(t, "hello", nil)
+	defer srv.Close()
+
+	dialer := &websocket.Dialer{Subprotocols: []string{"ot.v9.json", "ot.v1.json"}}
+	ws, _, err := dialer.Dial(wsURL(srv), nil)
+	if err != nil {
+		t.Fatalf("expected no error dialing, got %v", err)
+	}
+	defer ws.Close()
+	if actual, expected := ws.Subprotocol(), "ot.v1.json"; actual != expected {
+		t.Errorf("expected protocol %s, got %s", expected, actual)
+	}
+	e := readRaw(t, ws)
+	if e.Name != "doc" {
+		t.Fatalf("expected doc event, got %s", e.Name)
+	}
+	// which tells the units positions count
+	var doc protocol.Doc
+	if err = json.Unmarshal(e.Data, &doc); err != nil {
+		t.Fatalf("expected no error decoding doc, got %v", err)
+	}
+	if actual, expected := doc.Units, "utf8"; actual != expected {
+		t.Errorf("expected units %s, got %s", expected, actual)
+	}
+
+	// clients that offer nothing get the ot.js protocol
+	raw := dialRaw(t, srv)
+	defer raw.Close()
+	if actual := raw.Subprotocol(); actual != "" {
+		t.Errorf("expected no protocol, got %s", actual)
+	}
+
+	// the go client speaks the binary encoding, in its units
+	c := dialAndJoin(t, srv, "alice")
+	defer c.Close()
+	if actual, expected := c.Protocol(), "ot.v1.binary.utf8"; actual != expected {
+		t.Errorf("expected protocol %s, got %s", expected, actual)
+	}
+	if actual, expected := c.Document(), "hello"; actual != expected {
+		t.Errorf("expected document %q, got %q", expected, actual)
+	}
+
+	for _, offered := range []string{"ot.v9.json", "ot.v1.json.utf16"} {
+		dialer = &websocket.Dialer{Subprotocols: []string{offered}}
+		_, resp, err := dialer.Dial(wsURL(srv), nil)
+		if err == nil {
+			t.Fatalf("expected dialing with %s to fail", offered)
+		}
+		if actual, expected := resp.StatusCode, http.StatusBadRequest; actual != expected {
+			t.Errorf("expected status %d for %s, got %d", expected, offered, actual)
+		}
+	}
+}
+
+func TestClientRefusesOtherUnits(t *testing.T) {
+	// a server that does not know units, counting in utf-16
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ws, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer ws.Close()
+		ws.WriteMessage(websocket.TextMessage, []byte(`{"e": "doc", "d": {"document": "😀", "revision": 0, "clients": {}, "units": "utf16"}}`))
+		ws.ReadMessage()
+	}))
+	defer srv.Close()
+
+	if _, err := wsclient.Dial(wsURL(srv)); err != wsclient.ErrUnits {
+		t.Errorf("expected ErrUnits, got %v", err)
+	}
+}
+
+func TestCompression(t *testing.T) {
+	srv, _ := newTestServer(t, "hello", func(s *Session) {
+		s.ConnOptions.Compression = true
+	})
+	defer srv.Close()
+
+	dialer := &websocket.Dialer{EnableCompression: true}
+	ws, resp, err := dialer.Dial(wsURL(srv), nil)
+	if err != nil {
+		t.Fatalf("expected no error dialing, got %v", err)
+	}
+	ws.Close()
+	if actual := resp.Header.Get("Sec-Websocket-Extensions"); !strings.Contains(actual, "permessage-deflate") {
+		t.Errorf("expected permessage-deflate to be negotiated, got %q", actual)
+	}
+
+	alice, err := wsclient.DialWith(dialer, wsURL(srv))
+	if err != nil {
+		t.Fatalf("expected no error dialing, got %v", err)
+	}
+	defer alice.Close()
+	bob := dialAndJoin(t, srv, "bob")
+	defer bob.Close()
+
+	if err := alice.Submit(operation.New().Retain(5).Insert(" world"), nil); err != nil {
+		t.Fatalf("expected no error submitting, got %v", err)
+	}
+	if err := bob.WaitRevision(1, testTimeout); err != nil {
+		t.Fatalf("expected no error waiting, got %v", err)
+	}
+	if actual, expected := bob.Document(), "hello world"; actual != expected {
+		t.Errorf("expected document %q, got %q", expected, actual)
+	}
+}
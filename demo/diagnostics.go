@@ -0,0 +1,195 @@
+package main
+
+import (
+	"go/ast"
+	"go/importer"
+	"go/parser"
+	"go/scanner"
+	"go/token"
+	"go/types"
+	"sort"
+	"sync"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/nitrous-io/ot.go/demo/protocol"
+	"github.com/nitrous-io/ot.go/ot/operation"
+	"github.com/nitrous-io/ot.go/ot/selection"
+)
+
+// maxDiagnostics is the most diagnostics sent for a document
+const maxDiagnostics = 50
+
+// diagnosis is the result of checking the document at a revision
+type diagnosis struct {
+	revision    int
+	diagnostics []protocol.Diagnostic
+}
+
+// scheduleCheck checks the document once it has not changed for
+// DiagnosticsDelay
+func (s *Session) scheduleCheck() {
+	if s.DiagnosticsDelay <= 0 {
+		return
+	}
+	if s.checkTimer != nil {
+		s.checkTimer.Stop()
+	}
+	// a timer that fired before it was stopped posts an outdated generation
+	s.checkGen++
+	gen := s.checkGen
+	s.checkTimer = time.AfterFunc(s.DiagnosticsDelay, func() {
+		s.post(ConnEvent{Event: &Event{"check", gen}, internal: true})
+	})
+}
+
+// startCheck checks the document off the event loop. The result comes back
+// as a "checked" event.
+func (s *Session) startCheck(gen int) {
+	if gen != s.checkGen {
+		return
+	}
+	d := &diagnosis{revision: len(s.Operations)}
+	doc := s.Document
+	go func() {
+		d.diagnostics = checkDocument(doc)
+		s.post(ConnEvent{Event: &Event{"checked", d}, internal: true})
+	}()
+}
+
+// handleChecked transforms the diagnostics past the edits made while
+// checking, keeps them for clients that connect later and broadcasts them
+func (s *Session) handleChecked(d *diagnosis) {
+	// checks can overtake each other
+	if d.revision < s.checkedRev {
+		return
+	}
+	ops, err := s.OperationsSince(d.revision)
+	if err != nil {
+		return
+	}
+	s.checkedRev = d.revision
+	diags := d.diagnostics
+	for _, op := range ops {
+		diags = transformDiagnostics(diags, op)
+	}
+	s.diagnostics = diags
+	s.broadcast(&protocol.Diagnostics{Diagnostics: diags}, nil)
+}
+
+// sendDiagnostics sends c the diagnostics of the current revision, if any
+func (s *Session) sendDiagnostics(c *Connection) {
+	if len(s.diagnostics) > 0 {
+		c.Send(&protocol.Diagnostics{Diagnostics: s.diagnostics})
+	}
+}
+
+// transformDiagnostics moves diags past op, as selections are. It returns a
+// new slice because diags may be queued for sending.
+func transformDiagnostics(diags []protocol.Diagnostic, op *operation.Operation) []protocol.Diagnostic {
+	transformed := make([]protocol.Diagnostic, len(diags))
+	for i, d := range diags {
+		r := (&selection.Range{Anchor: d.From, Head: d.To}).Transform(op)
+		d.From, d.To = r.Anchor, r.Head
+		transformed[i] = d
+	}
+	return transformed
+}
+
+// checker type checks documents. Importers cache the packages they import,
+// but are not safe for concurrent use.
+var checker struct {
+	sync.Mutex
+	importer types.Importer
+}
+
+// checkDocument parses and type checks doc as a main package
+func checkDocument(doc string) []protocol.Diagnostic {
+	diags := []protocol.Diagnostic{}
+	add := func(pos token.Position, severity, message string) {
+		if len(diags) < maxDiagnostics {
+			from, to := diagnosticRange(doc, pos.Offset)
+			diags = append(diags, protocol.Diagnostic{From: from, To: to, Severity: severity, Message: message})
+		}
+	}
+
+	fset := token.NewFileSet()
+	f, err := parser.ParseFile(fset, "main.go", doc, 0)
+	if list, ok := err.(scanner.ErrorList); ok {
+		for _, e := range list {
+			add(e.Pos, "error", e.Msg)
+		}
+		return diags
+	}
+	if err != nil {
+		return diags
+	}
+
+	checker.Lock()
+	defer checker.Unlock()
+	if checker.importer == nil {
+		checker.importer = importer.Default()
+	}
+	imp := &recordingImporter{Importer: checker.importer}
+	var typeErrs []types.Error
+	conf := types.Config{
+		Importer: imp,
+		Error: func(err error) {
+			if terr, ok := err.(types.Error); ok {
+				typeErrs = append(typeErrs, terr)
+			}
+		},
+	}
+	conf.Check("main", fset, []*ast.File{f}, nil)
+	if imp.failed {
+		// without the imported packages, every use of them would be an error
+		return diags
+	}
+	sort.SliceStable(typeErrs, func(i, j int) bool { return typeErrs[i].Pos < typeErrs[j].Pos })
+	for _, e := range typeErrs {
+		severity := "error"
+		if e.Soft {
+			severity = "warning"
+		}
+		add(fset.Position(e.Pos), severity, e.Msg)
+	}
+	return diags
+}
+
+// recordingImporter notes whether an import failed
+type recordingImporter struct {
+	types.Importer
+	failed bool
+}
+
+func (imp *recordingImporter) Import(path string) (*types.Package, error) {
+	pkg, err := imp.Importer.Import(path)
+	if err != nil {
+		imp.failed = true
+	}
+	return pkg, err
+}
+
+// diagnosticRange returns the range, in units of ot.TextEncoding, of the
+// word at the byte offset of doc, or of the character there if it is not in
+// a word
+func diagnosticRange(doc string, offset int) (int, int) {
+	if offset > len(doc) {
+		offset = len(doc)
+	}
+	end := offset
+	for end < len(doc) {
+		r, size := utf8.DecodeRuneInString(doc[end:])
+		if r != '_' && !unicode.IsLetter(r) && !unicode.IsDigit(r) {
+			break
+		}
+		end += size
+	}
+	if end == offset && end < len(doc) && doc[end] != '\n' {
+		_, size := utf8.DecodeRuneInString(doc[end:])
+		end += size
+	}
+	from := unitLen(doc[:offset])
+	return from, from + unitLen(doc[offset:end])
+}
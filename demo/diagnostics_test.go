@@ -0,0 +1,93 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/nitrous-io/ot.go/demo/protocol"
+	"github.com/nitrous-io/ot.go/demo/wsclient"
+	"github.com/nitrous-io/ot.go/ot/operation"
+)
+
+func TestCheckDocument(t *testing.T) {
+	for _, tc := range []struct {
+		doc      string
+		expected []protocol.Diagnostic
+	}{
+		{"package main\n\nfunc main() {}\n", []protocol.Diagnostic{}},
+		{"package main\n\nfunc main() {\n\tx := 1\n\ty = 2\n}\n", []protocol.Diagnostic{
+			{From: 29, To: 30, Severity: "warning", Message: "declared and not used: x"},
+			{From: 37, To: 38, Severity: "error", Message: "undefined: y"},
+		}},
+		{"package main\n\nfunc main() {\n\tx := \n}\n", []protocol.Diagnostic{
+			{From: 35, To: 36, Severity: "error", Message: "expected operand, found '}'"},
+		}},
+	} {
+		if actual := checkDocument(tc.doc); !reflect.DeepEqual(actual, tc.expected) {
+			t.Errorf("expected %+v for %q, got %+v", tc.expected, tc.doc, actual)
+		}
+	}
+}
+
+func TestTransformDiagnostics(t *testing.T) {
+	diags := []protocol.Diagnostic{{From: 2, To: 4, Severity: "error", Message: "a"}, {From: 6, To: 7, Severity: "error", Message: "b"}}
+	transformed := transformDiagnostics(diags, operation.New().Insert("xx").Retain(3).Delete(2).Retain(2))
+
+	// a shrinks with the deletion at its end, b moves back
+	expected := []protocol.Diagnostic{{From: 4, To: 5, Severity: "error", Message: "a"}, {From: 6, To: 7, Severity: "error", Message: "b"}}
+	if actual := transformed; !reflect.DeepEqual(actual, expected) {
+		t.Errorf("expected %+v, got %+v", expected, actual)
+	}
+	if actual, expected := diags[0].From, 2; actual != expected {
+		t.Errorf("expected the original diagnostics to be left alone, got %d", actual)
+	}
+}
+
+func TestDiagnostics(t *testing.T) {
+	srv, _ := newTestServer(t, "package main\n\nfunc main() {\n}\n", func(s *Session) {
+		s.DiagnosticsDelay = 20 * time.Millisecond
+	})
+	defer srv.Close()
+
+	alice := dialAndJoin(t, srv, "alice")
+	defer alice.Close()
+
+	// a quiet period after the edit, the error is reported
+	if err := alice.Submit(operation.New().Retain(28).Insert("\ty = 1\n").Retain(2), nil); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	err := alice.Wait(testTimeout, func(c *wsclient.Client) bool {
+		return len(c.Diagnostics()) == 1
+	})
+	if err != nil {
+		t.Fatalf("expected diagnostics, got %v", err)
+	}
+	expected := protocol.Diagnostic{From: 29, To: 30, Severity: "error", Message: "undefined: y"}
+	if actual := alice.Diagnostics()[0]; actual != expected {
+		t.Errorf("expected %+v, got %+v", expected, actual)
+	}
+
+	// edits move the diagnostics along until the next check
+	if err = alice.Submit(operation.New().Insert("// x\n").Retain(37), nil); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	expected.From, expected.To = 34, 35
+	if actual := alice.Diagnostics()[0]; actual != expected {
+		t.Errorf("expected %+v, got %+v", expected, actual)
+	}
+
+	// late joiners get them too
+	if err = alice.WaitSynchronized(testTimeout); err != nil {
+		t.Fatalf("expected alice to synchronize, got %v", err)
+	}
+	bob := dialAndJoin(t, srv, "bob")
+	defer bob.Close()
+	err = bob.Wait(testTimeout, func(c *wsclient.Client) bool {
+		d := c.Diagnostics()
+		return len(d) == 1 && d[0] == expected
+	})
+	if err != nil {
+		t.Errorf("expected bob to get %+v, got %+v", expected, bob.Diagnostics())
+	}
+}
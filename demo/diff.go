@@ -0,0 +1,184 @@
+package main
+
+import (
+	"strings"
+
+	"github.com/nitrous-io/ot.go/ot"
+	"github.com/nitrous-io/ot.go/ot/operation"
+)
+
+// maxDiffEdits bounds the work spent diffing; changes with more edits are
+// made by replacing the whole changed part
+const maxDiffEdits = 1000
+
+// diffOperation returns an operation turning a into b. It keeps the parts the
+// two have in common, so that cursors in them stay where they are: lines are
+// compared first, and then the characters of the lines that changed.
+func diffOperation(a, b string) *operation.Operation {
+	op := operation.New()
+	la, lb := splitLines(a), splitLines(b)
+	edits := diff(len(la), len(lb), func(i, j int) bool { return la[i] == lb[j] })
+	if edits == nil {
+		// too different, compare the characters of everything
+		edits = []edit{{'-', len(la)}, {'+', len(lb)}}
+	}
+
+	var i, j int
+	for k := 0; k < len(edits); k++ {
+		e := edits[k]
+		if e.kind == '=' {
+			op.Retain(unitLen(strings.Join(la[i:i+e.n], "")))
+			i, j = i+e.n, j+e.n
+			continue
+		}
+		// a run of changed lines
+		i0, j0 := i, j
+		for ; k < len(edits) && edits[k].kind != '='; k++ {
+			if edits[k].kind == '-' {
+				i += edits[k].n
+			} else {
+				j += edits[k].n
+			}
+		}
+		k--
+		diffRunes(op, strings.Join(la[i0:i], ""), strings.Join(lb[j0:j], ""))
+	}
+	return op
+}
+
+// diffRunes appends the edits turning a into b to op
+func diffRunes(op *operation.Operation, a, b string) {
+	ra, rb := []rune(a), []rune(b)
+	edits := diff(len(ra), len(rb), func(i, j int) bool { return ra[i] == rb[j] })
+	if edits == nil {
+		op.Delete(unitLen(a)).Insert(b)
+		return
+	}
+	var i, j int
+	for _, e := range edits {
+		switch e.kind {
+		case '=':
+			op.Retain(unitLen(string(ra[i : i+e.n])))
+			i, j = i+e.n, j+e.n
+		case '-':
+			op.Delete(unitLen(string(ra[i : i+e.n])))
+			i += e.n
+		case '+':
+			op.Insert(string(rb[j : j+e.n]))
+			j += e.n
+		}
+	}
+}
+
+// splitLines splits s after each newline
+func splitLines(s string) []string {
+	lines := strings.SplitAfter(s, "\n")
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	return lines
+}
+
+// unitLen returns the length of s in units of ot.TextEncoding
+func unitLen(s string) int {
+	n := 0
+	for _, r := range s {
+		if ot.TextEncoding == ot.TextEncodingTypeUTF16 && r >= 0x10000 {
+			n += 2
+		} else {
+			n++
+		}
+	}
+	return n
+}
+
+// edit is a run of n equal ('='), deleted ('-') or inserted ('+') elements
+type edit struct {
+	kind byte
+	n    int
+}
+
+// diff returns the shortest edit script turning a sequence of n elements into
+// one of m elements, where eq reports whether the ith element of the first
+// equals the jth of the second. It returns nil if that takes more than
+// maxDiffEdits edits.
+//
+// This is Myers' algorithm: v[k] is the furthest x reached on diagonal
+// k = x - y, and trace keeps v as it was before each step to walk back the
+// path.
+func diff(n, m int, eq func(i, j int) bool) []edit {
+	max := n + m
+	if max > maxDiffEdits {
+		max = maxDiffEdits
+	}
+	// v[offset+k] for k in -d-1..d+1
+	offset := max + 1
+	v := make([]int, 2*max+3)
+	var trace [][]int
+
+	var found bool
+	for d := 0; d <= max && !found; d++ {
+		trace = append(trace, append([]int(nil), v[offset-d-1:offset+d+2]...))
+		for k := -d; k <= d; k += 2 {
+			var x int
+			if k == -d || (k != d && v[offset+k-1] < v[offset+k+1]) {
+				x = v[offset+k+1]
+			} else {
+				x = v[offset+k-1] + 1
+			}
+			y := x - k
+			for x < n && y < m && eq(x, y) {
+				x, y = x+1, y+1
+			}
+			v[offset+k] = x
+			if x >= n && y >= m {
+				found = true
+				break
+			}
+		}
+	}
+	if !found {
+		return nil
+	}
+
+	// walk back from the end, collecting edits in reverse
+	var rev []edit
+	add := func(kind byte) {
+		if l := len(rev); l > 0 && rev[l-1].kind == kind {
+			rev[l-1].n++
+		} else {
+			rev = append(rev, edit{kind, 1})
+		}
+	}
+	x, y := n, m
+	for d := len(trace) - 1; d >= 0; d-- {
+		tv := trace[d] // tv[d+1+k] is v[k] before step d
+		k := x - y
+		var prevK int
+		if k == -d || (k != d && tv[d+1+k-1] < tv[d+1+k+1]) {
+			prevK = k + 1
+		} else {
+			prevK = k - 1
+		}
+		prevX := tv[d+1+prevK]
+		prevY := prevX - prevK
+		for x > prevX && y > prevY {
+			add('=')
+			x, y = x-1, y-1
+		}
+		if d > 0 {
+			if x == prevX {
+				add('+')
+			} else {
+				add('-')
+			}
+		}
+		x, y = prevX, prevY
+	}
+
+	edits := make([]edit, 0, len(rev))
+	for i := len(rev) - 1; i >= 0; i-- {
+		edits = append(edits, rev[i])
+	}
+	return edits
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"math/rand"
+	"strings"
+	"testing"
+
+	"github.com/nitrous-io/ot.go/ot"
+	"github.com/nitrous-io/ot.go/ot/operation"
+)
+
+func TestDiffOperation(t *testing.T) {
+	for _, tc := range []struct {
+		a, b string
+	}{
+		{"", ""},
+		{"", "hello"},
+		{"hello", ""},
+		{"hello", "hello"},
+		{"hello", "help"},
+		{"a\nb\nc\n", "a\nc\n"},
+		{"a\nb\nc", "x\na\nb\nc\ny"},
+		{"func f() {\nreturn  1\n}\n", "func f() {\n\treturn 1\n}\n"},
+		{"héllo 😀 wörld", "hello 😀😀 world"},
+	} {
+		op := diffOperation(tc.a, tc.b)
+		actual, err := op.Apply(tc.a)
+		if err != nil {
+			t.Errorf("expected no error applying the diff of %q and %q, got %v", tc.a, tc.b, err)
+			continue
+		}
+		if expected := tc.b; actual != expected {
+			t.Errorf("expected %q, got %q", expected, actual)
+		}
+	}
+}
+
+func TestDiffOperationKeepsCommonText(t *testing.T) {
+	a := "package main\n\nfunc main() {\nx:=1\n\tprintln(x)\n}\n"
+	b := "package main\n\nfunc main() {\n\tx := 1\n\tprintln(x)\n}\n"
+	op := diffOperation(a, b)
+
+	// only the tab and the spaces around := are inserted
+	inserted := 0
+	for _, o := range op.Ops {
+		if operation.IsInsert(o) {
+			inserted += len(o.S)
+		}
+		if operation.IsDelete(o) {
+			t.Errorf("expected nothing to be deleted, got %v", o)
+		}
+	}
+	if actual, expected := inserted, 3; actual != expected {
+		t.Errorf("expected %d characters to be inserted, got %d", expected, actual)
+	}
+}
+
+func TestDiffOperationUTF16(t *testing.T) {
+	ot.TextEncoding = ot.TextEncodingTypeUTF16
+	defer func() { ot.TextEncoding = ot.TextEncodingTypeUTF8 }()
+
+	a, b := "😀 x\n", "😀 y 😀\n"
+	op := diffOperation(a, b)
+	if actual, expected := op.BaseLen, 5; actual != expected {
+		t.Errorf("expected base length %d, got %d", expected, actual)
+	}
+	if actual, err := op.Apply(a); err != nil || actual != b {
+		t.Errorf("expected %q, got %q, %v", b, actual, err)
+	}
+}
+
+func TestDiffOperationRandom(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	alphabet := []string{"a", "b", "\n", " ", "\t", "ü"}
+	random := func(n int) string {
+		var s []string
+		for i := 0; i < n; i++ {
+			s = append(s, alphabet[r.Intn(len(alphabet))])
+		}
+		return strings.Join(s, "")
+	}
+	for i := 0; i < 500; i++ {
+		a, b := random(r.Intn(40)), random(r.Intn(40))
+		if actual, err := diffOperation(a, b).Apply(a); err != nil || actual != b {
+			t.Fatalf("expected the diff of %q and %q to apply, got %q, %v", a, b, actual, err)
+		}
+	}
+
+	// documents too different to diff are replaced
+	a, b := random(3000), random(3000)
+	if actual, err := diffOperation(a, b).Apply(a); err != nil || actual != b {
+		t.Errorf("expected the diff of large documents to apply, got %v", err)
+	}
+}
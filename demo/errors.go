@@ -0,0 +1,90 @@
+package main
+
+import (
+	"github.com/nitrous-io/ot.go/demo/protocol"
+	"github.com/nitrous-io/ot.go/ot/operation"
+	"github.com/nitrous-io/ot.go/ot/session"
+)
+
+// machine-readable codes of error events
+const (
+	ErrCodeMalformedEvent     = protocol.CodeMalformedEvent
+	ErrCodeUnknownEvent       = protocol.CodeUnknownEvent
+	ErrCodeMalformedJoin      = protocol.CodeMalformedJoin
+	ErrCodeMalformedOp        = protocol.CodeMalformedOp
+	ErrCodeMalformedSelection = protocol.CodeMalformedSelection
+	ErrCodeInvalidRevision    = protocol.CodeInvalidRevision
+	ErrCodeBaseLenMismatch    = "base_len_mismatch"
+	ErrCodeForbidden          = "forbidden"
+	ErrCodeRateLimited        = "rate_limited"
+	ErrCodeDocumentTooLong    = "document_too_long"
+	ErrCodeTooManyRanges      = "too_many_ranges"
+	ErrCodeUnavailable        = "unavailable"
+	ErrCodeVetoed             = "vetoed"
+	ErrCodeFormatFailed       = "format_failed"
+	ErrCodeRunDisabled        = "run_disabled"
+	ErrCodeRunInProgress      = "run_in_progress"
+	ErrCodeNotRunning         = "not_running"
+	ErrCodeMalformedComment   = protocol.CodeMalformedComment
+	ErrCodeInvalidRange       = "invalid_range"
+	ErrCodeUnknownAnnotation  = "unknown_annotation"
+)
+
+// EventError is sent to a client in an "error" event when one of its events
+// could not be handled.
+type EventError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+	Event   string `json:"event,omitempty"` // name of the offending event
+}
+
+func (e *EventError) Error() string {
+	return e.Code + ": " + e.Message
+}
+
+// event returns the error event reporting e
+func (e *EventError) event() *protocol.Error {
+	return &protocol.Error{Code: e.Code, Message: e.Message, Event: e.Event}
+}
+
+func newEventError(code, message string) *EventError {
+	return &EventError{Code: code, Message: message}
+}
+
+// operationError converts an error from session.AddOperation
+func operationError(err error) *EventError {
+	if verr, ok := err.(*session.VetoError); ok {
+		return newEventError(ErrCodeVetoed, verr.Reason)
+	}
+	switch err {
+	case session.ErrInvalidRevision:
+		return newEventError(ErrCodeInvalidRevision, err.Error())
+	case operation.ErrBaseLenMismatch:
+		return newEventError(ErrCodeBaseLenMismatch, err.Error())
+	case session.ErrDocumentTooLong:
+		return newEventError(ErrCodeDocumentTooLong, err.Error())
+	}
+	return newEventError(ErrCodeMalformedOp, err.Error())
+}
+
+// annotationError converts an error from the annotation methods of
+// session.Session
+func annotationError(err error) *EventError {
+	switch err {
+	case session.ErrInvalidRevision:
+		return newEventError(ErrCodeInvalidRevision, err.Error())
+	case session.ErrInvalidRange:
+		return newEventError(ErrCodeInvalidRange, err.Error())
+	case session.ErrUnknownAnnotation:
+		return newEventError(ErrCodeUnknownAnnotation, err.Error())
+	}
+	return newEventError(ErrCodeMalformedComment, err.Error())
+}
+
+// decodeError converts an error from protocol.DecodeClient
+func decodeError(err error) *EventError {
+	if derr, ok := err.(*protocol.DecodeError); ok {
+		return &EventError{Code: derr.Code, Message: derr.Message, Event: derr.Event}
+	}
+	return newEventError(ErrCodeMalformedEvent, err.Error())
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"go/format"
+	"go/scanner"
+	"strings"
+
+	"github.com/nitrous-io/ot.go/demo/protocol"
+	"github.com/nitrous-io/ot.go/ot/operation"
+)
+
+// formatting is the result of formatting the document at a revision for the
+// connection that asked for it
+type formatting struct {
+	conn     *Connection
+	revision int
+	op       *operation.Operation // nil if nothing changed
+	errors   []protocol.SyntaxError
+	err      error
+}
+
+// handleFormat formats the document off the event loop. The result comes back
+// as a "formatted" event.
+func (s *Session) handleFormat(c *Connection) *EventError {
+	if !c.Identity.Role.CanEdit() {
+		return newEventError(ErrCodeForbidden, c.Identity.Role.String()+" may not edit the document")
+	}
+	if !s.allowOp(c) {
+		return newEventError(ErrCodeRateLimited, "too many operations, slow down")
+	}
+	f := &formatting{conn: c, revision: len(s.Operations)}
+	doc := s.Document
+	go func() {
+		f.op, f.errors, f.err = formatDocument(doc)
+		s.post(ConnEvent{Conn: c, Event: &Event{"formatted", f}, internal: true})
+	}()
+	return nil
+}
+
+// handleFormatted applies the formatted document, transformed past the edits
+// made while formatting, and answers the format event
+func (s *Session) handleFormatted(f *formatting) {
+	c := f.conn
+	if f.err != nil {
+		eerr := newEventError(ErrCodeFormatFailed, f.err.Error())
+		eerr.Event = "format"
+		c.Send(eerr.event())
+		return
+	}
+	if f.op != nil {
+		// the formatter is not a client; no one's cursor goes with the edit
+		if _, eerr := s.applyOperation("", nil, f.revision, f.op); eerr != nil {
+			s.refundOp(c, eerr)
+			eerr.Event = "format"
+			c.Send(eerr.event())
+			return
+		}
+	}
+	c.Send(&protocol.Formatted{Errors: f.errors})
+}
+
+// formatDocument returns the operation that gofmts doc, or the syntax errors
+// that prevent it
+func formatDocument(doc string) (*operation.Operation, []protocol.SyntaxError, error) {
+	src, err := format.Source([]byte(doc))
+	if list, ok := err.(scanner.ErrorList); ok {
+		errs := make([]protocol.SyntaxError, len(list))
+		for i, e := range list {
+			errs[i] = syntaxError(doc, e)
+		}
+		return nil, errs, nil
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	if string(src) == doc {
+		return nil, []protocol.SyntaxError{}, nil
+	}
+	return diffOperation(doc, string(src)), []protocol.SyntaxError{}, nil
+}
+
+// syntaxError converts the byte offsets of e into units of ot.TextEncoding
+func syntaxError(doc string, e *scanner.Error) protocol.SyntaxError {
+	offset := e.Pos.Offset
+	if offset > len(doc) {
+		offset = len(doc)
+	}
+	lineStart := strings.LastIndex(doc[:offset], "\n") + 1
+	return protocol.SyntaxError{
+		Offset:  unitLen(doc[:offset]),
+		Line:    e.Pos.Line,
+		Column:  unitLen(doc[lineStart:offset]) + 1,
+		Message: e.Msg,
+	}
+}
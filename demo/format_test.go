@@ -0,0 +1,110 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/nitrous-io/ot.go/demo/protocol"
+	"github.com/nitrous-io/ot.go/demo/wsclient"
+	"github.com/nitrous-io/ot.go/ot/selection"
+)
+
+const unformatted = "package main\n\nfunc main() {\nx:=1\n\tprintln(x)\n}\n"
+
+func TestFormat(t *testing.T) {
+	srv, _ := newTestServer(t, unformatted, nil)
+	defer srv.Close()
+
+	alice := dialAndJoin(t, srv, "alice")
+	defer alice.Close()
+	bob := dialAndJoin(t, srv, "bob")
+	defer bob.Close()
+
+	// bob's cursor is on println
+	if err := bob.SetSelection(&selection.Selection{Ranges: []selection.Range{{Anchor: 35, Head: 35}}}); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	err := alice.Wait(testTimeout, func(c *wsclient.Client) bool {
+		return len(c.Clients()[bob.ID()].Selection.Ranges) == 1
+	})
+	if err != nil {
+		t.Fatalf("expected alice to see bob's cursor, got %v", err)
+	}
+
+	if err = alice.Format(); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	err = alice.Wait(testTimeout, func(c *wsclient.Client) bool {
+		_, ok := c.Formatted()
+		return ok
+	})
+	if err != nil {
+		t.Fatalf("expected the server to answer, got %v", err)
+	}
+	if errs, _ := alice.Formatted(); len(errs) != 0 {
+		t.Errorf("expected no syntax errors, got %v", errs)
+	}
+
+	expected := "package main\n\nfunc main() {\n\tx := 1\n\tprintln(x)\n}\n"
+	for _, c := range []*wsclient.Client{alice, bob} {
+		if err = c.WaitRevision(1, testTimeout); err != nil {
+			t.Fatalf("expected the formatted document, got %v", err)
+		}
+		if actual := c.Document(); actual != expected {
+			t.Errorf("expected document %q, got %q", expected, actual)
+		}
+	}
+
+	// bob's cursor moved with the text it was in
+	if actual, expected := alice.Clients()[bob.ID()].Selection.Ranges[0].Head, 38; actual != expected {
+		t.Errorf("expected bob's cursor at %d, got %d", expected, actual)
+	}
+
+	// formatting a formatted document changes nothing
+	if err = bob.Format(); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	err = bob.Wait(testTimeout, func(c *wsclient.Client) bool {
+		_, ok := c.Formatted()
+		return ok
+	})
+	if err != nil {
+		t.Fatalf("expected the server to answer, got %v", err)
+	}
+	if actual, expected := bob.Revision(), 1; actual != expected {
+		t.Errorf("expected revision %d, got %d", expected, actual)
+	}
+}
+
+func TestFormatSyntaxErrors(t *testing.T) {
+	srv, s := newTestServer(t, "package main\n\nfunc main() {\n\tx := ü +\n}\n", nil)
+	defer srv.Close()
+
+	alice := dialAndJoin(t, srv, "alice")
+	defer alice.Close()
+
+	if err := alice.Format(); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	err := alice.Wait(testTimeout, func(c *wsclient.Client) bool {
+		_, ok := c.Formatted()
+		return ok
+	})
+	if err != nil {
+		t.Fatalf("expected the server to answer, got %v", err)
+	}
+
+	errs, _ := alice.Formatted()
+	if len(errs) != 1 {
+		t.Fatalf("expected one syntax error, got %v", errs)
+	}
+	// the closing brace is at byte 39 but, after the two byte ü, at unit 38
+	if actual, expected := errs[0], (protocol.SyntaxError{Offset: 38, Line: 5, Column: 1}); actual.Offset != expected.Offset || actual.Line != expected.Line || actual.Column != expected.Column {
+		t.Errorf("expected error at %+v, got %+v", expected, actual)
+	}
+
+	s.Call(func() {
+		if actual := len(s.Operations); actual != 0 {
+			t.Errorf("expected the document to be left alone, got %d operations", actual)
+		}
+	})
+}
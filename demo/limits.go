@@ -0,0 +1,83 @@
+package main
+
+import (
+	"time"
+)
+
+// Limits protect a session from clients that send too much. A zero value
+// disables the corresponding limit.
+type Limits struct {
+	// largest websocket message accepted; bigger ones close the connection
+	// with close code 1009
+	MaxMessageBytes int64
+	// longest the document may grow, in units of ot.TextEncoding
+	MaxDocumentLength int
+	// sustained rate and burst of op events for each connection
+	OpsPerSecond float64
+	OpBurst      int
+	// sustained rate and burst of op events for the whole document
+	DocOpsPerSecond float64
+	DocOpBurst      int
+	// most ranges a selection may have
+	MaxSelectionRanges int
+}
+
+var DefaultLimits = Limits{
+	MaxMessageBytes:    1 << 20,
+	MaxDocumentLength:  1 << 20,
+	OpsPerSecond:       20,
+	OpBurst:            50,
+	DocOpsPerSecond:    200,
+	DocOpBurst:         500,
+	MaxSelectionRanges: 100,
+}
+
+// tokenBucket allows rate events per second on average, and up to burst at
+// once. A nil bucket allows everything.
+type tokenBucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate float64, burst int) *tokenBucket {
+	if rate <= 0 {
+		return nil
+	}
+	if burst < 1 {
+		burst = 1
+	}
+	return &tokenBucket{rate: rate, burst: float64(burst), tokens: float64(burst)}
+}
+
+// allow takes a token if there is one
+func (b *tokenBucket) allow(now time.Time) bool {
+	if b == nil {
+		return true
+	}
+	if !b.last.IsZero() {
+		b.tokens += now.Sub(b.last).Seconds() * b.rate
+		if b.tokens > b.burst {
+			b.tokens = b.burst
+		}
+	}
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// refund gives back a token taken by allow, for an event that was refused
+// for another reason
+func (b *tokenBucket) refund() {
+	if b == nil {
+		return
+	}
+	b.tokens++
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+}
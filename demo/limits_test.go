@@ -0,0 +1,171 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func newLimitsTestServer(t *testing.T, doc string, limits Limits) *httptest.Server {
+	srv, _ := newTestServer(t, doc, func(s *Session) {
+		s.Limits = limits
+	})
+	return srv
+}
+
+// sendRaw sends msg and returns the code of the error event it causes, or ""
+// if it is acknowledged. Events about other clients are skipped.
+func sendRaw(t *testing.T, ws *websocket.Conn, msg string) string {
+	if err := ws.WriteMessage(websocket.TextMessage, []byte(msg)); err != nil {
+		t.Fatalf("expected no error sending, got %v", err)
+	}
+	for {
+		e := readRaw(t, ws)
+		switch e.Name {
+		case "ok":
+			return ""
+		case "error":
+			var eerr EventError
+			if err := json.Unmarshal(e.Data, &eerr); err != nil {
+				t.Fatalf("expected no error decoding error event, got %v", err)
+			}
+			return eerr.Code
+		}
+	}
+}
+
+func TestTokenBucket(t *testing.T) {
+	b := newTokenBucket(2, 3)
+	now := time.Now()
+
+	for i := 0; i < 3; i++ {
+		if !b.allow(now) {
+			t.Errorf("expected event %d of the burst to be allowed", i)
+		}
+	}
+	if b.allow(now) {
+		t.Errorf("expected event after the burst to be denied")
+	}
+	if !b.allow(now.Add(500 * time.Millisecond)) {
+		t.Errorf("expected event to be allowed after refilling")
+	}
+	if b.allow(now.Add(500 * time.Millisecond)) {
+		t.Errorf("expected refill to be used up")
+	}
+
+	// refunds give back what was taken, up to the burst
+	b.refund()
+	if !b.allow(now.Add(500 * time.Millisecond)) {
+		t.Errorf("expected the refunded token to be allowed")
+	}
+	for i := 0; i < 5; i++ {
+		b.refund()
+	}
+	if actual, expected := b.tokens, 3.0; actual != expected {
+		t.Errorf("expected %v tokens, got %v", expected, actual)
+	}
+
+	var unlimited *tokenBucket
+	if !unlimited.allow(now) {
+		t.Errorf("expected nil bucket to allow everything")
+	}
+	unlimited.refund()
+}
+
+func TestLimits(t *testing.T) {
+	srv := newLimitsTestServer(t, "hello", Limits{
+		MaxDocumentLength:  8,
+		OpsPerSecond:       0.1,
+		OpBurst:            2,
+		MaxSelectionRanges: 2,
+	})
+	defer srv.Close()
+
+	ws := dialRaw(t, srv)
+	defer ws.Close()
+
+	if actual, expected := sendRaw(t, ws, `{"e": "sel", "d": {"ranges": [{"anchor": 1, "head": 1}, {"anchor": 2, "head": 2}, {"anchor": 3, "head": 3}]}}`), ErrCodeTooManyRanges; actual != expected {
+		t.Errorf("expected %s, got %q", expected, actual)
+	}
+	if actual, expected := sendRaw(t, ws, `{"e": "op", "d": [0, [5, "!!!!"]]}`), ErrCodeDocumentTooLong; actual != expected {
+		t.Errorf("expected %s, got %q", expected, actual)
+	}
+	if actual, expected := sendRaw(t, ws, `{"e": "op", "d": [0, [5, "!!!"]]}`), ""; actual != expected {
+		t.Errorf("expected op to be accepted, got %q", actual)
+	}
+
+	// the burst of two is used up
+	if actual, expected := sendRaw(t, ws, `{"e": "op", "d": [1, [8]]}`), ErrCodeRateLimited; actual != expected {
+		t.Errorf("expected %s, got %q", expected, actual)
+	}
+}
+
+func TestDocumentRateLimit(t *testing.T) {
+	srv := newLimitsTestServer(t, "hello", Limits{
+		DocOpsPerSecond: 0.1,
+		DocOpBurst:      1,
+	})
+	defer srv.Close()
+
+	alice := dialRaw(t, srv)
+	defer alice.Close()
+	bob := dialRaw(t, srv)
+	defer bob.Close()
+
+	if actual, expected := sendRaw(t, alice, `{"e": "op", "d": [0, [5, "!"]]}`), ""; actual != expected {
+		t.Errorf("expected op to be accepted, got %q", actual)
+	}
+	if actual, expected := sendRaw(t, bob, `{"e": "op", "d": [1, [6, "?"]]}`), ErrCodeRateLimited; actual != expected {
+		t.Errorf("expected %s, got %q", expected, actual)
+	}
+}
+
+// TestDocumentRateLimitRefund checks that ops the document refuses do not use
+// up the sender's own allowance
+func TestDocumentRateLimitRefund(t *testing.T) {
+	srv, s := newTestServer(t, "hello", func(s *Session) {
+		s.Limits = Limits{OpsPerSecond: 0.1, OpBurst: 1, DocOpsPerSecond: 0.1, DocOpBurst: 1}
+	})
+	defer srv.Close()
+
+	alice := dialRaw(t, srv)
+	defer alice.Close()
+	bob := dialRaw(t, srv)
+	defer bob.Close()
+
+	if actual, expected := sendRaw(t, alice, `{"e": "op", "d": [0, [5, "!"]]}`), ""; actual != expected {
+		t.Errorf("expected op to be accepted, got %q", actual)
+	}
+	if actual, expected := sendRaw(t, bob, `{"e": "op", "d": [1, [6, "?"]]}`), ErrCodeRateLimited; actual != expected {
+		t.Errorf("expected %s, got %q", expected, actual)
+	}
+
+	// once the document allows ops again, bob's own token is still there
+	s.Call(func() {
+		s.opBucket = newTokenBucket(s.Limits.DocOpsPerSecond, s.Limits.DocOpBurst)
+	})
+	if actual, expected := sendRaw(t, bob, `{"e": "op", "d": [1, [6, "?"]]}`), ""; actual != expected {
+		t.Errorf("expected op to be accepted, got %q", actual)
+	}
+}
+
+func TestMaxMessageBytes(t *testing.T) {
+	srv := newLimitsTestServer(t, "hello", Limits{MaxMessageBytes: 64})
+	defer srv.Close()
+
+	ws := dialRaw(t, srv)
+	defer ws.Close()
+
+	msg := `{"e": "op", "d": [0, [5, "` + strings.Repeat("x", 100) + `"]]}`
+	ws.WriteMessage(websocket.TextMessage, []byte(msg))
+
+	ws.SetReadDeadline(time.Now().Add(testTimeout))
+	_, _, err := ws.ReadMessage()
+	if !websocket.IsCloseError(err, websocket.CloseMessageTooBig) {
+		t.Errorf("expected message too big close error, got %v", err)
+	}
+}
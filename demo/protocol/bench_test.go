@@ -0,0 +1,92 @@
+package protocol_test
+
+import (
+	"bytes"
+	"compress/flate"
+	"testing"
+
+	"github.com/nitrous-io/ot.go/demo/protocol"
+	"github.com/nitrous-io/ot.go/ot/operation"
+	"github.com/nitrous-io/ot.go/ot/selection"
+)
+
+// typical events of a heavy editing session: a keystroke in the middle of a
+// document, with the cursor after it, and a cursor move
+var (
+	cursor = &selection.Selection{Ranges: []selection.Range{{Anchor: 1844, Head: 1844}}}
+
+	benchMessages = []struct {
+		name string
+		msg  protocol.Message
+	}{
+		{"op", &protocol.RemoteOp{ClientID: "17", Operation: operation.New().Retain(1843).Insert("x").Retain(2051), Selection: cursor}},
+		{"sel", &protocol.RemoteSel{ClientID: "17", Selection: cursor}},
+	}
+
+	benchProtocols = []protocol.Protocol{
+		{Version: protocol.Version1, Encoding: protocol.EncodingJSON},
+		{Version: protocol.Version1, Encoding: protocol.EncodingBinary},
+	}
+)
+
+// deflated returns the size of b compressed like permessage-deflate does
+// without context takeover, at the websocket library's default level
+func deflated(b []byte) int {
+	var buf bytes.Buffer
+	w, _ := flate.NewWriter(&buf, flate.BestSpeed)
+	w.Write(b)
+	w.Flush()
+	// the empty block that ends the flush is not sent
+	return buf.Len() - 4
+}
+
+// BenchmarkEncode reports the encode cost and, as bytes/msg and
+// deflated-bytes/msg, the payload size of each event in each encoding.
+func BenchmarkEncode(b *testing.B) {
+	for _, m := range benchMessages {
+		for _, p := range benchProtocols {
+			b.Run(m.name+"/"+p.Encoding, func(b *testing.B) {
+				encoded, err := protocol.Encode(p, m.msg)
+				if err != nil {
+					b.Fatalf("expected no error, got %v", err)
+				}
+				b.ReportAllocs()
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					protocol.Encode(p, m.msg)
+				}
+				b.ReportMetric(float64(len(encoded)), "bytes/msg")
+				b.ReportMetric(float64(deflated(encoded)), "deflated-bytes/msg")
+			})
+		}
+	}
+}
+
+// BenchmarkDecode measures how fast the server decodes the clients' events.
+func BenchmarkDecode(b *testing.B) {
+	clientMessages := []struct {
+		name string
+		msg  protocol.Message
+	}{
+		{"op", &protocol.Op{Revision: 4211, Operation: operation.New().Retain(1843).Insert("x").Retain(2051), Selection: cursor}},
+		{"sel", &protocol.Sel{Selection: cursor}},
+	}
+	for _, m := range clientMessages {
+		for _, p := range benchProtocols {
+			b.Run(m.name+"/"+p.Encoding, func(b *testing.B) {
+				encoded, err := protocol.Encode(p, m.msg)
+				if err != nil {
+					b.Fatalf("expected no error, got %v", err)
+				}
+				b.ReportAllocs()
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					if _, err := protocol.DecodeClient(p, encoded); err != nil {
+						b.Fatalf("expected no error, got %v", err)
+					}
+				}
+				b.ReportMetric(float64(len(encoded)), "bytes/msg")
+			})
+		}
+	}
+}
@@ -0,0 +1,566 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+	"sort"
+	"unicode/utf8"
+
+	"github.com/nitrous-io/ot.go/ot/operation"
+	"github.com/nitrous-io/ot.go/ot/selection"
+	"github.com/nitrous-io/ot.go/ot/session"
+)
+
+// The binary encoding is a compact alternative to json for clients that can
+// send and receive binary websocket messages. A message is the tag of its
+// name followed by its fields, in the order of the struct fields:
+//
+//	int          uvarint
+//	string       uvarint length followed by utf-8 bytes
+//	operation    uvarint number of components, then a varint per component:
+//	             n > 0 retains n, n < 0 deletes -n, 0 is followed by the
+//	             string to insert
+//	selection    uvarint number of ranges + 1, 0 for no selection, then the
+//	             anchor and head of each range as ints
+//	clients      uvarint count, then id, name and selection of each client
+//	errors       uvarint count, then offset, line, column and message of each
+//	             syntax error
+//	diagnostics  uvarint count, then from, to, severity and message of each
+//	             diagnostic
+//	annotation   id, from, to, flags (1 orphaned, 2 resolved), then uvarint
+//	             count and the author and text of each comment
+//
+// Fields can only be added at the end of server messages; clients ignore
+// what they do not know.
+
+var errBinaryTruncated = errors.New("message is truncated")
+
+// binaryTags maps message names to tags; 0 is not a valid tag
+var binaryTags = map[string]byte{}
+
+var binaryNames = []string{"", "join", "op", "sel", "resync", "doc", "registered", "quit", "ok", "resumed", "shutdown", "error", "transport", "format", "diagnostics", "run", "stop", "output", "exit", "comment", "reply", "resolve", "annotation", "annotations"}
+
+func init() {
+	for tag, name := range binaryNames {
+		if name != "" {
+			binaryTags[name] = byte(tag)
+		}
+	}
+}
+
+// binaryMessage is implemented by every message
+type binaryMessage interface {
+	appendBinary(b []byte) []byte
+	decodeBinary(r *binaryReader)
+}
+
+func encodeBinary(m Message) ([]byte, error) {
+	tag, ok := binaryTags[m.Name()]
+	bm, isBinary := m.(binaryMessage)
+	if !ok || !isBinary {
+		return nil, ErrUnsupportedEncoding
+	}
+	return bm.appendBinary([]byte{tag}), nil
+}
+
+func decodeBinary(data []byte, strict bool, message func(name string) Message) (Message, error) {
+	if len(data) == 0 {
+		return nil, newDecodeError("", CodeMalformedEvent, "empty message")
+	}
+	var name string
+	if int(data[0]) < len(binaryNames) {
+		name = binaryNames[data[0]]
+	}
+	if name == "" {
+		return nil, newDecodeError("", CodeUnknownEvent, "unknown event")
+	}
+	m := message(name)
+	bm, ok := m.(binaryMessage)
+	if !ok {
+		return nil, newDecodeError(name, CodeUnknownEvent, "unknown event")
+	}
+
+	r := &binaryReader{data: data[1:], strict: strict}
+	bm.decodeBinary(r)
+	if r.err == nil && strict && len(r.data) > 0 {
+		r.fail(CodeMalformedEvent, "unexpected data after message")
+	}
+	if derr, ok := r.err.(*DecodeError); ok {
+		derr.Event = name
+		return nil, derr
+	}
+	if r.err != nil {
+		code := CodeMalformedEvent
+		if d, ok := m.(decoder); ok {
+			code = d.errorCode()
+		}
+		return nil, newDecodeError(name, code, r.err.Error())
+	}
+	return m, nil
+}
+
+func appendInt(b []byte, n int) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	return append(b, buf[:binary.PutUvarint(buf[:], uint64(n))]...)
+}
+
+func appendString(b []byte, s string) []byte {
+	return append(appendInt(b, len(s)), s...)
+}
+
+func appendOperation(b []byte, op *operation.Operation) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	b = appendInt(b, len(op.Ops))
+	for _, o := range op.Ops {
+		if operation.IsInsert(o) {
+			b = appendString(append(b, 0), string(o.S))
+		} else {
+			// retains are positive, deletes negative
+			b = append(b, buf[:binary.PutVarint(buf[:], int64(o.N))]...)
+		}
+	}
+	return b
+}
+
+func appendSelection(b []byte, sel *selection.Selection) []byte {
+	if sel == nil {
+		return appendInt(b, 0)
+	}
+	b = appendInt(b, len(sel.Ranges)+1)
+	for _, r := range sel.Ranges {
+		b = appendInt(appendInt(b, r.Anchor), r.Head)
+	}
+	return b
+}
+
+func appendClients(b []byte, clients map[string]*session.Client) []byte {
+	ids := make([]string, 0, len(clients))
+	for id := range clients {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	b = appendInt(b, len(ids))
+	for _, id := range ids {
+		cl := clients[id]
+		b = appendString(appendString(b, id), cl.Name)
+		b = appendSelection(b, &cl.Selection)
+	}
+	return b
+}
+
+// binaryReader reads the fields of a message. The first error sticks and
+// makes every later read return zero values.
+type binaryReader struct {
+	data   []byte
+	strict bool // client messages must not contain anything unexpected
+	err    error
+}
+
+func (r *binaryReader) fail(code, message string) {
+	if r.err == nil {
+		r.err = newDecodeError("", code, message)
+	}
+}
+
+func (r *binaryReader) int() int {
+	if r.err != nil {
+		return 0
+	}
+	n, size := binary.Uvarint(r.data)
+	if size <= 0 || n > math.MaxInt32 {
+		r.err = errBinaryTruncated
+		return 0
+	}
+	r.data = r.data[size:]
+	return int(n)
+}
+
+func (r *binaryReader) varint() int {
+	if r.err != nil {
+		return 0
+	}
+	n, size := binary.Varint(r.data)
+	if size <= 0 || n > math.MaxInt32 || n < -math.MaxInt32 {
+		r.err = errBinaryTruncated
+		return 0
+	}
+	r.data = r.data[size:]
+	return int(n)
+}
+
+func (r *binaryReader) string() string {
+	n := r.int()
+	if r.err != nil {
+		return ""
+	}
+	if n > len(r.data) {
+		r.err = errBinaryTruncated
+		return ""
+	}
+	s := string(r.data[:n])
+	r.data = r.data[n:]
+	if r.strict && !utf8.ValidString(s) {
+		r.err = errors.New("strings must be utf-8")
+	}
+	return s
+}
+
+func (r *binaryReader) operation() *operation.Operation {
+	n := r.int()
+	// every component takes at least one byte
+	if r.err == nil && n > len(r.data) {
+		r.err = errBinaryTruncated
+	}
+	op := operation.New()
+	for i := 0; i < n && r.err == nil; i++ {
+		switch c := r.varint(); {
+		case c > 0:
+			op.Retain(c)
+		case c < 0:
+			op.Delete(-c)
+		default:
+			s := r.string()
+			if s == "" && r.err == nil {
+				r.fail(CodeMalformedOp, "inserts must not be empty")
+			}
+			op.Insert(s)
+		}
+	}
+	if r.err != nil {
+		return nil
+	}
+	return op
+}
+
+func (r *binaryReader) selection() *selection.Selection {
+	n := r.int()
+	if r.err != nil || n == 0 {
+		return nil
+	}
+	n--
+	// every range takes at least two bytes
+	if n > len(r.data)/2 {
+		r.fail(CodeMalformedSelection, errBinaryTruncated.Error())
+		return nil
+	}
+	sel := &selection.Selection{Ranges: make([]selection.Range, n)}
+	for i := range sel.Ranges {
+		sel.Ranges[i] = selection.Range{Anchor: r.int(), Head: r.int()}
+	}
+	if r.err != nil {
+		if _, ok := r.err.(*DecodeError); !ok {
+			r.err = newDecodeError("", CodeMalformedSelection, r.err.Error())
+		}
+		return nil
+	}
+	return sel
+}
+
+func appendSyntaxErrors(b []byte, errs []SyntaxError) []byte {
+	b = appendInt(b, len(errs))
+	for _, e := range errs {
+		b = appendString(appendInt(appendInt(appendInt(b, e.Offset), e.Line), e.Column), e.Message)
+	}
+	return b
+}
+
+func (r *binaryReader) syntaxErrors() []SyntaxError {
+	n := r.int()
+	// every error takes at least four bytes
+	if r.err == nil && n > len(r.data)/4 {
+		r.err = errBinaryTruncated
+	}
+	if r.err != nil {
+		return nil
+	}
+	errs := make([]SyntaxError, n)
+	for i := range errs {
+		errs[i] = SyntaxError{Offset: r.int(), Line: r.int(), Column: r.int(), Message: r.string()}
+	}
+	return errs
+}
+
+func appendDiagnostics(b []byte, diags []Diagnostic) []byte {
+	b = appendInt(b, len(diags))
+	for _, d := range diags {
+		b = appendString(appendString(appendInt(appendInt(b, d.From), d.To), d.Severity), d.Message)
+	}
+	return b
+}
+
+func (r *binaryReader) diagnostics() []Diagnostic {
+	n := r.int()
+	// every diagnostic takes at least four bytes
+	if r.err == nil && n > len(r.data)/4 {
+		r.err = errBinaryTruncated
+	}
+	if r.err != nil {
+		return nil
+	}
+	diags := make([]Diagnostic, n)
+	for i := range diags {
+		diags[i] = Diagnostic{From: r.int(), To: r.int(), Severity: r.string(), Message: r.string()}
+	}
+	return diags
+}
+
+func appendAnnotation(b []byte, a *session.Annotation) []byte {
+	var flags int
+	if a.Orphaned {
+		flags |= 1
+	}
+	if a.Resolved {
+		flags |= 2
+	}
+	b = appendInt(appendInt(appendInt(appendString(b, a.ID), a.From), a.To), flags)
+	b = appendInt(b, len(a.Comments))
+	for _, c := range a.Comments {
+		b = appendString(appendString(b, c.Author), c.Text)
+	}
+	return b
+}
+
+func (r *binaryReader) annotation() session.Annotation {
+	a := session.Annotation{ID: r.string(), From: r.int(), To: r.int()}
+	flags := r.int()
+	a.Orphaned, a.Resolved = flags&1 != 0, flags&2 != 0
+	n := r.int()
+	// every comment takes at least two bytes
+	if r.err == nil && n > len(r.data)/2 {
+		r.err = errBinaryTruncated
+	}
+	if r.err != nil {
+		return session.Annotation{}
+	}
+	a.Comments = make([]session.Comment, n)
+	for i := range a.Comments {
+		a.Comments[i] = session.Comment{Author: r.string(), Text: r.string()}
+	}
+	return a
+}
+
+func (r *binaryReader) clients() map[string]*session.Client {
+	n := r.int()
+	// every client takes at least three bytes
+	if r.err == nil && n > len(r.data)/3 {
+		r.err = errBinaryTruncated
+	}
+	if r.err != nil {
+		return nil
+	}
+	clients := make(map[string]*session.Client, n)
+	for i := 0; i < n && r.err == nil; i++ {
+		id, name := r.string(), r.string()
+		cl := &session.Client{Name: name, Selection: selection.Selection{Ranges: []selection.Range{}}}
+		if sel := r.selection(); sel != nil {
+			cl.Selection = *sel
+		}
+		clients[id] = cl
+	}
+	return clients
+}
+
+func (m *Join) appendBinary(b []byte) []byte {
+	return appendString(b, m.Username)
+}
+
+func (m *Join) decodeBinary(r *binaryReader) {
+	if m.Username = r.string(); m.Username == "" && r.err == nil {
+		r.err = errors.New("username must be a non-empty string")
+	}
+}
+
+func (m *Op) appendBinary(b []byte) []byte {
+	return appendSelection(appendOperation(appendInt(b, m.Revision), m.Operation), m.Selection)
+}
+
+func (m *Op) decodeBinary(r *binaryReader) {
+	m.Revision = r.int()
+	m.Operation = r.operation()
+	m.Selection = r.selection()
+}
+
+func (m *Sel) appendBinary(b []byte) []byte {
+	return appendSelection(b, m.Selection)
+}
+
+func (m *Sel) decodeBinary(r *binaryReader) {
+	m.Selection = r.selection()
+}
+
+func (m *Resync) appendBinary(b []byte) []byte { return b }
+func (m *Resync) decodeBinary(r *binaryReader) {}
+
+func (m *Format) appendBinary(b []byte) []byte { return b }
+func (m *Format) decodeBinary(r *binaryReader) {}
+
+func (m *Run) appendBinary(b []byte) []byte { return b }
+func (m *Run) decodeBinary(r *binaryReader) {}
+
+func (m *Stop) appendBinary(b []byte) []byte { return b }
+func (m *Stop) decodeBinary(r *binaryReader) {}
+
+func (m *Comment) appendBinary(b []byte) []byte {
+	return appendString(appendInt(appendInt(appendInt(b, m.Revision), m.From), m.To), m.Text)
+}
+
+func (m *Comment) decodeBinary(r *binaryReader) {
+	m.Revision, m.From, m.To, m.Text = r.int(), r.int(), r.int(), r.string()
+	if r.err == nil {
+		r.err = m.validate()
+	}
+}
+
+func (m *Reply) appendBinary(b []byte) []byte {
+	return appendString(appendString(b, m.ID), m.Text)
+}
+
+func (m *Reply) decodeBinary(r *binaryReader) {
+	m.ID, m.Text = r.string(), r.string()
+	if r.err == nil {
+		r.err = m.validate()
+	}
+}
+
+func (m *Resolve) appendBinary(b []byte) []byte { return appendString(b, m.ID) }
+
+func (m *Resolve) decodeBinary(r *binaryReader) {
+	if m.ID = r.string(); m.ID == "" && r.err == nil {
+		r.err = errors.New("data must be the id of an annotation")
+	}
+}
+
+func (m *Doc) appendBinary(b []byte) []byte {
+	b = appendInt(appendString(b, m.Document), m.Revision)
+	b = appendClients(b, m.Clients)
+	b = appendString(appendString(appendString(b, m.ClientID), m.ResumeToken), m.Role)
+	return appendString(b, m.Units)
+}
+
+func (m *Doc) decodeBinary(r *binaryReader) {
+	m.Document, m.Revision = r.string(), r.int()
+	m.Clients = r.clients()
+	m.ClientID, m.ResumeToken, m.Role = r.string(), r.string(), r.string()
+	if len(r.data) > 0 {
+		// older servers do not announce their units
+		m.Units = r.string()
+	}
+}
+
+func (m *Registered) appendBinary(b []byte) []byte { return appendString(b, m.ClientID) }
+func (m *Registered) decodeBinary(r *binaryReader) { m.ClientID = r.string() }
+
+func (m *Quit) appendBinary(b []byte) []byte { return appendString(b, m.ClientID) }
+func (m *Quit) decodeBinary(r *binaryReader) { m.ClientID = r.string() }
+
+func (m *OK) appendBinary(b []byte) []byte { return b }
+func (m *OK) decodeBinary(r *binaryReader) {}
+
+func (m *Joined) appendBinary(b []byte) []byte {
+	return appendString(appendString(b, m.ClientID), m.Username)
+}
+
+func (m *Joined) decodeBinary(r *binaryReader) {
+	m.ClientID, m.Username = r.string(), r.string()
+}
+
+func (m *RemoteOp) appendBinary(b []byte) []byte {
+	return appendSelection(appendOperation(appendString(b, m.ClientID), m.Operation), m.Selection)
+}
+
+func (m *RemoteOp) decodeBinary(r *binaryReader) {
+	m.ClientID = r.string()
+	m.Operation = r.operation()
+	m.Selection = r.selection()
+}
+
+func (m *RemoteSel) appendBinary(b []byte) []byte {
+	return appendSelection(appendString(b, m.ClientID), m.Selection)
+}
+
+func (m *RemoteSel) decodeBinary(r *binaryReader) {
+	m.ClientID = r.string()
+	m.Selection = r.selection()
+}
+
+func (m *Resumed) appendBinary(b []byte) []byte {
+	return appendClients(appendInt(appendString(b, m.ClientID), m.Revision), m.Clients)
+}
+
+func (m *Resumed) decodeBinary(r *binaryReader) {
+	m.ClientID, m.Revision = r.string(), r.int()
+	m.Clients = r.clients()
+}
+
+func (m *Shutdown) appendBinary(b []byte) []byte { return appendInt(b, int(m.RetryAfter)) }
+func (m *Shutdown) decodeBinary(r *binaryReader) { m.RetryAfter = int64(r.int()) }
+
+func (m *Error) appendBinary(b []byte) []byte {
+	return appendString(appendString(appendString(b, m.Code), m.Message), m.Event)
+}
+
+func (m *Error) decodeBinary(r *binaryReader) {
+	m.Code, m.Message, m.Event = r.string(), r.string(), r.string()
+}
+
+func (m *Transport) appendBinary(b []byte) []byte { return appendString(b, m.ID) }
+func (m *Transport) decodeBinary(r *binaryReader) { m.ID = r.string() }
+
+func (m *Formatted) appendBinary(b []byte) []byte { return appendSyntaxErrors(b, m.Errors) }
+func (m *Formatted) decodeBinary(r *binaryReader) { m.Errors = r.syntaxErrors() }
+
+func (m *Diagnostics) appendBinary(b []byte) []byte { return appendDiagnostics(b, m.Diagnostics) }
+func (m *Diagnostics) decodeBinary(r *binaryReader) { m.Diagnostics = r.diagnostics() }
+
+func (m *Running) appendBinary(b []byte) []byte {
+	return appendString(appendString(b, m.ClientID), m.Username)
+}
+
+func (m *Running) decodeBinary(r *binaryReader) {
+	m.ClientID, m.Username = r.string(), r.string()
+}
+
+func (m *Output) appendBinary(b []byte) []byte {
+	return appendString(appendString(b, m.Stream), m.Data)
+}
+
+func (m *Output) decodeBinary(r *binaryReader) {
+	m.Stream, m.Data = r.string(), r.string()
+}
+
+// the status is -1 when the program did not exit by itself
+func (m *Exit) appendBinary(b []byte) []byte {
+	return appendString(appendInt(b, m.Status+1), m.Error)
+}
+
+func (m *Exit) decodeBinary(r *binaryReader) {
+	m.Status, m.Error = r.int()-1, r.string()
+}
+
+func (m *Annotated) appendBinary(b []byte) []byte { return appendAnnotation(b, &m.Annotation) }
+func (m *Annotated) decodeBinary(r *binaryReader) { m.Annotation = r.annotation() }
+
+func (m *Annotations) appendBinary(b []byte) []byte {
+	b = appendInt(b, len(m.Annotations))
+	for i := range m.Annotations {
+		b = appendAnnotation(b, &m.Annotations[i])
+	}
+	return b
+}
+
+func (m *Annotations) decodeBinary(r *binaryReader) {
+	n := r.int()
+	// every annotation takes at least five bytes
+	if r.err == nil && n > len(r.data)/5 {
+		r.err = errBinaryTruncated
+	}
+	if r.err != nil {
+		return
+	}
+	m.Annotations = make([]session.Annotation, n)
+	for i := range m.Annotations {
+		m.Annotations[i] = r.annotation()
+	}
+}
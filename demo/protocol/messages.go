@@ -0,0 +1,563 @@
+package protocol
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+
+	"github.com/nitrous-io/ot.go/ot/operation"
+	"github.com/nitrous-io/ot.go/ot/selection"
+	"github.com/nitrous-io/ot.go/ot/session"
+)
+
+// Messages sent by clients. They are decoded strictly: unknown fields,
+// missing fields and values of the wrong type are errors.
+
+// Join names the client: {"username": name}
+type Join struct {
+	Username string `json:"username"`
+}
+
+// Op submits an operation: [revision, ops, selection?]
+type Op struct {
+	Revision  int
+	Operation *operation.Operation
+	Selection *selection.Selection // the author's selection after the op, or nil
+}
+
+// Sel moves the client's selection: selection or null, which clears it.
+type Sel struct {
+	Selection *selection.Selection
+}
+
+// Resync asks for the whole document again.
+type Resync struct{}
+
+// Format asks the server to gofmt the document.
+type Format struct{}
+
+// Run asks the server to build and run the document.
+type Run struct{}
+
+// Stop cancels the program that is running.
+type Stop struct{}
+
+// Comment starts a thread on the text between From and To in the document at
+// Revision: {"revision": n, "from": n, "to": n, "text": s}
+type Comment struct {
+	Revision int    `json:"revision"`
+	From     int    `json:"from"`
+	To       int    `json:"to"`
+	Text     string `json:"text"`
+}
+
+// Reply adds a comment to the thread of an annotation: {"id": s, "text": s}
+type Reply struct {
+	ID   string `json:"id"`
+	Text string `json:"text"`
+}
+
+// Resolve marks an annotation as resolved: its id
+type Resolve struct {
+	ID string
+}
+
+func (m *Join) Name() string    { return "join" }
+func (m *Op) Name() string      { return "op" }
+func (m *Sel) Name() string     { return "sel" }
+func (m *Resync) Name() string  { return "resync" }
+func (m *Format) Name() string  { return "format" }
+func (m *Run) Name() string     { return "run" }
+func (m *Stop) Name() string    { return "stop" }
+func (m *Comment) Name() string { return "comment" }
+func (m *Reply) Name() string   { return "reply" }
+func (m *Resolve) Name() string { return "resolve" }
+
+func (m *Join) decode(data json.RawMessage) error {
+	if err := decodeStrict(data, m); err != nil {
+		return err
+	}
+	if m.Username == "" {
+		return errors.New("username must be a non-empty string")
+	}
+	return nil
+}
+
+func (m *Join) errorCode() string { return CodeMalformedJoin }
+
+func (m *Op) decode(data json.RawMessage) error {
+	var d []json.RawMessage
+	if err := decodeStrict(data, &d); err != nil || len(d) < 2 || len(d) > 3 {
+		return errors.New("data must be [revision, ops, selection?]")
+	}
+	if err := json.Unmarshal(d[0], &m.Revision); err != nil {
+		return newDecodeError("", CodeInvalidRevision, "revision must be an integer")
+	}
+	op, err := decodeOperation(d[1])
+	if err != nil {
+		return err
+	}
+	m.Operation = op
+	if len(d) == 3 && !isNull(d[2]) {
+		if m.Selection, err = decodeSelection(d[2]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *Op) errorCode() string { return CodeMalformedOp }
+
+func (m *Op) MarshalJSON() ([]byte, error) {
+	data := []interface{}{m.Revision, m.Operation.Marshal()}
+	if m.Selection != nil {
+		data = append(data, m.Selection.Marshal())
+	}
+	return json.Marshal(data)
+}
+
+func (m *Sel) decode(data json.RawMessage) error {
+	if isNull(data) {
+		m.Selection = nil
+		return nil
+	}
+	sel, err := decodeSelection(data)
+	m.Selection = sel
+	return err
+}
+
+func (m *Sel) errorCode() string { return CodeMalformedSelection }
+
+func (m *Sel) MarshalJSON() ([]byte, error) {
+	return marshalSelection(m.Selection)
+}
+
+func (m *Resync) decode(data json.RawMessage) error {
+	if !isNull(data) {
+		return errors.New("resync has no data")
+	}
+	return nil
+}
+
+func (m *Resync) errorCode() string { return CodeMalformedEvent }
+
+func (m *Format) decode(data json.RawMessage) error {
+	if !isNull(data) {
+		return errors.New("format has no data")
+	}
+	return nil
+}
+
+func (m *Format) errorCode() string { return CodeMalformedEvent }
+
+func (m *Run) decode(data json.RawMessage) error {
+	if !isNull(data) {
+		return errors.New("run has no data")
+	}
+	return nil
+}
+
+func (m *Run) errorCode() string { return CodeMalformedEvent }
+
+func (m *Stop) decode(data json.RawMessage) error {
+	if !isNull(data) {
+		return errors.New("stop has no data")
+	}
+	return nil
+}
+
+func (m *Stop) errorCode() string { return CodeMalformedEvent }
+
+func (m *Comment) decode(data json.RawMessage) error {
+	var d struct {
+		Revision *int    `json:"revision"`
+		From     *int    `json:"from"`
+		To       *int    `json:"to"`
+		Text     *string `json:"text"`
+	}
+	if err := decodeStrict(data, &d); err != nil {
+		return err
+	}
+	if d.Revision == nil || d.From == nil || d.To == nil || d.Text == nil {
+		return errors.New("data must be {revision, from, to, text}")
+	}
+	m.Revision, m.From, m.To, m.Text = *d.Revision, *d.From, *d.To, *d.Text
+	return m.validate()
+}
+
+func (m *Comment) validate() error {
+	if m.From < 0 || m.From > m.To {
+		return errors.New("from and to must be positions with from <= to")
+	}
+	return validateText(m.Text)
+}
+
+func (m *Comment) errorCode() string { return CodeMalformedComment }
+
+func (m *Reply) decode(data json.RawMessage) error {
+	if err := decodeStrict(data, m); err != nil {
+		return err
+	}
+	return m.validate()
+}
+
+func (m *Reply) validate() error {
+	if m.ID == "" {
+		return errors.New("id must be a non-empty string")
+	}
+	return validateText(m.Text)
+}
+
+func (m *Reply) errorCode() string { return CodeMalformedComment }
+
+func (m *Resolve) decode(data json.RawMessage) error {
+	if err := decodeStrict(data, &m.ID); err != nil || m.ID == "" {
+		return errors.New("data must be the id of an annotation")
+	}
+	return nil
+}
+
+func (m *Resolve) errorCode() string { return CodeMalformedEvent }
+
+func (m *Resolve) MarshalJSON() ([]byte, error) {
+	return json.Marshal(m.ID)
+}
+
+func validateText(text string) error {
+	if strings.TrimSpace(text) == "" {
+		return errors.New("text must not be blank")
+	}
+	return nil
+}
+
+// decodeOperation decodes ops, an array of positive retains, negative
+// deletes and non-empty inserts
+func decodeOperation(data json.RawMessage) (*operation.Operation, error) {
+	var ops []json.RawMessage
+	if err := decodeStrict(data, &ops); err != nil || ops == nil {
+		return nil, newDecodeError("", CodeMalformedOp, "ops must be an array")
+	}
+	op := operation.New()
+	for _, o := range ops {
+		var s string
+		if json.Unmarshal(o, &s) == nil {
+			if s == "" {
+				return nil, newDecodeError("", CodeMalformedOp, "inserts must not be empty")
+			}
+			op.Insert(s)
+			continue
+		}
+		var n int
+		if err := json.Unmarshal(o, &n); err != nil || n == 0 {
+			return nil, newDecodeError("", CodeMalformedOp, "ops must be non-zero integers or strings")
+		}
+		if n > 0 {
+			op.Retain(n)
+		} else {
+			op.Delete(-n)
+		}
+	}
+	return op, nil
+}
+
+// decodeSelection decodes {"ranges": [{"anchor": n, "head": n}, ...]}.
+// Positions outside of the document, negative ones included, are left to
+// selection.Normalize.
+func decodeSelection(data json.RawMessage) (*selection.Selection, error) {
+	var d struct {
+		Ranges []struct {
+			Anchor *int `json:"anchor"`
+			Head   *int `json:"head"`
+		} `json:"ranges"`
+	}
+	if err := decodeStrict(data, &d); err != nil {
+		return nil, newDecodeError("", CodeMalformedSelection, err.Error())
+	}
+	if d.Ranges == nil {
+		return nil, newDecodeError("", CodeMalformedSelection, "ranges is required")
+	}
+	sel := &selection.Selection{Ranges: make([]selection.Range, len(d.Ranges))}
+	for i, r := range d.Ranges {
+		if r.Anchor == nil || r.Head == nil {
+			return nil, newDecodeError("", CodeMalformedSelection, "ranges need an anchor and a head")
+		}
+		sel.Ranges[i] = selection.Range{Anchor: *r.Anchor, Head: *r.Head}
+	}
+	return sel, nil
+}
+
+func marshalSelection(sel *selection.Selection) ([]byte, error) {
+	if sel == nil {
+		return []byte("null"), nil
+	}
+	return json.Marshal(sel.Marshal())
+}
+
+// Messages sent by the server. Clients decode them leniently so that fields
+// can be added within a version.
+
+// Doc is the whole document, sent when a client connects or resyncs.
+type Doc struct {
+	Document    string                     `json:"document"`
+	Revision    int                        `json:"revision"`
+	Clients     map[string]*session.Client `json:"clients"`
+	ClientID    string                     `json:"client_id"`
+	ResumeToken string                     `json:"resume_token"`
+	Role        string                     `json:"role"`
+	Units       string                     `json:"units,omitempty"` // that positions count, see Units
+}
+
+// Registered confirms a join: the client's id
+type Registered struct {
+	ClientID string
+}
+
+// Joined announces that another client joined.
+type Joined struct {
+	ClientID string `json:"client_id"`
+	Username string `json:"username"`
+}
+
+// Quit announces that a client left: its id
+type Quit struct {
+	ClientID string
+}
+
+// OK acknowledges the client's operation.
+type OK struct{}
+
+// RemoteOp is an operation by another client: [client_id, ops, selection?].
+// ClientID is empty for edits made through the http api.
+type RemoteOp struct {
+	ClientID  string
+	Operation *operation.Operation
+	Selection *selection.Selection
+}
+
+// RemoteSel is another client's selection: [client_id, selection or null]
+type RemoteSel struct {
+	ClientID  string
+	Selection *selection.Selection
+}
+
+// Resumed confirms that a reconnecting client kept its identity, after the
+// operations it missed have been replayed.
+type Resumed struct {
+	ClientID string                     `json:"client_id"`
+	Revision int                        `json:"revision"`
+	Clients  map[string]*session.Client `json:"clients"`
+}
+
+// Shutdown announces that the server is going away.
+type Shutdown struct {
+	RetryAfter int64 `json:"retry_after"` // in milliseconds
+}
+
+// Error reports an event of the client that could not be handled.
+type Error struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+	Event   string `json:"event,omitempty"` // name of the offending event
+}
+
+// Transport is the first event of the http transports, naming the
+// connection to POST events to.
+type Transport struct {
+	ID string `json:"id"`
+}
+
+// Formatted answers a format event. The formatted document is broadcast as
+// an op without a client; if the document does not parse, it is left alone
+// and Errors tells why.
+type Formatted struct {
+	Errors []SyntaxError `json:"errors"`
+}
+
+// Diagnostics are the problems found in the document, as of the revision the
+// client has reached when it receives them:
+// [{"from": n, "to": n, "severity": s, "message": s}, ...]
+type Diagnostics struct {
+	Diagnostics []Diagnostic
+}
+
+// Diagnostic is a problem with the code between From and To, which count
+// units of the document's text encoding. Severity is "error" or "warning".
+type Diagnostic struct {
+	From     int    `json:"from"`
+	To       int    `json:"to"`
+	Severity string `json:"severity"`
+	Message  string `json:"message"`
+}
+
+// Running announces that a client started a run of the document.
+type Running struct {
+	ClientID string `json:"client_id"`
+	Username string `json:"username"`
+}
+
+// Output is a chunk of what the running program, or the compiler, wrote to
+// Stream, "stdout" or "stderr".
+type Output struct {
+	Stream string `json:"stream"`
+	Data   string `json:"data"`
+}
+
+// Exit ends a run. Status is the exit status of the program, or -1 if it did
+// not exit by itself; Error tells why, e.g. that it did not build.
+type Exit struct {
+	Status int    `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+// Annotated is an annotation that was added, replied to or resolved. Its
+// range is as of the revision the client has reached when it receives it.
+type Annotated struct {
+	Annotation session.Annotation
+}
+
+// Annotations are all annotations of the document, sent after it:
+// [annotation, ...]
+type Annotations struct {
+	Annotations []session.Annotation
+}
+
+// SyntaxError is a parse error at a position of the document. Offset and
+// Column count units of the document's text encoding; Line and Column start
+// at 1.
+type SyntaxError struct {
+	Offset  int    `json:"offset"`
+	Line    int    `json:"line"`
+	Column  int    `json:"column"`
+	Message string `json:"message"`
+}
+
+func (m *Doc) Name() string         { return "doc" }
+func (m *Registered) Name() string  { return "registered" }
+func (m *Joined) Name() string      { return "join" }
+func (m *Quit) Name() string        { return "quit" }
+func (m *OK) Name() string          { return "ok" }
+func (m *RemoteOp) Name() string    { return "op" }
+func (m *RemoteSel) Name() string   { return "sel" }
+func (m *Resumed) Name() string     { return "resumed" }
+func (m *Shutdown) Name() string    { return "shutdown" }
+func (m *Error) Name() string       { return "error" }
+func (m *Transport) Name() string   { return "transport" }
+func (m *Formatted) Name() string   { return "format" }
+func (m *Diagnostics) Name() string { return "diagnostics" }
+func (m *Running) Name() string     { return "run" }
+func (m *Output) Name() string      { return "output" }
+func (m *Exit) Name() string        { return "exit" }
+func (m *Annotated) Name() string   { return "annotation" }
+func (m *Annotations) Name() string { return "annotations" }
+
+func (m *Error) Error() string {
+	return m.Code + ": " + m.Message
+}
+
+func (m *Registered) MarshalJSON() ([]byte, error) {
+	return json.Marshal(m.ClientID)
+}
+
+func (m *Registered) UnmarshalJSON(data []byte) error {
+	return json.Unmarshal(data, &m.ClientID)
+}
+
+func (m *Quit) MarshalJSON() ([]byte, error) {
+	return json.Marshal(m.ClientID)
+}
+
+func (m *Quit) UnmarshalJSON(data []byte) error {
+	return json.Unmarshal(data, &m.ClientID)
+}
+
+func (m *RemoteOp) MarshalJSON() ([]byte, error) {
+	data := []interface{}{m.ClientID, m.Operation.Marshal()}
+	if m.Selection != nil {
+		data = append(data, m.Selection.Marshal())
+	}
+	return json.Marshal(data)
+}
+
+func (m *RemoteOp) UnmarshalJSON(data []byte) error {
+	var d []json.RawMessage
+	if err := json.Unmarshal(data, &d); err != nil {
+		return err
+	}
+	if len(d) < 2 {
+		return errors.New("data must be [client_id, ops, selection?]")
+	}
+	if err := json.Unmarshal(d[0], &m.ClientID); err != nil {
+		return err
+	}
+	var ops []interface{}
+	if err := json.Unmarshal(d[1], &ops); err != nil {
+		return err
+	}
+	op, err := operation.Unmarshal(ops)
+	if err != nil {
+		return err
+	}
+	m.Operation = op
+	if len(d) >= 3 && !isNull(d[2]) {
+		m.Selection = &selection.Selection{}
+		return json.Unmarshal(d[2], m.Selection)
+	}
+	return nil
+}
+
+func (m *RemoteSel) MarshalJSON() ([]byte, error) {
+	sel, err := marshalSelection(m.Selection)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal([]interface{}{m.ClientID, json.RawMessage(sel)})
+}
+
+func (m *RemoteSel) UnmarshalJSON(data []byte) error {
+	var d []json.RawMessage
+	if err := json.Unmarshal(data, &d); err != nil {
+		return err
+	}
+	if len(d) < 2 {
+		return errors.New("data must be [client_id, selection]")
+	}
+	if err := json.Unmarshal(d[0], &m.ClientID); err != nil {
+		return err
+	}
+	if isNull(d[1]) {
+		m.Selection = nil
+		return nil
+	}
+	m.Selection = &selection.Selection{}
+	return json.Unmarshal(d[1], m.Selection)
+}
+
+func (m *Diagnostics) MarshalJSON() ([]byte, error) {
+	if m.Diagnostics == nil {
+		return []byte("[]"), nil
+	}
+	return json.Marshal(m.Diagnostics)
+}
+
+func (m *Diagnostics) UnmarshalJSON(data []byte) error {
+	return json.Unmarshal(data, &m.Diagnostics)
+}
+
+func (m *Annotated) MarshalJSON() ([]byte, error) {
+	return json.Marshal(m.Annotation)
+}
+
+func (m *Annotated) UnmarshalJSON(data []byte) error {
+	return json.Unmarshal(data, &m.Annotation)
+}
+
+func (m *Annotations) MarshalJSON() ([]byte, error) {
+	if m.Annotations == nil {
+		return []byte("[]"), nil
+	}
+	return json.Marshal(m.Annotations)
+}
+
+func (m *Annotations) UnmarshalJSON(data []byte) error {
+	return json.Unmarshal(data, &m.Annotations)
+}
@@ -0,0 +1,347 @@
+// Package protocol defines the messages the demo server and its clients
+// exchange, how they are encoded and how client and server agree on a
+// protocol version and encoding.
+//
+// In json, every message is an envelope {"e": name, "d": data}; binary.go
+// describes the binary encoding. Clients offer the protocols they speak as
+// websocket subprotocols, e.g. "ot.v1.json", or in the protocol query
+// parameter of the http transports. Clients that offer nothing, such as the
+// ot.js client, get Default.
+//
+// Operations, selections and other positions count text in the units of
+// ot.TextEncoding, which the server announces in doc. A client that counts in
+// other units cannot edit the document safely, so it can name its units in
+// the protocol, e.g. "ot.v1.json.utf16", and the server only accepts the
+// units it uses.
+package protocol
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/nitrous-io/ot.go/ot"
+)
+
+var (
+	ErrUnsupportedProtocol = errors.New("demo/protocol: no supported protocol offered")
+	ErrUnsupportedEncoding = errors.New("demo/protocol: unsupported encoding")
+)
+
+const (
+	// Version1 is the protocol of the original ot.js client
+	Version1 = 1
+)
+
+const (
+	EncodingJSON = "json"
+	// EncodingBinary is the compact encoding described in binary.go. Its
+	// messages must be sent as binary websocket messages.
+	EncodingBinary = "binary"
+)
+
+const (
+	UnitsUTF8  = "utf8"
+	UnitsUTF16 = "utf16"
+)
+
+// Units returns the name of the units of ot.TextEncoding.
+func Units() string {
+	if ot.TextEncoding == ot.TextEncodingTypeUTF16 {
+		return UnitsUTF16
+	}
+	return UnitsUTF8
+}
+
+// Protocol is a protocol version together with the encoding of its messages
+// and, if the client named them, the units it counts text in.
+type Protocol struct {
+	Version  int
+	Encoding string
+	Units    string
+}
+
+// Default is spoken with clients that do not negotiate.
+var Default = Protocol{Version: Version1, Encoding: EncodingJSON}
+
+// Supported lists the protocols the server speaks, most preferred first.
+// Each is spoken in the units of ot.TextEncoding only.
+var Supported = []Protocol{
+	{Version: Version1, Encoding: EncodingBinary},
+	{Version: Version1, Encoding: EncodingJSON},
+}
+
+// String returns the name of p as a websocket subprotocol, e.g. ot.v1.json
+// or ot.v1.json.utf16
+func (p Protocol) String() string {
+	name := "ot.v" + strconv.Itoa(p.Version) + "." + p.Encoding
+	if p.Units != "" {
+		name += "." + p.Units
+	}
+	return name
+}
+
+// Wire returns p without its units, which do not change how messages are
+// encoded.
+func (p Protocol) Wire() Protocol {
+	return Protocol{Version: p.Version, Encoding: p.Encoding}
+}
+
+// Binary reports whether p's messages are binary rather than text.
+func (p Protocol) Binary() bool {
+	return p.Encoding == EncodingBinary
+}
+
+// Parse parses the name of a protocol as returned by String.
+func Parse(name string) (Protocol, error) {
+	parts := strings.Split(name, ".")
+	if len(parts) < 3 || len(parts) > 4 || parts[0] != "ot" || !strings.HasPrefix(parts[1], "v") {
+		return Protocol{}, ErrUnsupportedProtocol
+	}
+	v, err := strconv.Atoi(parts[1][1:])
+	if err != nil || v < 1 {
+		return Protocol{}, ErrUnsupportedProtocol
+	}
+	p := Protocol{Version: v, Encoding: parts[2]}
+	if len(parts) == 4 {
+		if p.Units = parts[3]; p.Units != UnitsUTF8 && p.Units != UnitsUTF16 {
+			return Protocol{}, ErrUnsupportedProtocol
+		}
+	}
+	return p, nil
+}
+
+// Subprotocols returns the names of the supported protocols, first in the
+// units of ot.TextEncoding and then without units, for servers that do not
+// know them.
+func Subprotocols() []string {
+	var names []string
+	for _, p := range Supported {
+		p.Units = Units()
+		names = append(names, p.String())
+	}
+	for _, p := range Supported {
+		names = append(names, p.String())
+	}
+	return names
+}
+
+// Negotiate picks the server's most preferred protocol among the offered
+// ones, in the units of ot.TextEncoding or without units. The result keeps
+// the units of the offer, so its String is the name offered. An empty offer
+// gets Default.
+func Negotiate(offered []string) (Protocol, error) {
+	if len(offered) == 0 {
+		return Default, nil
+	}
+	for _, p := range Supported {
+		for _, name := range offered {
+			q, err := Parse(name)
+			if err == nil && q.Wire() == p && (q.Units == "" || q.Units == Units()) {
+				return q, nil
+			}
+		}
+	}
+	return Protocol{}, ErrUnsupportedProtocol
+}
+
+// Message is any message of the protocol. Name is the e of its envelope.
+type Message interface {
+	Name() string
+}
+
+type envelope struct {
+	Name string          `json:"e"`
+	Data json.RawMessage `json:"d,omitempty"`
+}
+
+// Encode encodes m in p's encoding.
+func Encode(p Protocol, m Message) ([]byte, error) {
+	switch p.Encoding {
+	case EncodingJSON:
+	case EncodingBinary:
+		return encodeBinary(m)
+	default:
+		return nil, ErrUnsupportedEncoding
+	}
+	e := struct {
+		Name string      `json:"e"`
+		Data interface{} `json:"d,omitempty"`
+	}{Name: m.Name()}
+	switch m.(type) {
+	case *OK, *Resync, *Format, *Run, *Stop:
+		// no data
+	default:
+		e.Data = m
+	}
+	return json.Marshal(e)
+}
+
+// DecodeClient decodes a message sent by a client. Errors are *DecodeError.
+func DecodeClient(p Protocol, data []byte) (Message, error) {
+	return decode(p, data, true, func(name string) Message {
+		switch name {
+		case "join":
+			return &Join{}
+		case "op":
+			return &Op{}
+		case "sel":
+			return &Sel{}
+		case "resync":
+			return &Resync{}
+		case "format":
+			return &Format{}
+		case "run":
+			return &Run{}
+		case "stop":
+			return &Stop{}
+		case "comment":
+			return &Comment{}
+		case "reply":
+			return &Reply{}
+		case "resolve":
+			return &Resolve{}
+		}
+		return nil
+	})
+}
+
+// DecodeServer decodes a message sent by the server. Errors are *DecodeError.
+func DecodeServer(p Protocol, data []byte) (Message, error) {
+	return decode(p, data, false, func(name string) Message {
+		switch name {
+		case "doc":
+			return &Doc{}
+		case "registered":
+			return &Registered{}
+		case "join":
+			return &Joined{}
+		case "quit":
+			return &Quit{}
+		case "ok":
+			return &OK{}
+		case "op":
+			return &RemoteOp{}
+		case "sel":
+			return &RemoteSel{}
+		case "resumed":
+			return &Resumed{}
+		case "shutdown":
+			return &Shutdown{}
+		case "error":
+			return &Error{}
+		case "transport":
+			return &Transport{}
+		case "format":
+			return &Formatted{}
+		case "diagnostics":
+			return &Diagnostics{}
+		case "run":
+			return &Running{}
+		case "output":
+			return &Output{}
+		case "exit":
+			return &Exit{}
+		case "annotation":
+			return &Annotated{}
+		case "annotations":
+			return &Annotations{}
+		}
+		return nil
+	})
+}
+
+// decode decodes data in p's encoding. Client messages are decoded strictly.
+func decode(p Protocol, data []byte, strict bool, message func(name string) Message) (Message, error) {
+	switch p.Encoding {
+	case EncodingJSON:
+	case EncodingBinary:
+		return decodeBinary(data, strict, message)
+	default:
+		return nil, ErrUnsupportedEncoding
+	}
+
+	var e envelope
+	if err := decodeStrict(data, &e); err != nil {
+		return nil, newDecodeError("", CodeMalformedEvent, err.Error())
+	}
+	if e.Name == "" {
+		return nil, newDecodeError("", CodeMalformedEvent, "e is required")
+	}
+	m := message(e.Name)
+	if m == nil {
+		return nil, newDecodeError(e.Name, CodeUnknownEvent, "unknown event")
+	}
+
+	var err error
+	code := CodeMalformedEvent
+	if d, ok := m.(decoder); ok {
+		err = d.decode(e.Data)
+		code = d.errorCode()
+	} else if !isNull(e.Data) {
+		err = json.Unmarshal(e.Data, m)
+	}
+	if derr, ok := err.(*DecodeError); ok {
+		derr.Event = e.Name
+		return nil, derr
+	}
+	if err != nil {
+		return nil, newDecodeError(e.Name, code, err.Error())
+	}
+	return m, nil
+}
+
+// decoder is implemented by client messages, which are decoded strictly
+type decoder interface {
+	decode(data json.RawMessage) error
+	// errorCode is reported for data that cannot be decoded
+	errorCode() string
+}
+
+// decodeStrict decodes a single json value into v, rejecting unknown object
+// fields and trailing data
+func decodeStrict(data []byte, v interface{}) error {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(v); err != nil {
+		return err
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return errors.New("unexpected data after json value")
+	}
+	return nil
+}
+
+// isNull reports whether data is missing or the json null
+func isNull(data json.RawMessage) bool {
+	return len(data) == 0 || string(bytes.TrimSpace(data)) == "null"
+}
+
+// codes of decoding errors
+const (
+	CodeMalformedEvent     = "malformed_event"
+	CodeUnknownEvent       = "unknown_event"
+	CodeMalformedJoin      = "malformed_join"
+	CodeMalformedOp        = "malformed_op"
+	CodeMalformedSelection = "malformed_selection"
+	CodeInvalidRevision    = "invalid_revision"
+	CodeMalformedComment   = "malformed_comment"
+)
+
+// DecodeError describes a message that could not be decoded.
+type DecodeError struct {
+	Event   string // name of the message, if it could be read
+	Code    string
+	Message string
+}
+
+func (e *DecodeError) Error() string {
+	return "demo/protocol: " + e.Code + ": " + e.Message
+}
+
+func newDecodeError(event, code, message string) *DecodeError {
+	return &DecodeError{Event: event, Code: code, Message: message}
+}
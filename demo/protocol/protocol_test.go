@@ -0,0 +1,370 @@
+package protocol_test
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/nitrous-io/ot.go/demo/protocol"
+	"github.com/nitrous-io/ot.go/ot"
+	"github.com/nitrous-io/ot.go/ot/operation"
+	"github.com/nitrous-io/ot.go/ot/selection"
+	"github.com/nitrous-io/ot.go/ot/session"
+)
+
+func TestParse(t *testing.T) {
+	p, err := protocol.Parse("ot.v1.json")
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if actual, expected := p, (protocol.Protocol{Version: protocol.Version1, Encoding: protocol.EncodingJSON}); actual != expected {
+		t.Errorf("expected %+v, got %+v", expected, actual)
+	}
+	if actual, expected := p.String(), "ot.v1.json"; actual != expected {
+		t.Errorf("expected %s, got %s", expected, actual)
+	}
+
+	p, err = protocol.Parse("ot.v1.binary.utf16")
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if actual, expected := p, (protocol.Protocol{Version: protocol.Version1, Encoding: protocol.EncodingBinary, Units: protocol.UnitsUTF16}); actual != expected {
+		t.Errorf("expected %+v, got %+v", expected, actual)
+	}
+	if actual, expected := p.String(), "ot.v1.binary.utf16"; actual != expected {
+		t.Errorf("expected %s, got %s", expected, actual)
+	}
+
+	for _, name := range []string{"", "ot", "ot.1.json", "ot.v0.json", "ot.vx.json", "xx.v1.json", "ot.v1.json.gz", "ot.v1.json.utf8.gz"} {
+		if _, err := protocol.Parse(name); err != protocol.ErrUnsupportedProtocol {
+			t.Errorf("expected ErrUnsupportedProtocol for %q, got %v", name, err)
+		}
+	}
+}
+
+func TestNegotiate(t *testing.T) {
+	defer func() {
+		ot.TextEncoding = ot.TextEncodingTypeUTF8
+	}()
+
+	for _, tc := range []struct {
+		encoding int
+		offered  []string
+		expected protocol.Protocol
+		err      error
+	}{
+		{ot.TextEncodingTypeUTF8, nil, protocol.Default, nil},
+		{ot.TextEncodingTypeUTF8, []string{"ot.v1.json"}, protocol.Protocol{Version: 1, Encoding: "json"}, nil},
+		{ot.TextEncodingTypeUTF8, []string{"ot.v9.json", "chat", "ot.v1.json"}, protocol.Protocol{Version: 1, Encoding: "json"}, nil},
+		{ot.TextEncodingTypeUTF8, []string{"ot.v9.json"}, protocol.Protocol{}, protocol.ErrUnsupportedProtocol},
+		// the units offered must be the server's
+		{ot.TextEncodingTypeUTF8, []string{"ot.v1.json.utf8"}, protocol.Protocol{Version: 1, Encoding: "json", Units: "utf8"}, nil},
+		{ot.TextEncodingTypeUTF8, []string{"ot.v1.json.utf16"}, protocol.Protocol{}, protocol.ErrUnsupportedProtocol},
+		{ot.TextEncodingTypeUTF16, []string{"ot.v1.json.utf8", "ot.v1.json.utf16"}, protocol.Protocol{Version: 1, Encoding: "json", Units: "utf16"}, nil},
+		{ot.TextEncodingTypeUTF16, []string{"ot.v1.binary.utf8", "ot.v1.json"}, protocol.Protocol{Version: 1, Encoding: "json"}, nil},
+		// the go client, counting in utf-8, falls back to a name without
+		// units and learns the server's from doc
+		{ot.TextEncodingTypeUTF8, protocol.Subprotocols(), protocol.Protocol{Version: 1, Encoding: "binary", Units: "utf8"}, nil},
+		{ot.TextEncodingTypeUTF16, protocol.Subprotocols(), protocol.Protocol{Version: 1, Encoding: "binary"}, nil},
+	} {
+		ot.TextEncoding = tc.encoding
+		p, err := protocol.Negotiate(tc.offered)
+		if err != tc.err {
+			t.Errorf("expected error %v for %v, got %v", tc.err, tc.offered, err)
+		}
+		if actual, expected := p, tc.expected; actual != expected {
+			t.Errorf("expected %+v for %v, got %+v", expected, tc.offered, actual)
+		}
+	}
+}
+
+func TestDecodeClient(t *testing.T) {
+	sel := &selection.Selection{Ranges: []selection.Range{{Anchor: 1, Head: 3}}}
+
+	for _, tc := range []struct {
+		msg      string
+		expected protocol.Message
+	}{
+		{`{"e": "join", "d": {"username": "alice"}}`, &protocol.Join{Username: "alice"}},
+		{`{"e": "op", "d": [2, [-1, "H", 4]]}`, &protocol.Op{Revision: 2, Operation: operation.New().Delete(1).Insert("H").Retain(4)}},
+		{`{"e": "op", "d": [2, [5, "!"], null]}`, &protocol.Op{Revision: 2, Operation: operation.New().Retain(5).Insert("!")}},
+		{`{"e": "op", "d": [2, [5], {"ranges": [{"anchor": 1, "head": 3}]}]}`, &protocol.Op{Revision: 2, Operation: operation.New().Retain(5), Selection: sel}},
+		{`{"e": "sel", "d": {"ranges": [{"anchor": 1, "head": 3}]}}`, &protocol.Sel{Selection: sel}},
+		{`{"e": "sel", "d": {"ranges": [{"anchor": -1, "head": 3}]}}`, &protocol.Sel{Selection: &selection.Selection{Ranges: []selection.Range{{Anchor: -1, Head: 3}}}}},
+		{`{"e": "sel", "d": null}`, &protocol.Sel{}},
+		{`{"e": "sel"}`, &protocol.Sel{}},
+		{`{"e": "resync"}`, &protocol.Resync{}},
+		{`{"e": "format"}`, &protocol.Format{}},
+		{`{"e": "run"}`, &protocol.Run{}},
+		{`{"e": "stop"}`, &protocol.Stop{}},
+		{`{"e": "comment", "d": {"revision": 2, "from": 1, "to": 3, "text": "why?"}}`, &protocol.Comment{Revision: 2, From: 1, To: 3, Text: "why?"}},
+		{`{"e": "reply", "d": {"id": "1", "text": "because"}}`, &protocol.Reply{ID: "1", Text: "because"}},
+		{`{"e": "resolve", "d": "1"}`, &protocol.Resolve{ID: "1"}},
+	} {
+		m, err := protocol.DecodeClient(protocol.Default, []byte(tc.msg))
+		if err != nil {
+			t.Errorf("expected no error decoding %s, got %v", tc.msg, err)
+			continue
+		}
+		if actual, expected := m, tc.expected; !reflect.DeepEqual(actual, expected) {
+			t.Errorf("expected %+v for %s, got %+v", expected, tc.msg, actual)
+		}
+	}
+}
+
+func TestDecodeClientErrors(t *testing.T) {
+	for _, tc := range []struct {
+		msg   string
+		code  string
+		event string
+	}{
+		{`not json`, protocol.CodeMalformedEvent, ""},
+		{`{"e": ""}`, protocol.CodeMalformedEvent, ""},
+		{`{"e": "join", "d": {"username": "a"}, "x": 1}`, protocol.CodeMalformedEvent, ""},
+		{`{"e": "join", "d": {"username": "a"}} []`, protocol.CodeMalformedEvent, ""},
+		{`{"e": "doc", "d": {}}`, protocol.CodeUnknownEvent, "doc"},
+		{`{"e": "join", "d": {"username": "a", "admin": true}}`, protocol.CodeMalformedJoin, "join"},
+		{`{"e": "join", "d": {}}`, protocol.CodeMalformedJoin, "join"},
+		{`{"e": "op", "d": [1]}`, protocol.CodeMalformedOp, "op"},
+		{`{"e": "op", "d": [1, [5], null, null]}`, protocol.CodeMalformedOp, "op"},
+		{`{"e": "op", "d": [1.5, [5]]}`, protocol.CodeInvalidRevision, "op"},
+		{`{"e": "op", "d": [1, {}]}`, protocol.CodeMalformedOp, "op"},
+		{`{"e": "op", "d": [1, [0]]}`, protocol.CodeMalformedOp, "op"},
+		{`{"e": "op", "d": [1, [""]]}`, protocol.CodeMalformedOp, "op"},
+		{`{"e": "op", "d": [1, [null]]}`, protocol.CodeMalformedOp, "op"},
+		{`{"e": "op", "d": [1, [5], {}]}`, protocol.CodeMalformedSelection, "op"},
+		{`{"e": "sel", "d": {"ranges": [{"anchor": 1, "head": 2, "x": 3}]}}`, protocol.CodeMalformedSelection, "sel"},
+		{`{"e": "sel", "d": {"ranges": [{"head": 2}]}}`, protocol.CodeMalformedSelection, "sel"},
+		{`{"e": "resync", "d": {}}`, protocol.CodeMalformedEvent, "resync"},
+		{`{"e": "format", "d": 1}`, protocol.CodeMalformedEvent, "format"},
+		{`{"e": "comment", "d": {"revision": 2, "from": 1, "to": 3}}`, protocol.CodeMalformedComment, "comment"},
+		{`{"e": "comment", "d": {"revision": 2, "from": 3, "to": 1, "text": "why?"}}`, protocol.CodeMalformedComment, "comment"},
+		{`{"e": "comment", "d": {"revision": 2, "from": 1, "to": 3, "text": " "}}`, protocol.CodeMalformedComment, "comment"},
+		{`{"e": "reply", "d": {"text": "because"}}`, protocol.CodeMalformedComment, "reply"},
+		{`{"e": "resolve", "d": ""}`, protocol.CodeMalformedEvent, "resolve"},
+	} {
+		_, err := protocol.DecodeClient(protocol.Default, []byte(tc.msg))
+		derr, ok := err.(*protocol.DecodeError)
+		if !ok {
+			t.Errorf("expected a DecodeError for %s, got %v", tc.msg, err)
+			continue
+		}
+		if actual, expected := derr.Code, tc.code; actual != expected {
+			t.Errorf("expected code %s for %s, got %s", expected, tc.msg, actual)
+		}
+		if actual, expected := derr.Event, tc.event; actual != expected {
+			t.Errorf("expected event %q for %s, got %q", expected, tc.msg, actual)
+		}
+	}
+}
+
+// the ot.js client depends on the exact shape of the server's messages
+func TestEncodeServer(t *testing.T) {
+	sel := &selection.Selection{Ranges: []selection.Range{{Anchor: 1, Head: 3}}}
+
+	for _, tc := range []struct {
+		msg      protocol.Message
+		expected string
+	}{
+		{&protocol.Registered{ClientID: "1"}, `{"e":"registered","d":"1"}`},
+		{&protocol.Quit{ClientID: "1"}, `{"e":"quit","d":"1"}`},
+		{&protocol.OK{}, `{"e":"ok"}`},
+		{&protocol.Joined{ClientID: "1", Username: "alice"}, `{"e":"join","d":{"client_id":"1","username":"alice"}}`},
+		{&protocol.RemoteOp{ClientID: "1", Operation: operation.New().Retain(5).Insert("!")}, `{"e":"op","d":["1",[5,"!"]]}`},
+		{&protocol.RemoteOp{ClientID: "1", Operation: operation.New().Retain(5), Selection: sel}, `{"e":"op","d":["1",[5],{"ranges":[{"anchor":1,"head":3}]}]}`},
+		{&protocol.RemoteSel{ClientID: "1", Selection: sel}, `{"e":"sel","d":["1",{"ranges":[{"anchor":1,"head":3}]}]}`},
+		{&protocol.RemoteSel{ClientID: "1"}, `{"e":"sel","d":["1",null]}`},
+		{&protocol.Shutdown{RetryAfter: 500}, `{"e":"shutdown","d":{"retry_after":500}}`},
+		{&protocol.Error{Code: "forbidden", Message: "no"}, `{"e":"error","d":{"code":"forbidden","message":"no"}}`},
+		{&protocol.Formatted{Errors: []protocol.SyntaxError{}}, `{"e":"format","d":{"errors":[]}}`},
+		{&protocol.Diagnostics{Diagnostics: []protocol.Diagnostic{{From: 10, To: 13, Severity: "error", Message: "undefined: y"}}}, `{"e":"diagnostics","d":[{"from":10,"to":13,"severity":"error","message":"undefined: y"}]}`},
+		{&protocol.Diagnostics{Diagnostics: []protocol.Diagnostic{}}, `{"e":"diagnostics","d":[]}`},
+		{&protocol.Running{ClientID: "1", Username: "alice"}, `{"e":"run","d":{"client_id":"1","username":"alice"}}`},
+		{&protocol.Output{Stream: "stdout", Data: "hello\n"}, `{"e":"output","d":{"stream":"stdout","data":"hello\n"}}`},
+		{&protocol.Exit{Status: -1, Error: "timed out"}, `{"e":"exit","d":{"status":-1,"error":"timed out"}}`},
+		{&protocol.Annotated{Annotation: session.Annotation{ID: "1", From: 1, To: 3, Resolved: true, Comments: []session.Comment{{Author: "alice", Text: "why?"}}}}, `{"e":"annotation","d":{"id":"1","from":1,"to":3,"resolved":true,"comments":[{"author":"alice","text":"why?"}]}}`},
+		{&protocol.Annotations{Annotations: []session.Annotation{}}, `{"e":"annotations","d":[]}`},
+		{&protocol.Formatted{Errors: []protocol.SyntaxError{{Offset: 9, Line: 2, Column: 1, Message: "expected 'IDENT', found 'EOF'"}}}, `{"e":"format","d":{"errors":[{"offset":9,"line":2,"column":1,"message":"expected 'IDENT', found 'EOF'"}]}}`},
+	} {
+		j, err := protocol.Encode(protocol.Default, tc.msg)
+		if err != nil {
+			t.Errorf("expected no error encoding %+v, got %v", tc.msg, err)
+			continue
+		}
+		if actual, expected := string(j), tc.expected; actual != expected {
+			t.Errorf("expected %s, got %s", expected, actual)
+		}
+
+		// and clients decode them back
+		m, err := protocol.DecodeServer(protocol.Default, j)
+		if err != nil {
+			t.Errorf("expected no error decoding %s, got %v", j, err)
+			continue
+		}
+		if actual, expected := m, tc.msg; !reflect.DeepEqual(actual, expected) {
+			t.Errorf("expected %+v decoding %s, got %+v", expected, j, actual)
+		}
+	}
+}
+
+var binary = protocol.Protocol{Version: protocol.Version1, Encoding: protocol.EncodingBinary}
+
+func TestBinaryRoundTrip(t *testing.T) {
+	sel := &selection.Selection{Ranges: []selection.Range{{Anchor: 1, Head: 3}, {Anchor: 300, Head: 70000}}}
+	clients := map[string]*session.Client{
+		"1": {Name: "alice", Selection: *sel},
+		"2": {Name: "bob", Selection: selection.Selection{Ranges: []selection.Range{}}},
+	}
+	annotation := session.Annotation{ID: "1", From: 1, To: 3, Resolved: true, Comments: []session.Comment{
+		{Author: "alice", Text: "why?"},
+		{Author: "bob", Text: "because"},
+	}}
+
+	for _, tc := range []struct {
+		msg    protocol.Message
+		client bool
+	}{
+		{&protocol.Join{Username: "alice"}, true},
+		{&protocol.Op{Revision: 300, Operation: operation.New().Retain(5).Insert("wörld").Delete(200), Selection: sel}, true},
+		{&protocol.Op{Revision: 0, Operation: operation.New().Insert("!")}, true},
+		{&protocol.Sel{Selection: sel}, true},
+		{&protocol.Sel{}, true},
+		{&protocol.Resync{}, true},
+		{&protocol.Format{}, true},
+		{&protocol.Run{}, true},
+		{&protocol.Stop{}, true},
+		{&protocol.Comment{Revision: 2, From: 1, To: 3, Text: "why?"}, true},
+		{&protocol.Reply{ID: "1", Text: "because"}, true},
+		{&protocol.Resolve{ID: "1"}, true},
+		{&protocol.Doc{Document: "hello", Revision: 3, Clients: clients, ClientID: "3", ResumeToken: "abc", Role: "editor", Units: "utf16"}, false},
+		{&protocol.Registered{ClientID: "1"}, false},
+		{&protocol.Quit{ClientID: "1"}, false},
+		{&protocol.OK{}, false},
+		{&protocol.Joined{ClientID: "1", Username: "alice"}, false},
+		{&protocol.RemoteOp{ClientID: "1", Operation: operation.New().Delete(1).Insert("H").Retain(4), Selection: sel}, false},
+		{&protocol.RemoteOp{Operation: operation.New().Retain(5)}, false},
+		{&protocol.RemoteSel{ClientID: "1", Selection: sel}, false},
+		{&protocol.RemoteSel{ClientID: "1"}, false},
+		{&protocol.Resumed{ClientID: "1", Revision: 4, Clients: clients}, false},
+		{&protocol.Shutdown{RetryAfter: 5000}, false},
+		{&protocol.Error{Code: "forbidden", Message: "viewer may not edit the document", Event: "op"}, false},
+		{&protocol.Transport{ID: "abc"}, false},
+		{&protocol.Formatted{Errors: []protocol.SyntaxError{}}, false},
+		{&protocol.Running{ClientID: "1", Username: "alice"}, false},
+		{&protocol.Output{Stream: "stderr", Data: "panic: oops\n"}, false},
+		{&protocol.Exit{Status: 2}, false},
+		{&protocol.Exit{Status: -1, Error: "timed out"}, false},
+		{&protocol.Diagnostics{Diagnostics: []protocol.Diagnostic{{From: 10, To: 13, Severity: "error", Message: "undefined: y"}}}, false},
+		{&protocol.Formatted{Errors: []protocol.SyntaxError{{Offset: 9, Line: 2, Column: 1, Message: "expected 'IDENT', found 'EOF'"}}}, false},
+		{&protocol.Annotated{Annotation: annotation}, false},
+		{&protocol.Annotations{Annotations: []session.Annotation{annotation, {ID: "2", From: 0, To: 0, Orphaned: true, Comments: []session.Comment{}}}}, false},
+	} {
+		b, err := protocol.Encode(binary, tc.msg)
+		if err != nil {
+			t.Errorf("expected no error encoding %+v, got %v", tc.msg, err)
+			continue
+		}
+		decode := protocol.DecodeServer
+		if tc.client {
+			decode = protocol.DecodeClient
+		}
+		m, err := decode(binary, b)
+		if err != nil {
+			t.Errorf("expected no error decoding %+v, got %v", tc.msg, err)
+			continue
+		}
+		if actual, expected := m, tc.msg; !reflect.DeepEqual(actual, expected) {
+			t.Errorf("expected %+v, got %+v", expected, actual)
+		}
+
+		// binary messages are smaller than json ones
+		j, _ := protocol.Encode(protocol.Default, tc.msg)
+		if len(b) >= len(j) {
+			t.Errorf("expected %+v to be smaller than %d bytes in binary, got %d", tc.msg, len(j), len(b))
+		}
+	}
+}
+
+func TestDecodeBinaryErrors(t *testing.T) {
+	for _, tc := range []struct {
+		msg   []byte
+		code  string
+		event string
+	}{
+		{[]byte{}, protocol.CodeMalformedEvent, ""},
+		{[]byte{0}, protocol.CodeUnknownEvent, ""},
+		{[]byte{200}, protocol.CodeUnknownEvent, ""},
+		{[]byte{5}, protocol.CodeUnknownEvent, "doc"},
+		// join: empty, truncated, invalid utf-8, trailing data
+		{[]byte{1, 0}, protocol.CodeMalformedJoin, "join"},
+		{[]byte{1, 5, 'a'}, protocol.CodeMalformedJoin, "join"},
+		{[]byte{1, 1, 0xff}, protocol.CodeMalformedJoin, "join"},
+		{[]byte{1, 1, 'a', 0}, protocol.CodeMalformedEvent, "join"},
+		// op: revision 0, one component, then something broken
+		{[]byte{2, 0, 1, 0, 0, 0}, protocol.CodeMalformedOp, "op"},
+		{[]byte{2, 0, 5}, protocol.CodeMalformedOp, "op"},
+		{[]byte{2, 0, 1, 10}, protocol.CodeMalformedOp, "op"},
+		{[]byte{2, 0, 1, 10, 2, 1}, protocol.CodeMalformedSelection, "op"},
+		{[]byte{3, 100, 1, 2}, protocol.CodeMalformedSelection, "sel"},
+		{[]byte{4, 0}, protocol.CodeMalformedEvent, "resync"},
+	} {
+		_, err := protocol.DecodeClient(binary, tc.msg)
+		derr, ok := err.(*protocol.DecodeError)
+		if !ok {
+			t.Errorf("expected a DecodeError for %v, got %v", tc.msg, err)
+			continue
+		}
+		if actual, expected := derr.Code, tc.code; actual != expected {
+			t.Errorf("expected code %s for %v, got %s", expected, tc.msg, actual)
+		}
+		if actual, expected := derr.Event, tc.event; actual != expected {
+			t.Errorf("expected event %q for %v, got %q", expected, tc.msg, actual)
+		}
+	}
+
+	// clients ignore fields added to server messages later
+	m, err := protocol.DecodeServer(binary, []byte{7, 1, 'a', 42})
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if actual, expected := m, (&protocol.Quit{ClientID: "a"}); !reflect.DeepEqual(actual, expected) {
+		t.Errorf("expected %+v, got %+v", expected, actual)
+	}
+
+	// and the units are missing from the docs of older servers
+	doc := &protocol.Doc{Document: "hello", Revision: 3, Clients: map[string]*session.Client{}, Role: "editor"}
+	b, _ := protocol.Encode(binary, doc)
+	m, err = protocol.DecodeServer(binary, b[:len(b)-1])
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if actual, expected := m, doc; !reflect.DeepEqual(actual, expected) {
+		t.Errorf("expected %+v, got %+v", expected, actual)
+	}
+}
+
+func TestDecodeServerIsLenient(t *testing.T) {
+	m, err := protocol.DecodeServer(protocol.Default, []byte(`{"e": "doc", "d": {"document": "hello", "revision": 3, "clients": {"2": {"name": "bob", "selection": {"ranges": []}}}, "added_later": true}}`))
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	expected := &protocol.Doc{
+		Document: "hello",
+		Revision: 3,
+		Clients: map[string]*session.Client{
+			"2": {Name: "bob", Selection: selection.Selection{Ranges: []selection.Range{}}},
+		},
+	}
+	if actual := m; !reflect.DeepEqual(actual, expected) {
+		t.Errorf("expected %+v, got %+v", expected, actual)
+	}
+}
+
+func TestUnsupportedEncoding(t *testing.T) {
+	p := protocol.Protocol{Version: protocol.Version1, Encoding: "xml"}
+	if _, err := protocol.Encode(p, &protocol.OK{}); err != protocol.ErrUnsupportedEncoding {
+		t.Errorf("expected ErrUnsupportedEncoding, got %v", err)
+	}
+	if _, err := protocol.DecodeClient(p, []byte(`{"e": "resync"}`)); err != protocol.ErrUnsupportedEncoding {
+		t.Errorf("expected ErrUnsupportedEncoding, got %v", err)
+	}
+}
@@ -20,11 +20,71 @@
     App.conn.send('join', { username: $username.val() });
   });
 
-  var url = [location.protocol.replace('http', 'ws'), '//', location.host, '/ws'].join('');
-  var conn = App.conn = new SocketConnection(url);
+  $('#format-btn').click(function (evt) {
+    evt.preventDefault();
+    $('#format-status').text('Formatting...');
+    App.conn.send('format');
+  });
+
+  $('#comment-btn').click(function (evt) {
+    evt.preventDefault();
+    var text = prompt('Comment');
+    if (!text) {
+      return;
+    }
+    var from = App.cm.indexFromPos(App.cm.getCursor('from'));
+    var to = App.cm.indexFromPos(App.cm.getCursor('to'));
+    App.conn.send('comment', { revision: App.client.revision, from: from, to: to, text: text });
+  });
+
+  $('#annotations').on('click', '.reply-btn', function (evt) {
+    evt.preventDefault();
+    var text = prompt('Reply');
+    if (text) {
+      App.conn.send('reply', { id: $(this).closest('li').data('id'), text: text });
+    }
+  });
+
+  $('#annotations').on('click', '.resolve-btn', function (evt) {
+    evt.preventDefault();
+    App.conn.send('resolve', $(this).closest('li').data('id'));
+  });
+
+  $('#run-btn').click(function (evt) {
+    evt.preventDefault();
+    App.conn.send('run');
+  });
+
+  $('#stop-btn').click(function (evt) {
+    evt.preventDefault();
+    App.conn.send('stop');
+  });
+
+  // each document lives at /#<doc id>; the bare page edits the default document
+  var docId = location.hash.replace(/^#/, '');
+  // ?transport=sse uses server-sent events where websockets are blocked
+  var sse = /[?&]transport=sse/.test(location.search);
+  var url = sse ? ['/sse', docId ? '/' + encodeURIComponent(docId) : ''].join('') :
+    [location.protocol.replace('http', 'ws'), '//', location.host, '/ws', docId ? '/' + encodeURIComponent(docId) : ''].join('');
+  // an access token in the page url is handed on to the server
+  var accessToken = (location.search.match(/[?&]access_token=([^&#]*)/) || [])[1];
+  // ?spectate=1 watches the document without joining
+  var spectate = /[?&]spectate=/.test(location.search);
+  var params = [];
+  if (accessToken) {
+    params.push('access_token=' + accessToken);
+  }
+  if (spectate) {
+    params.push('spectate=1');
+    $('#join-form').hide();
+  }
+  if (params.length) {
+    url += '?' + params.join('&');
+  }
+  var conn = App.conn = sse ? new EventSourceConnection(url) : new SocketConnection(url);
 
   conn.on('open', function () {
-    $('#conn-status').text('Connected');
+    $('#conn-status').text(spectate ? 'Watching' : 'Connected');
     $('#join-btn').attr({ disabled: false});
   });
 
@@ -33,6 +93,8 @@
   });
 
   conn.on('doc', function(data) {
+    App.role = data.role;
+    setAnnotations([]);
     App.cm.setValue(data.document);
     var serverAdapter = new ot.SocketConnectionAdapter(conn);
     var editorAdapter = new ot.CodeMirrorAdapter(App.cm);
@@ -40,7 +102,17 @@
   });
 
   conn.on('registered', function(clientId) {
-    App.cm.setOption('readOnly', false);
+    if (App.role !== 'viewer') {
+      $('#comment-btn').attr({disabled: false});
+      App.canComment = true;
+      renderAnnotations();
+    }
+    if (App.role === 'editor' || App.role === 'owner') {
+      App.cm.setOption('readOnly', false);
+      $('#format-btn').attr({disabled: false});
+      $('#run-btn').attr({disabled: false});
+      App.canRun = true;
+    }
   });
 
   conn.on('join', function(data) {
@@ -50,4 +122,131 @@
   conn.on('quit', function(data) {
     console.log(data);
   });
+
+  // the answer to a format event; the formatted document arrives as an op
+  conn.on('format', function(data) {
+    $('#format-status').text(data.errors.map(function (err) {
+      return err.line + ':' + err.column + ': ' + err.message;
+    }).join('; '));
+  });
+
+  // problems found in the code; codemirror moves the marks along with edits
+  // until the next check replaces them
+  var diagnosticMarks = [];
+  conn.on('diagnostics', function(diagnostics) {
+    diagnosticMarks.forEach(function (mark) {
+      mark.clear();
+    });
+    diagnosticMarks = diagnostics.map(function (d) {
+      return App.cm.markText(App.cm.posFromIndex(d.from), App.cm.posFromIndex(d.to), {
+        className: 'diagnostic-' + d.severity,
+        title: d.message
+      });
+    });
+  });
+
+  // someone started the document; everyone sees its output
+  conn.on('run', function(data) {
+    $('#output').empty();
+    $('#run-status').text('Running (started by ' + (data.username || data.client_id) + ')');
+    $('#run-btn').attr({disabled: true});
+    $('#stop-btn').attr({disabled: !App.canRun});
+  });
+
+  conn.on('output', function(data) {
+    $('<span>').addClass(data.stream).text(data.data).appendTo('#output');
+  });
+
+  conn.on('exit', function(data) {
+    $('#run-status').text(data.error ? 'Stopped: ' + data.error : 'Exited with status ' + data.status);
+    $('#run-btn').attr({disabled: !App.canRun});
+    $('#stop-btn').attr({disabled: true});
+  });
+
+  // comment threads; codemirror moves their marks along with edits, and clears
+  // them once their text is deleted
+  var annotations = {};
+  var annotationMarks = {};
+  function setAnnotation(a) {
+    if (annotationMarks[a.id]) {
+      annotationMarks[a.id].clear();
+      delete annotationMarks[a.id];
+    }
+    annotations[a.id] = a;
+    if (!a.resolved && !a.orphaned && a.from < a.to) {
+      annotationMarks[a.id] = App.cm.markText(App.cm.posFromIndex(a.from), App.cm.posFromIndex(a.to), {
+        className: 'annotation',
+        title: a.comments[0].text
+      });
+    }
+  }
+
+  function setAnnotations(list) {
+    Object.keys(annotationMarks).forEach(function (id) {
+      annotationMarks[id].clear();
+    });
+    annotations = {};
+    annotationMarks = {};
+    list.forEach(setAnnotation);
+    renderAnnotations();
+  }
+
+  function renderAnnotations() {
+    var $list = $('#annotations').empty();
+    Object.keys(annotations).map(function (id) {
+      return annotations[id];
+    }).sort(function (a, b) {
+      return a.from - b.from || a.to - b.to;
+    }).forEach(function (a) {
+      var $li = $('<li>').data('id', a.id).toggleClass('resolved', !!a.resolved).toggleClass('orphaned', !!a.orphaned);
+      if (a.resolved) {
+        $li.append('(resolved) ');
+      } else if (a.orphaned) {
+        $li.append('(text deleted) ');
+      }
+      a.comments.forEach(function (c) {
+        $('<div>').text(c.author + ': ' + c.text).appendTo($li);
+      });
+      if (App.canComment) {
+        $('<button class="reply-btn">Reply</button>').appendTo($li);
+        if (!a.resolved) {
+          $('<button class="resolve-btn">Resolve</button>').appendTo($li);
+        }
+      }
+      $li.appendTo($list);
+    });
+  }
+
+  conn.on('annotations', setAnnotations);
+
+  conn.on('annotation', function(a) {
+    setAnnotation(a);
+    renderAnnotations();
+  });
+
+  conn.on('shutdown', function(data) {
+    // the server is restarting; come back once it should be up again
+    $('#conn-status').text('Server restarting');
+    App.cm.setOption('readOnly', 'nocursor');
+    setTimeout(function () {
+      location.reload();
+    }, data.retry_after);
+  });
+
+  conn.on('error', function(err) {
+    console.error('server error', err.code, err.message);
+    if (err.event === 'format') {
+      $('#format-status').text(err.message);
+    }
+    if (err.event === 'comment' || err.event === 'reply' || err.event === 'resolve') {
+      alert(err.message);
+    }
+    if (err.event === 'run' || err.event === 'stop') {
+      $('#run-status').text(err.message);
+    }
+    if (err.event === 'op') {
+      // the edit was rejected; start over from the server's document
+      conn.send('resync');
+    }
+  });
 }());
@@ -0,0 +1,63 @@
+(function () {
+  'use strict';
+
+  // EventSourceConnection receives events as server-sent events and POSTs
+  // the client's events, for networks where websockets do not work. It
+  // emits the same events as SocketConnection.
+  function EventSourceConnection (url) {
+    this.url = url;
+    this.id = null;
+    this.pending = [];
+    this.sending = false;
+
+    var es = this.es = new EventSource(this.url);
+    var self = this;
+
+    es.onerror = function (evt) {
+      // the server closes the stream for good, EventSource would retry
+      es.close();
+      self.emit('close', evt);
+    };
+
+    es.onmessage = function (evt) {
+      var m = JSON.parse(evt.data);
+      if (!m || !m.e) {
+        return;
+      }
+      if (m.e === 'transport') {
+        self.id = m.d.id;
+        self.emit('open', evt);
+        self.flush();
+        return;
+      }
+      self.emit(m.e, m.d, evt);
+    };
+  }
+
+  EventSourceConnection.prototype = new EventEmitter;
+
+  EventSourceConnection.prototype.send = function(eventName, data) {
+    this.pending.push(JSON.stringify({e: eventName, d: data}));
+    this.flush();
+  };
+
+  // flush posts one event at a time so that they arrive in order
+  EventSourceConnection.prototype.flush = function () {
+    if (this.sending || !this.id || !this.pending.length) {
+      return;
+    }
+    var self = this;
+    this.sending = true;
+    $.ajax({
+      url: '/conn/' + this.id,
+      type: 'POST',
+      contentType: 'application/json',
+      data: this.pending.shift()
+    }).always(function () {
+      self.sending = false;
+      self.flush();
+    });
+  };
+
+  window.EventSourceConnection = EventSourceConnection;
+}());
@@ -24,7 +24,10 @@
           operation = data[1],
           selection = data[2];
       self.trigger('operation', operation);
-      self.trigger('selection', clientId, selection);
+      // edits made through the http api have no client
+      if (clientId) {
+        self.trigger('selection', clientId, selection);
+      }
     });
 
     conn.on('sel', function (data) {
@@ -0,0 +1,471 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/nitrous-io/ot.go/ot/session"
+)
+
+var (
+	ErrTooManyDocuments = errors.New("demo: too many open documents")
+	ErrInvalidDocID     = errors.New("demo: invalid document id")
+	ErrShuttingDown     = errors.New("demo: server shutting down")
+)
+
+// DocumentSource provides the initial content of a document when its session
+// is created.
+type DocumentSource interface {
+	Load(docID string) (string, error)
+}
+
+// DocumentSink stores the content of a document when its session is closed.
+type DocumentSink interface {
+	Save(docID, document string) error
+}
+
+// AnnotationSource can be implemented by a DocumentSource to provide the
+// annotations of documents too.
+type AnnotationSource interface {
+	LoadAnnotations(docID string) ([]session.Annotation, error)
+}
+
+// AnnotationSink can be implemented by a DocumentSink to store the
+// annotations of documents too.
+type AnnotationSink interface {
+	SaveAnnotations(docID string, annotations []session.Annotation) error
+}
+
+type DocumentSourceFunc func(docID string) (string, error)
+
+func (f DocumentSourceFunc) Load(docID string) (string, error) {
+	return f(docID)
+}
+
+// StaticSource starts every document with the same content.
+type StaticSource string
+
+func (s StaticSource) Load(docID string) (string, error) {
+	return string(s), nil
+}
+
+// DirSource loads each document from the file named after it in a directory,
+// and saves it back there. Documents without a file start out empty. The
+// annotations of a document are kept as json in a hidden file next to it.
+type DirSource string
+
+func (d DirSource) path(docID string) (string, error) {
+	if docID == "" || filepath.Base(docID) != docID || docID[0] == '.' {
+		return "", ErrInvalidDocID
+	}
+	return filepath.Join(string(d), docID), nil
+}
+
+func (d DirSource) Load(docID string) (string, error) {
+	path, err := d.path(docID)
+	if err != nil {
+		return "", err
+	}
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+func (d DirSource) Save(docID, document string) error {
+	path, err := d.path(docID)
+	if err != nil {
+		return err
+	}
+	return writeFile(path, []byte(document))
+}
+
+// annotationsPath cannot be the path of a document, whose ids never start
+// with a dot
+func (d DirSource) annotationsPath(docID string) (string, error) {
+	if _, err := d.path(docID); err != nil {
+		return "", err
+	}
+	return filepath.Join(string(d), "."+docID+".annotations"), nil
+}
+
+func (d DirSource) LoadAnnotations(docID string) ([]session.Annotation, error) {
+	path, err := d.annotationsPath(docID)
+	if err != nil {
+		return nil, err
+	}
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var annotations []session.Annotation
+	if err = json.Unmarshal(b, &annotations); err != nil {
+		return nil, err
+	}
+	return annotations, nil
+}
+
+func (d DirSource) SaveAnnotations(docID string, annotations []session.Annotation) error {
+	path, err := d.annotationsPath(docID)
+	if err != nil {
+		return err
+	}
+	if len(annotations) == 0 {
+		if err = os.Remove(path); os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	b, err := json.Marshal(annotations)
+	if err != nil {
+		return err
+	}
+	return writeFile(path, b)
+}
+
+// writeFile writes to a temporary file first so that a crash never leaves a
+// truncated file behind
+func writeFile(path string, data []byte) error {
+	f, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path))
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), path)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return err
+}
+
+type registryEntry struct {
+	session  *Session
+	refs     int
+	lastUsed time.Time
+}
+
+// Registry keeps one session per document. Sessions are created lazily when
+// the first connection acquires them, and evicted after being idle for
+// IdleTimeout.
+type Registry struct {
+	Source        DocumentSource
+	Sink          DocumentSink // optional, see Shutdown
+	IdleTimeout   time.Duration
+	MaxDocuments  int           // 0 means unlimited
+	GracePeriod   time.Duration // see Session.GracePeriod
+	ConnOptions   ConnOptions
+	Limits        Limits
+	Authenticator Authenticator
+	// see Session.DiagnosticsDelay
+	DiagnosticsDelay time.Duration
+	RunOptions       RunOptions
+
+	lock    sync.Mutex
+	entries map[string]*registryEntry
+	// closing has the evicted documents that are still being saved, which
+	// are loaded again only once they are
+	closing map[string]chan struct{}
+	// loading has the documents being loaded, which others wait for rather
+	// than loading them again
+	loading      map[string]chan struct{}
+	shuttingDown bool
+}
+
+// evictTimeout bounds how long an evicted session may take to shut down
+// before its document is saved anyway. Evicted sessions have no connections
+// left, unless a client is in its grace period or a transport is slow to
+// close.
+var evictTimeout = 10 * time.Second
+
+func NewRegistry(source DocumentSource) *Registry {
+	return &Registry{
+		Source:      source,
+		IdleTimeout: 5 * time.Minute,
+		GracePeriod: 10 * time.Second,
+		ConnOptions: DefaultConnOptions,
+		Limits:      DefaultLimits,
+		RunOptions:  DefaultRunOptions,
+		// everyone may edit until told otherwise
+		Authenticator: Anonymous(RoleEditor),
+		entries:       map[string]*registryEntry{},
+		closing:       map[string]chan struct{}{},
+		loading:       map[string]chan struct{}{},
+	}
+}
+
+// Acquire returns the session for docID, creating it and starting its event
+// loop if needed. Every Acquire must be paired with a Release.
+func (r *Registry) Acquire(docID string) (*Session, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	for {
+		wait := r.closing[docID]
+		if wait == nil {
+			wait = r.loading[docID]
+		}
+		if wait == nil {
+			break
+		}
+		// the document is still being saved after an eviction, or being
+		// loaded by another Acquire
+		r.lock.Unlock()
+		<-wait
+		r.lock.Lock()
+	}
+
+	if r.shuttingDown {
+		return nil, ErrShuttingDown
+	}
+
+	if e := r.entries[docID]; e != nil {
+		e.refs++
+		e.lastUsed = time.Now()
+		return e.session, nil
+	}
+
+	if r.MaxDocuments > 0 && len(r.entries)+len(r.loading) >= r.MaxDocuments {
+		// make room by evicting the least recently used idle document
+		finish := r.evictLRU()
+		if finish == nil {
+			return nil, ErrTooManyDocuments
+		}
+		go finish()
+	}
+
+	// load without the lock, so that a slow source holds up only those who
+	// want the same document
+	loaded := make(chan struct{})
+	r.loading[docID] = loaded
+	r.lock.Unlock()
+	s, err := r.load(docID)
+	r.lock.Lock()
+	delete(r.loading, docID)
+	close(loaded)
+
+	if err != nil {
+		return nil, err
+	}
+	if r.shuttingDown {
+		// nobody used the session, there is nothing to save
+		return nil, ErrShuttingDown
+	}
+	go s.HandleEvents()
+
+	r.entries[docID] = &registryEntry{session: s, refs: 1, lastUsed: time.Now()}
+
+	return s, nil
+}
+
+// load creates a session for docID from Source, without starting it
+func (r *Registry) load(docID string) (*Session, error) {
+	doc, err := r.Source.Load(docID)
+	if err != nil {
+		return nil, err
+	}
+
+	s := NewSession(doc)
+	if src, ok := r.Source.(AnnotationSource); ok {
+		annotations, err := src.LoadAnnotations(docID)
+		if err != nil {
+			return nil, err
+		}
+		for i := range annotations {
+			s.RestoreAnnotation(&annotations[i])
+		}
+	}
+	s.ID = docID
+	s.GracePeriod = r.GracePeriod
+	s.ConnOptions = r.ConnOptions
+	s.Limits = r.Limits
+	s.DiagnosticsDelay = r.DiagnosticsDelay
+	s.RunOptions = r.RunOptions
+	return s, nil
+}
+
+// Release marks one connection to the document as gone.
+func (r *Registry) Release(docID string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if e := r.entries[docID]; e != nil {
+		e.refs--
+		e.lastUsed = time.Now()
+	}
+}
+
+// Len returns the number of open documents.
+func (r *Registry) Len() int {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return len(r.entries)
+}
+
+// EvictIdle closes the sessions that have had no connections since before
+// now minus IdleTimeout, and returns how many were evicted.
+func (r *Registry) EvictIdle(now time.Time) int {
+	r.lock.Lock()
+	var finishes []func()
+	for id, e := range r.entries {
+		if e.refs <= 0 && now.Sub(e.lastUsed) >= r.IdleTimeout {
+			finishes = append(finishes, r.evict(id))
+		}
+	}
+	r.lock.Unlock()
+
+	var wg sync.WaitGroup
+	for _, finish := range finishes {
+		wg.Add(1)
+		go func(finish func()) {
+			defer wg.Done()
+			finish()
+		}(finish)
+	}
+	wg.Wait()
+	return len(finishes)
+}
+
+// Janitor evicts idle sessions every interval until stop is closed.
+func (r *Registry) Janitor(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case now := <-ticker.C:
+			r.EvictIdle(now)
+		case <-stop:
+			return
+		}
+	}
+}
+
+// Shutdown shuts down every session, see Session.Shutdown, and saves their
+// documents to Sink. Documents cannot be acquired anymore afterwards. It
+// returns the first error encountered, but always tries to save all documents.
+func (r *Registry) Shutdown(ctx context.Context, retryAfter time.Duration) error {
+	r.lock.Lock()
+	r.shuttingDown = true
+	entries := r.entries
+	r.entries = map[string]*registryEntry{}
+	closing := make([]chan struct{}, 0, len(r.closing))
+	for _, c := range r.closing {
+		closing = append(closing, c)
+	}
+	r.lock.Unlock()
+
+	errs := make(chan error, len(entries))
+	for id, e := range entries {
+		go func(id string, s *Session) {
+			snap, err := s.shutdownSnapshot(ctx, retryAfter)
+			if err == ErrSessionClosed {
+				errs <- err
+				return
+			}
+			if serr := r.save(id, snap); serr != nil {
+				err = serr
+			}
+			errs <- err
+		}(id, e.session)
+	}
+
+	var err error
+	for range entries {
+		if e := <-errs; e != nil && err == nil {
+			err = e
+		}
+	}
+	// evicted documents are saved too
+	for _, c := range closing {
+		select {
+		case <-c:
+		case <-ctx.Done():
+			if err == nil {
+				err = ctx.Err()
+			}
+		}
+	}
+	return err
+}
+
+// evictLRU evicts the least recently used idle document, see evict. It
+// returns nil if every document is in use.
+func (r *Registry) evictLRU() func() {
+	var lruID string
+	var lru *registryEntry
+	for id, e := range r.entries {
+		if e.refs <= 0 && (lru == nil || e.lastUsed.Before(lru.lastUsed)) {
+			lruID, lru = id, e
+		}
+	}
+	if lru == nil {
+		return nil
+	}
+	return r.evict(lruID)
+}
+
+// evict takes docID out of the registry. It should be called with r.lock
+// held, and the function it returns, which shuts the session down and saves
+// its document, without.
+func (r *Registry) evict(docID string) func() {
+	e := r.entries[docID]
+	delete(r.entries, docID)
+	closed := make(chan struct{})
+	r.closing[docID] = closed
+
+	return func() {
+		defer func() {
+			r.lock.Lock()
+			delete(r.closing, docID)
+			r.lock.Unlock()
+			close(closed)
+		}()
+
+		ctx, cancel := context.WithTimeout(context.Background(), evictTimeout)
+		defer cancel()
+		snap, err := e.session.shutdownSnapshot(ctx, 0)
+		if err == ErrSessionClosed {
+			return
+		}
+		if err != nil {
+			log.Printf("%s did not shut down cleanly: %v", docID, err)
+		}
+		if err = r.save(docID, snap); err != nil {
+			log.Printf("could not save %s: %v", docID, err)
+		}
+	}
+}
+
+// save stores a closed session's document, and its annotations if Sink can
+// store them
+func (r *Registry) save(docID string, snap *snapshot) error {
+	if r.Sink == nil {
+		return nil
+	}
+	if err := r.Sink.Save(docID, snap.document); err != nil {
+		return err
+	}
+	if sink, ok := r.Sink.(AnnotationSink); ok {
+		return sink.SaveAnnotations(docID, snap.annotations)
+	}
+	return nil
+}
@@ -0,0 +1,450 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/nitrous-io/ot.go/demo/wsclient"
+	"github.com/nitrous-io/ot.go/ot/operation"
+	"github.com/nitrous-io/ot.go/ot/session"
+)
+
+func TestRegistryAcquire(t *testing.T) {
+	loads := map[string]int{}
+	r := NewRegistry(DocumentSourceFunc(func(docID string) (string, error) {
+		loads[docID]++
+		return "content of " + docID, nil
+	}))
+
+	s1, err := r.Acquire("foo")
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	if actual, expected := s1.Document, "content of foo"; actual != expected {
+		t.Errorf("expected document to be %s, got %s", expected, actual)
+	}
+
+	s2, err := r.Acquire("foo")
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	if s1 != s2 {
+		t.Errorf("expected the same session for the same document")
+	}
+
+	s3, err := r.Acquire("bar")
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	if actual, expected := s3.Document, "content of bar"; actual != expected {
+		t.Errorf("expected document to be %s, got %s", expected, actual)
+	}
+
+	if actual, expected := loads["foo"], 1; actual != expected {
+		t.Errorf("expected foo to be loaded %d time(s), got %d", expected, actual)
+	}
+
+	if actual, expected := r.Len(), 2; actual != expected {
+		t.Errorf("expected %d open documents, got %d", expected, actual)
+	}
+}
+
+func TestRegistryEvictIdle(t *testing.T) {
+	r := NewRegistry(StaticSource(""))
+	r.IdleTimeout = time.Minute
+
+	foo, _ := r.Acquire("foo")
+	r.Acquire("bar")
+	r.Release("foo")
+
+	now := time.Now()
+
+	// foo has not been idle long enough
+	if actual, expected := r.EvictIdle(now), 0; actual != expected {
+		t.Errorf("expected %d evicted documents, got %d", expected, actual)
+	}
+
+	// bar still has a connection
+	if actual, expected := r.EvictIdle(now.Add(time.Hour)), 1; actual != expected {
+		t.Errorf("expected %d evicted documents, got %d", expected, actual)
+	}
+
+	if actual, expected := r.Len(), 1; actual != expected {
+		t.Errorf("expected %d open documents, got %d", expected, actual)
+	}
+
+	// the evicted session's event loop is stopped
+	if err := foo.Call(func() {}); err != ErrSessionClosed {
+		t.Errorf("expected ErrSessionClosed calling evicted session, got %v", err)
+	}
+
+	// acquiring an evicted document creates a new session
+	foo2, _ := r.Acquire("foo")
+	if foo2 == foo {
+		t.Errorf("expected a new session after eviction")
+	}
+}
+
+// slowStore keeps documents in memory, but saves them only once release is
+// closed
+type slowStore struct {
+	lock    sync.Mutex
+	docs    map[string]string
+	saving  chan string
+	release chan struct{}
+}
+
+func (s *slowStore) Load(docID string) (string, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.docs[docID], nil
+}
+
+func (s *slowStore) Save(docID, document string) error {
+	s.saving <- docID
+	<-s.release
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.docs[docID] = document
+	return nil
+}
+
+func TestRegistryEvictWhileSaving(t *testing.T) {
+	store := &slowStore{docs: map[string]string{}, saving: make(chan string, 1), release: make(chan struct{})}
+	r := NewRegistry(store)
+	r.Sink = store
+	r.IdleTimeout = time.Minute
+
+	foo, _ := r.Acquire("foo")
+	foo.Call(func() { foo.AddOperation(0, operation.New().Insert("hello")) })
+	r.Release("foo")
+
+	evicted := make(chan int)
+	go func() { evicted <- r.EvictIdle(time.Now().Add(time.Hour)) }()
+	select {
+	case <-store.saving:
+	case <-time.After(testTimeout):
+		t.Fatalf("expected foo to be saved")
+	}
+
+	// the registry is not locked while foo is saved
+	acquired := make(chan *Session, 1)
+	go func() {
+		s, _ := r.Acquire("bar")
+		acquired <- s
+	}()
+	select {
+	case <-acquired:
+	case <-time.After(testTimeout):
+		t.Fatalf("expected bar to be acquired while foo is saved")
+	}
+
+	// but foo is loaded again only once it is saved
+	go func() {
+		s, _ := r.Acquire("foo")
+		acquired <- s
+	}()
+	select {
+	case <-acquired:
+		t.Fatalf("expected foo to be acquired only after it is saved")
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(store.release)
+
+	var foo2 *Session
+	select {
+	case foo2 = <-acquired:
+	case <-time.After(testTimeout):
+		t.Fatalf("expected foo to be acquired after it is saved")
+	}
+	var doc string
+	foo2.Call(func() { doc = foo2.Document })
+	if actual, expected := doc, "hello"; actual != expected {
+		t.Errorf("expected %q, got %q", expected, actual)
+	}
+	if actual, expected := <-evicted, 1; actual != expected {
+		t.Errorf("expected %d evicted documents, got %d", expected, actual)
+	}
+}
+
+func TestRegistrySlowLoad(t *testing.T) {
+	loading := make(chan string, 2)
+	release := make(chan struct{})
+	r := NewRegistry(DocumentSourceFunc(func(docID string) (string, error) {
+		if docID == "slow" {
+			loading <- docID
+			<-release
+		}
+		return "content of " + docID, nil
+	}))
+
+	acquired := make(chan *Session, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			s, _ := r.Acquire("slow")
+			acquired <- s
+		}()
+	}
+	select {
+	case <-loading:
+	case <-time.After(testTimeout):
+		t.Fatalf("expected slow to be loaded")
+	}
+
+	// the registry is not locked while slow is loaded
+	done := make(chan struct{})
+	go func() {
+		r.Acquire("fast")
+		r.Release("fast")
+		r.Len()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(testTimeout):
+		t.Fatalf("expected fast to be acquired while slow is loaded")
+	}
+
+	// and both get the one session of slow
+	close(release)
+	s1, s2 := <-acquired, <-acquired
+	if s1 == nil || s1 != s2 {
+		t.Errorf("expected the same session for the same document")
+	}
+	select {
+	case <-loading:
+		t.Errorf("expected slow to be loaded once")
+	default:
+	}
+}
+
+func TestRegistryMaxDocuments(t *testing.T) {
+	r := NewRegistry(StaticSource(""))
+	r.MaxDocuments = 2
+
+	r.Acquire("foo")
+	r.Acquire("bar")
+
+	if _, err := r.Acquire("baz"); err != ErrTooManyDocuments {
+		t.Errorf("expected ErrTooManyDocuments, got %v", err)
+	}
+
+	// an idle document makes room for a new one
+	r.Release("foo")
+
+	if _, err := r.Acquire("baz"); err != nil {
+		t.Errorf("expected no error, got %v", err)
+	}
+
+	if actual, expected := r.Len(), 2; actual != expected {
+		t.Errorf("expected %d open documents, got %d", expected, actual)
+	}
+}
+
+func TestDirSource(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ot-demo")
+	if err != nil {
+		t.Fatalf("could not create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err = ioutil.WriteFile(filepath.Join(dir, "foo"), []byte("hello"), 0644); err != nil {
+		t.Fatalf("could not write file: %v", err)
+	}
+
+	src := DirSource(dir)
+
+	if doc, err := src.Load("foo"); err != nil || doc != "hello" {
+		t.Errorf("expected hello and no error, got %s and %v", doc, err)
+	}
+
+	if doc, err := src.Load("bar"); err != nil || doc != "" {
+		t.Errorf("expected empty document and no error, got %s and %v", doc, err)
+	}
+
+	if err = src.Save("bar", "saved"); err != nil {
+		t.Errorf("expected no error saving, got %v", err)
+	}
+	if doc, err := src.Load("bar"); err != nil || doc != "saved" {
+		t.Errorf("expected saved and no error, got %s and %v", doc, err)
+	}
+
+	for _, id := range []string{"", "..", "../foo", "a/b", ".hidden"} {
+		if _, err := src.Load(id); err != ErrInvalidDocID {
+			t.Errorf("expected ErrInvalidDocID loading %q, got %v", id, err)
+		}
+		if err := src.Save(id, ""); err != ErrInvalidDocID {
+			t.Errorf("expected ErrInvalidDocID saving %q, got %v", id, err)
+		}
+	}
+}
+
+func TestDirSourceAnnotations(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ot-demo")
+	if err != nil {
+		t.Fatalf("could not create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	src := DirSource(dir)
+	if annotations, err := src.LoadAnnotations("foo"); err != nil || annotations != nil {
+		t.Errorf("expected no annotations and no error, got %+v and %v", annotations, err)
+	}
+
+	expected := []session.Annotation{{ID: "1", From: 1, To: 3, Comments: []session.Comment{{Author: "alice", Text: "why?"}}}}
+	if err = src.SaveAnnotations("foo", expected); err != nil {
+		t.Fatalf("expected no error saving, got %v", err)
+	}
+	if actual, err := src.LoadAnnotations("foo"); err != nil || !reflect.DeepEqual(actual, expected) {
+		t.Errorf("expected %+v and no error, got %+v and %v", expected, actual, err)
+	}
+	// they are not a document
+	if doc, err := src.Load("foo"); err != nil || doc != "" {
+		t.Errorf("expected empty document and no error, got %s and %v", doc, err)
+	}
+
+	if err = src.SaveAnnotations("foo", nil); err != nil {
+		t.Fatalf("expected no error saving, got %v", err)
+	}
+	if files, _ := ioutil.ReadDir(dir); len(files) != 0 {
+		t.Errorf("expected the file to be removed, got %v", files)
+	}
+
+	if _, err := src.LoadAnnotations("../foo"); err != ErrInvalidDocID {
+		t.Errorf("expected ErrInvalidDocID, got %v", err)
+	}
+}
+
+func TestRegistryPersistsAnnotations(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ot-demo")
+	if err != nil {
+		t.Fatalf("could not create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	r := NewRegistry(DirSource(dir))
+	r.Sink = DirSource(dir)
+	s, err := r.Acquire("foo")
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	s.Call(func() {
+		s.AddOperation(0, operation.New().Insert("Lorem Ipsum"))
+		s.AddAnnotation(1, 6, 11, "alice", "typo?")
+	})
+	r.Release("foo")
+
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+	if err = r.Shutdown(ctx, 0); err != nil {
+		t.Fatalf("expected no error shutting down, got %v", err)
+	}
+
+	r = NewRegistry(DirSource(dir))
+	s, err = r.Acquire("foo")
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	defer r.Release("foo")
+	var actual []session.Annotation
+	s.Call(func() { actual = s.annotationList() })
+	expected := []session.Annotation{{ID: "1", From: 6, To: 11, Comments: []session.Comment{{Author: "alice", Text: "typo?"}}}}
+	if !reflect.DeepEqual(actual, expected) {
+		t.Errorf("expected %+v, got %+v", expected, actual)
+	}
+}
+
+func TestPerDocumentSessions(t *testing.T) {
+	r := NewRegistry(DocumentSourceFunc(func(docID string) (string, error) {
+		return docID, nil
+	}))
+	srv := httptest.NewServer(newRouter(r))
+	defer srv.Close()
+
+	for _, tc := range []struct {
+		path string
+		doc  string
+	}{
+		{"/ws", defaultDocID},
+		{"/ws/foo", "foo"},
+		{"/ws/bar", "bar"},
+	} {
+		c, err := wsclient.Dial(wsURL(srv) + tc.path)
+		if err != nil {
+			t.Fatalf("expected no error dialing %s, got %v", tc.path, err)
+		}
+		if actual, expected := c.Document(), tc.doc; actual != expected {
+			t.Errorf("expected document at %s to be %s, got %s", tc.path, expected, actual)
+		}
+		c.Close()
+	}
+
+	if actual, expected := r.Len(), 3; actual != expected {
+		t.Errorf("expected %d open documents, got %d", expected, actual)
+	}
+}
+
+type memSink map[string]string
+
+func (m memSink) Save(docID, document string) error {
+	m[docID] = document
+	return nil
+}
+
+func TestRegistryShutdown(t *testing.T) {
+	r := NewRegistry(StaticSource("hello"))
+	sink := memSink{}
+	r.Sink = sink
+	srv := httptest.NewServer(newRouter(r))
+	defer srv.Close()
+
+	alice, err := wsclient.Dial(wsURL(srv) + "/ws/foo")
+	if err != nil {
+		t.Fatalf("expected no error dialing, got %v", err)
+	}
+	defer alice.Close()
+
+	// an edit still in flight when the server shuts down is not lost
+	if err = alice.Submit(operation.New().Retain(5).Insert("!"), nil); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+	if err = r.Shutdown(ctx, 2*time.Second); err != nil {
+		t.Fatalf("expected no error shutting down, got %v", err)
+	}
+
+	if actual, expected := sink["foo"], "hello!"; actual != expected {
+		t.Errorf("expected saved document to be %s, got %s", expected, actual)
+	}
+
+	err = alice.Wait(testTimeout, func(c *wsclient.Client) bool { return c.Err() != nil })
+	if err != nil {
+		t.Fatalf("expected alice's connection to be closed, got %v", err)
+	}
+	if !websocket.IsCloseError(alice.Err(), websocket.CloseGoingAway) {
+		t.Errorf("expected going away close error, got %v", alice.Err())
+	}
+	if actual, expected := alice.RetryAfter(), 2*time.Second; actual != expected {
+		t.Errorf("expected retry after %v, got %v", expected, actual)
+	}
+
+	if _, err = wsclient.Dial(wsURL(srv) + "/ws/foo"); err == nil {
+		t.Errorf("expected dialing to fail after shutdown")
+	}
+	if _, err = r.Acquire("foo"); err != ErrShuttingDown {
+		t.Errorf("expected ErrShuttingDown, got %v", err)
+	}
+}
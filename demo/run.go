@@ -0,0 +1,266 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/nitrous-io/ot.go/demo/protocol"
+)
+
+var (
+	ErrSandboxUnavailable = errors.New("demo: programs cannot be sandboxed on this platform")
+	ErrNoToolchain        = errors.New("demo: the go command is not installed")
+)
+
+// why runs end early
+var (
+	errBuildFailed    = errors.New("build failed")
+	errRunTimedOut    = errors.New("timed out")
+	errOutputTooLarge = errors.New("too much output")
+)
+
+// RunOptions limit the programs clients run.
+type RunOptions struct {
+	// Enabled allows clients to run the document. Programs are sandboxed,
+	// but they are still arbitrary code.
+	Enabled      bool
+	Timeout      time.Duration // for building and running, 0 for none
+	MemoryLimit  int64         // bytes of data the program may map, 0 for none
+	MaxOutput    int           // bytes written before the program is killed, 0 for no limit
+	MaxProcesses int           // processes and threads of the program, 0 for no limit
+	CPULimit     time.Duration // processor time of the program, in whole seconds, 0 for none
+}
+
+var DefaultRunOptions = RunOptions{
+	Timeout:      10 * time.Second,
+	MemoryLimit:  512 << 20,
+	MaxOutput:    1 << 20,
+	MaxProcesses: 64,
+	CPULimit:     10 * time.Second,
+}
+
+// activeRun is the program running for a session
+type activeRun struct {
+	clientID string
+	username string
+	cancel   context.CancelCauseFunc
+}
+
+// runResult ends an active run
+type runResult struct {
+	run  *activeRun
+	exit *protocol.Exit
+}
+
+// handleRun builds and runs the document off the event loop. Its output comes
+// back as "output" events, and its end as an "exited" event. There is at most
+// one run per session.
+func (s *Session) handleRun(c *Connection) *EventError {
+	if !s.RunOptions.Enabled {
+		return newEventError(ErrCodeRunDisabled, "running programs is disabled")
+	}
+	if !c.Identity.Role.CanEdit() {
+		return newEventError(ErrCodeForbidden, c.Identity.Role.String()+" may not run the document")
+	}
+	if s.run != nil {
+		return newEventError(ErrCodeRunInProgress, s.run.username+" is running the document")
+	}
+
+	var username string
+	if cl := s.Clients[c.ID]; cl != nil {
+		username = cl.Name
+	}
+	ctx, cancel := context.WithCancelCause(context.Background())
+	run := &activeRun{clientID: c.ID, username: username, cancel: cancel}
+	s.run = run
+	s.broadcast(s.runningEvent(), nil)
+
+	options, doc := s.RunOptions, s.Document
+	go func() {
+		// nobody is left to see the output
+		select {
+		case <-s.done:
+			cancel(ErrSessionClosed)
+		case <-ctx.Done():
+		}
+	}()
+	go func() {
+		defer cancel(nil)
+		ctx := ctx
+		if options.Timeout > 0 {
+			var stop context.CancelFunc
+			ctx, stop = context.WithTimeoutCause(ctx, options.Timeout, errRunTimedOut)
+			defer stop()
+		}
+		out := &runOutput{max: options.MaxOutput, exceeded: cancel, send: func(stream, data string) {
+			s.post(ConnEvent{Event: &Event{"output", &protocol.Output{Stream: stream, Data: data}}, internal: true})
+		}}
+
+		status, err := runProgram(ctx, doc, options, out)
+		exit := &protocol.Exit{Status: status}
+		if err != nil {
+			exit.Error = err.Error()
+		}
+		s.post(ConnEvent{Event: &Event{"exited", &runResult{run, exit}}, internal: true})
+	}()
+	return nil
+}
+
+// handleStop kills the running program
+func (s *Session) handleStop(c *Connection) *EventError {
+	if !c.Identity.Role.CanEdit() {
+		return newEventError(ErrCodeForbidden, c.Identity.Role.String()+" may not stop the program")
+	}
+	if s.run == nil {
+		return newEventError(ErrCodeNotRunning, "no program is running")
+	}
+	s.run.cancel(errors.New("stopped by " + s.displayName(c.ID)))
+	return nil
+}
+
+func (s *Session) handleExited(r *runResult) {
+	if r.run != s.run {
+		return
+	}
+	s.run = nil
+	s.broadcast(r.exit, nil)
+}
+
+// runningEvent announces the active run
+func (s *Session) runningEvent() *protocol.Running {
+	return &protocol.Running{ClientID: s.run.clientID, Username: s.run.username}
+}
+
+// runProgram builds doc as a main package and runs it in a sandbox, writing
+// the output of both to out. It returns the exit status of the program, or
+// -1 and why it did not run to completion.
+func runProgram(ctx context.Context, doc string, options RunOptions, out *runOutput) (int, error) {
+	goTool, err := exec.LookPath("go")
+	if err != nil {
+		return -1, ErrNoToolchain
+	}
+	dir, err := os.MkdirTemp("", "demo-run-")
+	if err != nil {
+		return -1, err
+	}
+	defer os.RemoveAll(dir)
+	// the sandbox may run the program as someone else
+	if err = os.Chmod(dir, 0711); err != nil {
+		return -1, err
+	}
+	if err = os.WriteFile(filepath.Join(dir, "main.go"), []byte(doc), 0600); err != nil {
+		return -1, err
+	}
+
+	stdout, stderr := out.writer("stdout"), out.writer("stderr")
+	defer stdout.flush()
+	defer stderr.flush()
+
+	// the build must not download anything either
+	build := exec.CommandContext(ctx, goTool, "build", "-o", "prog", "main.go")
+	build.Dir = dir
+	build.Env = append(os.Environ(), "CGO_ENABLED=0", "GOPROXY=off", "GOFLAGS=", "GOWORK=off")
+	build.Stdout, build.Stderr = stderr, stderr
+	if err = build.Run(); err != nil {
+		if ctx.Err() != nil {
+			return -1, context.Cause(ctx)
+		}
+		return -1, errBuildFailed
+	}
+
+	cmd := exec.CommandContext(ctx, filepath.Join(dir, "prog"))
+	cmd.Dir = dir
+	cmd.Env = []string{"HOME=/"}
+	cmd.Stdout, cmd.Stderr = stdout, stderr
+	// don't wait for children holding on to the output
+	cmd.WaitDelay = time.Second
+	if err = sandbox(cmd, options); err != nil {
+		return -1, err
+	}
+
+	err = cmd.Run()
+	if ctx.Err() != nil {
+		return -1, context.Cause(ctx)
+	}
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		if status := exitErr.ExitCode(); status >= 0 {
+			return status, nil
+		}
+		// killed by a signal
+		return -1, errors.New(exitErr.Error())
+	}
+	if err != nil {
+		return -1, err
+	}
+	return 0, nil
+}
+
+// runOutput streams what a run writes, until there has been too much of it
+type runOutput struct {
+	send     func(stream, data string)
+	max      int
+	exceeded context.CancelCauseFunc
+
+	lock    sync.Mutex
+	written int
+}
+
+func (o *runOutput) writer(stream string) *streamWriter {
+	return &streamWriter{out: o, stream: stream}
+}
+
+// streamWriter sends the output written to one stream. It holds back a
+// character split across writes so that every chunk is valid utf-8.
+type streamWriter struct {
+	out     *runOutput
+	stream  string
+	pending []byte
+}
+
+func (w *streamWriter) Write(p []byte) (int, error) {
+	n := len(p)
+	o := w.out
+	o.lock.Lock()
+	if o.max > 0 && o.written+len(p) > o.max {
+		p = p[:o.max-o.written]
+		o.exceeded(errOutputTooLarge)
+	}
+	o.written += len(p)
+	o.lock.Unlock()
+
+	b := append(w.pending, p...)
+	keep := incompleteRune(b)
+	w.pending = append([]byte(nil), b[len(b)-keep:]...)
+	if len(b) > keep {
+		o.send(w.stream, string(b[:len(b)-keep]))
+	}
+	return n, nil
+}
+
+// flush sends what is held back
+func (w *streamWriter) flush() {
+	if len(w.pending) > 0 {
+		w.out.send(w.stream, string(w.pending))
+		w.pending = nil
+	}
+}
+
+// incompleteRune returns the length of the incomplete character at the end
+// of b, if any
+func incompleteRune(b []byte) int {
+	for i := len(b) - 1; i >= 0 && i >= len(b)-utf8.UTFMax; i-- {
+		if utf8.RuneStart(b[i]) {
+			if !utf8.FullRune(b[i:]) {
+				return len(b) - i
+			}
+			break
+		}
+	}
+	return 0
+}
@@ -0,0 +1,297 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nitrous-io/ot.go/demo/protocol"
+	"github.com/nitrous-io/ot.go/demo/wsclient"
+)
+
+// runTimeout leaves room for building programs with a cold cache
+const runTimeout = 60 * time.Second
+
+// newRunServer serves a session that runs programs, or skips the test if
+// they cannot be run here
+func newRunServer(t *testing.T, doc string, options RunOptions) (*httptest.Server, *Session) {
+	if _, err := exec.LookPath("go"); err != nil {
+		t.Skip("the go command is not installed")
+	}
+	if err := checkSandbox(); err != nil {
+		t.Skip(err)
+	}
+
+	options.Enabled = true
+	return newTestServer(t, doc, func(s *Session) {
+		s.RunOptions = options
+	})
+}
+
+// runAndWait runs the document and waits for it to exit
+func runAndWait(t *testing.T, c *wsclient.Client) protocol.Exit {
+	if err := c.Run(); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	waitExit(t, c)
+	exit, _ := c.Exit()
+	return exit
+}
+
+func waitExit(t *testing.T, c *wsclient.Client) {
+	err := c.Wait(runTimeout, func(c *wsclient.Client) bool {
+		_, ok := c.Exit()
+		return ok
+	})
+	if err != nil {
+		t.Fatalf("expected the program to exit, got %v (output %q)", err, c.Output())
+	}
+}
+
+func TestRun(t *testing.T) {
+	srv, _ := newRunServer(t, "package main\n\nimport (\n\t\"fmt\"\n\t\"os\"\n)\n\nfunc main() {\n\tfmt.Println(\"hello, wörld\")\n\tfmt.Fprintln(os.Stderr, \"oops\")\n\tos.Exit(3)\n}\n", DefaultRunOptions)
+	defer srv.Close()
+
+	alice := dialAndJoin(t, srv, "alice")
+	defer alice.Close()
+	bob := dialAndJoin(t, srv, "bob")
+	defer bob.Close()
+
+	if err := alice.Run(); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	err := bob.Wait(runTimeout, func(c *wsclient.Client) bool {
+		_, running := c.Running()
+		_, exited := c.Exit()
+		return running || exited
+	})
+	if err != nil {
+		t.Fatalf("expected bob to see the run, got %v", err)
+	}
+
+	// everyone sees the output and how the program ended
+	for _, c := range []*wsclient.Client{alice, bob} {
+		waitExit(t, c)
+		if actual, expected := c.Output(), "hello, wörld\noops\n"; actual != expected && actual != "oops\nhello, wörld\n" {
+			t.Errorf("expected output %q, got %q", expected, actual)
+		}
+		if actual, _ := c.Exit(); actual != (protocol.Exit{Status: 3}) {
+			t.Errorf("expected status 3, got %+v", actual)
+		}
+		if _, running := c.Running(); running {
+			t.Errorf("expected the run to be over")
+		}
+	}
+}
+
+func TestRunBuildFailed(t *testing.T) {
+	srv, _ := newRunServer(t, "package main\n\nfunc main() {\n\tx := 1\n}\n", DefaultRunOptions)
+	defer srv.Close()
+
+	alice := dialAndJoin(t, srv, "alice")
+	defer alice.Close()
+
+	exit := runAndWait(t, alice)
+	if actual, expected := exit, (protocol.Exit{Status: -1, Error: errBuildFailed.Error()}); actual != expected {
+		t.Errorf("expected %+v, got %+v", expected, actual)
+	}
+	if actual := alice.Output(); !strings.Contains(actual, "declared and not used: x") {
+		t.Errorf("expected the compiler errors, got %q", actual)
+	}
+}
+
+func TestStopRun(t *testing.T) {
+	srv, _ := newRunServer(t, "package main\n\nimport \"time\"\n\nfunc main() {\n\tprintln(\"started\")\n\ttime.Sleep(time.Hour)\n}\n", DefaultRunOptions)
+	defer srv.Close()
+
+	alice := dialAndJoin(t, srv, "alice")
+	defer alice.Close()
+	bob := dialAndJoin(t, srv, "bob")
+	defer bob.Close()
+
+	if err := alice.Run(); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	err := bob.Wait(runTimeout, func(c *wsclient.Client) bool {
+		return c.Output() == "started\n"
+	})
+	if err != nil {
+		t.Fatalf("expected the program to start, got %v", err)
+	}
+	expected := protocol.Running{ClientID: alice.ID(), Username: "alice"}
+	if actual, _ := bob.Running(); actual != expected {
+		t.Errorf("expected %+v, got %+v", expected, actual)
+	}
+
+	// one run at a time
+	if err = bob.Run(); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	var errs []wsclient.ServerError
+	err = bob.Wait(testTimeout, func(c *wsclient.Client) bool {
+		errs = c.ServerErrors()
+		return len(errs) > 0
+	})
+	if err != nil {
+		t.Fatalf("expected bob to receive an error, got %v", err)
+	}
+	if actual, expected := errs[0], (wsclient.ServerError{Code: ErrCodeRunInProgress, Message: "alice is running the document", Event: "run"}); actual != expected {
+		t.Errorf("expected %+v, got %+v", expected, actual)
+	}
+
+	// anyone who may edit can stop it
+	if err = bob.Stop(); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	waitExit(t, alice)
+	if actual, expected := func() protocol.Exit { e, _ := alice.Exit(); return e }(), (protocol.Exit{Status: -1, Error: "stopped by bob"}); actual != expected {
+		t.Errorf("expected %+v, got %+v", expected, actual)
+	}
+
+	// and nothing is left to stop
+	if err = bob.Stop(); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	err = bob.Wait(testTimeout, func(c *wsclient.Client) bool {
+		errs = c.ServerErrors()
+		return len(errs) > 1
+	})
+	if err != nil {
+		t.Fatalf("expected bob to receive an error, got %v", err)
+	}
+	if actual, expected := errs[1].Code, ErrCodeNotRunning; actual != expected {
+		t.Errorf("expected %q, got %q", expected, actual)
+	}
+}
+
+func TestRunLimits(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		main    string
+		options RunOptions
+		error   string
+		output  string // in the reason the program failed
+	}{
+		{"timeout", "for {\n\t}", RunOptions{Timeout: time.Second}, errRunTimedOut.Error(), ""},
+		{"output", "for {\n\t\tprintln(\"spam\")\n\t}", RunOptions{MaxOutput: 1000}, errOutputTooLarge.Error(), ""},
+		{"memory", "b := make([]byte, 1<<30)\n\tfor i := range b {\n\t\tb[i] = 1\n\t}", RunOptions{MemoryLimit: 256 << 20}, "", "memory"},
+		{"network", "if _, err := net.Dial(\"tcp\", \"1.1.1.1:80\"); err != nil {\n\t\tpanic(err)\n\t}", RunOptions{}, "", "network is unreachable"},
+		{"processes", "for {\n\t\tgo func() {\n\t\t\truntime.LockOSThread()\n\t\t\ttime.Sleep(time.Hour)\n\t\t}()\n\t\ttime.Sleep(time.Millisecond)\n\t}", RunOptions{MaxProcesses: 16}, "", "failed to create new OS thread"},
+		{"cpu", "for {\n\t}", RunOptions{CPULimit: time.Second}, "signal: killed", ""},
+	} {
+		// a longer timeout still stops runaway programs if a limit does not
+		// hold, but only the first case expects it
+		if tc.options.Timeout == 0 {
+			tc.options.Timeout = runTimeout / 2
+		}
+		doc := "package main\n\nimport (\n\t\"net\"\n\t\"runtime\"\n\t\"time\"\n)\n\nvar (\n\t_ net.Conn\n\t_ = runtime.LockOSThread\n\t_ time.Duration\n)\n\nfunc main() {\n\t" + tc.main + "\n}\n"
+		srv, s := newRunServer(t, doc, tc.options)
+
+		alice := dialAndJoin(t, srv, "alice")
+		exit := runAndWait(t, alice)
+		if tc.error != "" {
+			if actual, expected := exit, (protocol.Exit{Status: -1, Error: tc.error}); actual != expected {
+				t.Errorf("%s: expected %+v, got %+v", tc.name, expected, actual)
+			}
+		} else if exit.Status == 0 || !strings.Contains(alice.Output(), tc.output) {
+			t.Errorf("%s: expected the program to fail with %q, got %+v (output %q)", tc.name, tc.output, exit, alice.Output())
+		}
+		if tc.options.MaxOutput > 0 && len(alice.Output()) > tc.options.MaxOutput {
+			t.Errorf("%s: expected at most %d bytes of output, got %d", tc.name, tc.options.MaxOutput, len(alice.Output()))
+		}
+
+		alice.Close()
+		srv.Close()
+		s.Stop()
+	}
+}
+
+func TestRunSandbox(t *testing.T) {
+	// a file the server can read
+	secret := filepath.Join(t.TempDir(), "secret")
+	if err := os.WriteFile(secret, []byte("secret"), 0644); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	doc := fmt.Sprintf("package main\n\nimport (\n\t\"fmt\"\n\t\"os\"\n)\n\nfunc main() {\n\tentries, _ := os.ReadDir(\"/\")\n\tfor _, e := range entries {\n\t\tfmt.Println(e.Name())\n\t}\n\tfor _, name := range []string{%q, \"/etc/passwd\", \"/proc/self/environ\"} {\n\t\t_, err := os.ReadFile(name)\n\t\tfmt.Println(err != nil)\n\t}\n}\n", secret)
+	srv, _ := newRunServer(t, doc, DefaultRunOptions)
+	defer srv.Close()
+
+	alice := dialAndJoin(t, srv, "alice")
+	defer alice.Close()
+
+	// the root holds nothing but the program
+	exit := runAndWait(t, alice)
+	if actual, expected := alice.Output(), "prog\ntrue\ntrue\ntrue\n"; exit.Status != 0 || actual != expected {
+		t.Errorf("expected output %q, got %+v and %q", expected, exit, actual)
+	}
+}
+
+func TestRunDisabled(t *testing.T) {
+	srv, _ := newTestServer(t, "package main\n\nfunc main() {}\n", nil)
+	defer srv.Close()
+
+	alice := dialAndJoin(t, srv, "alice")
+	defer alice.Close()
+
+	if err := alice.Run(); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	var errs []wsclient.ServerError
+	err := alice.Wait(testTimeout, func(c *wsclient.Client) bool {
+		errs = c.ServerErrors()
+		return len(errs) > 0
+	})
+	if err != nil {
+		t.Fatalf("expected alice to receive an error, got %v", err)
+	}
+	if actual, expected := errs[0].Code, ErrCodeRunDisabled; actual != expected {
+		t.Errorf("expected %q, got %q", expected, actual)
+	}
+}
+
+func TestStreamWriter(t *testing.T) {
+	var sent []string
+	_, cancel := context.WithCancelCause(context.Background())
+	out := &runOutput{max: 7, exceeded: cancel, send: func(stream, data string) {
+		sent = append(sent, stream+":"+data)
+	}}
+	w := out.writer("stdout")
+
+	// the ö is split across writes
+	w.Write([]byte("ab\xc3"))
+	w.Write([]byte("\xb6cd"))
+	// only what fits the limit is sent
+	w.Write([]byte("efgh"))
+	w.flush()
+
+	expected := []string{"stdout:ab", "stdout:öcd", "stdout:e"}
+	if actual := strings.Join(sent, "|"); actual != strings.Join(expected, "|") {
+		t.Errorf("expected %q, got %q", expected, sent)
+	}
+}
+
+func TestIncompleteRune(t *testing.T) {
+	for _, tc := range []struct {
+		b        string
+		expected int
+	}{
+		{"", 0},
+		{"abc", 0},
+		{"aö", 0},
+		{"a\xc3", 1},
+		{"a\xf0\x9f\x98", 3},
+		{"a😀", 0},
+		// invalid bytes are sent as they are
+		{"a\xb6", 0},
+	} {
+		if actual := incompleteRune([]byte(tc.b)); actual != tc.expected {
+			t.Errorf("expected %d for %q, got %d", tc.expected, tc.b, actual)
+		}
+	}
+}
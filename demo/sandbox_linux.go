@@ -0,0 +1,189 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// sandboxInit is the name the demo runs itself under to set up a sandbox from
+// the inside, see initSandbox
+const sandboxInit = "demo-sandbox-init"
+
+// missing from package syscall
+const (
+	rlimitNproc     = 6
+	prSetNoNewPrivs = 38
+	capVersion3     = 0x20080522
+)
+
+// nobody owns the programs of a server running as root, which would
+// otherwise be exempt from RLIMIT_NPROC
+const nobody = 65534
+
+func init() {
+	if len(os.Args) == 6 && os.Args[0] == sandboxInit {
+		if err := initSandbox(os.Args[1], os.Args[2], os.Args[3:]); err != nil {
+			fmt.Fprintln(os.Stderr, "sandbox:", err)
+			os.Exit(127)
+		}
+		os.Exit(0)
+	}
+}
+
+// sandbox makes cmd run in new user, mount, pid and network namespaces, in a
+// process group of its own that is killed as a whole when cmd's context is
+// done. The program, cmd.Path in cmd.Dir, sees nothing but a copy of itself
+// in an empty root and a loopback interface, and is limited by options.
+//
+// cmd.Dir must be accessible to others if the server runs as root.
+func sandbox(cmd *exec.Cmd, options RunOptions) error {
+	// rounded up to whole seconds
+	cpu := int64((options.CPULimit + time.Second - 1) / time.Second)
+	cmd.Args = []string{
+		sandboxInit, cmd.Dir, filepath.Base(cmd.Path),
+		strconv.FormatInt(options.MemoryLimit, 10),
+		strconv.Itoa(options.MaxProcesses),
+		strconv.FormatInt(cpu, 10),
+	}
+	cmd.Path = "/proc/self/exe"
+
+	uid, gid := os.Getuid(), os.Getgid()
+	if uid == 0 {
+		uid, gid = nobody, nobody
+	}
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		Cloneflags: syscall.CLONE_NEWUSER | syscall.CLONE_NEWNS | syscall.CLONE_NEWPID | syscall.CLONE_NEWNET,
+		// root in the namespace, to set it up
+		UidMappings: []syscall.SysProcIDMap{{ContainerID: 0, HostID: uid, Size: 1}},
+		GidMappings: []syscall.SysProcIDMap{{ContainerID: 0, HostID: gid, Size: 1}},
+		Credential:  &syscall.Credential{Uid: 0, Gid: 0, NoSetGroups: true},
+		Setpgid:     true,
+		Pdeathsig:   syscall.SIGKILL,
+	}
+	cmd.Cancel = func() error {
+		return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+	}
+	return nil
+}
+
+// checkSandbox sets up a sandbox without a program in it, to tell whether
+// programs can be run here.
+func checkSandbox() error {
+	cmd := exec.CommandContext(context.Background(), "/proc/self/exe")
+	cmd.Dir = os.TempDir()
+	if err := sandbox(cmd, RunOptions{}); err != nil {
+		return err
+	}
+	cmd.Args[2] = ""
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("demo: programs cannot be sandboxed here: %v %s", err, out)
+	}
+	return nil
+}
+
+// initSandbox runs as the first process of the namespaces made by sandbox. It
+// replaces the root with a tmpfs holding only a copy of prog from dir, limits
+// the data size, processes and cpu seconds to limits, drops its capabilities
+// and execs prog. Without prog, it returns nil once the root is replaced.
+func initSandbox(dir, prog string, limits []string) error {
+	// capabilities and no_new_privs belong to the thread that execs
+	runtime.LockOSThread()
+
+	var binary []byte
+	if prog != "" {
+		var err error
+		if binary, err = os.ReadFile(filepath.Join(dir, prog)); err != nil {
+			return err
+		}
+	}
+
+	// the mounts must not propagate to the host
+	if err := syscall.Mount("", "/", "", syscall.MS_REC|syscall.MS_PRIVATE, ""); err != nil {
+		return fmt.Errorf("making mounts private: %v", err)
+	}
+	if err := syscall.Mount("tmpfs", dir, "tmpfs", syscall.MS_NOSUID|syscall.MS_NODEV, "size=64m,mode=0755"); err != nil {
+		return fmt.Errorf("mounting the root: %v", err)
+	}
+	if prog != "" {
+		if err := os.WriteFile(filepath.Join(dir, prog), binary, 0755); err != nil {
+			return err
+		}
+	}
+	old := filepath.Join(dir, ".old")
+	if err := os.Mkdir(old, 0700); err != nil {
+		return err
+	}
+	if err := syscall.PivotRoot(dir, old); err != nil {
+		return fmt.Errorf("pivoting the root: %v", err)
+	}
+	if err := os.Chdir("/"); err != nil {
+		return err
+	}
+	if err := syscall.Unmount("/.old", syscall.MNT_DETACH); err != nil {
+		return fmt.Errorf("unmounting the old root: %v", err)
+	}
+	if err := os.Remove("/.old"); err != nil {
+		return err
+	}
+	if prog == "" {
+		return nil
+	}
+
+	for i, resource := range []int{syscall.RLIMIT_DATA, rlimitNproc, syscall.RLIMIT_CPU} {
+		n, err := strconv.ParseUint(limits[i], 10, 64)
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			continue
+		}
+		rlimit := &syscall.Rlimit{Cur: n, Max: n}
+		if resource == syscall.RLIMIT_CPU {
+			// SIGXCPU at the limit, SIGKILL a second later
+			rlimit.Max++
+		}
+		if err = syscall.Setrlimit(resource, rlimit); err != nil {
+			return fmt.Errorf("setting limit %d: %v", resource, err)
+		}
+	}
+
+	if err := dropCapabilities(); err != nil {
+		return fmt.Errorf("dropping capabilities: %v", err)
+	}
+	return syscall.Exec("/"+prog, []string{prog}, os.Environ())
+}
+
+// dropCapabilities leaves the thread with no capabilities, now or after
+// exec, although it is root in its namespace
+func dropCapabilities() error {
+	for c := 0; ; c++ {
+		_, _, errno := syscall.RawSyscall(syscall.SYS_PRCTL, syscall.PR_CAPBSET_DROP, uintptr(c), 0)
+		if errno == syscall.EINVAL {
+			// past the last capability
+			break
+		}
+		if errno != 0 {
+			return errno
+		}
+	}
+	header := struct {
+		version uint32
+		pid     int32
+	}{version: capVersion3}
+	var data [2]struct{ effective, permitted, inheritable uint32 }
+	if _, _, errno := syscall.RawSyscall(syscall.SYS_CAPSET, uintptr(unsafe.Pointer(&header)), uintptr(unsafe.Pointer(&data[0])), 0); errno != 0 {
+		return errno
+	}
+	if _, _, errno := syscall.RawSyscall(syscall.SYS_PRCTL, prSetNoNewPrivs, 1, 0); errno != 0 {
+		return errno
+	}
+	return nil
+}
@@ -0,0 +1,15 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import "os/exec"
+
+// sandbox needs linux namespaces
+func sandbox(cmd *exec.Cmd, options RunOptions) error {
+	return ErrSandboxUnavailable
+}
+
+func checkSandbox() error {
+	return ErrSandboxUnavailable
+}
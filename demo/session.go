@@ -1,146 +1,612 @@
 package main
 
 import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
 	"strconv"
 	"sync"
+	"time"
 
+	"github.com/nitrous-io/ot.go/demo/protocol"
 	"github.com/nitrous-io/ot.go/ot/operation"
 	"github.com/nitrous-io/ot.go/ot/selection"
 	"github.com/nitrous-io/ot.go/ot/session"
 )
 
+var (
+	ErrSessionClosed = errors.New("demo: session closed")
+)
+
+// Resume identifies a client that reconnects after its connection dropped.
+type Resume struct {
+	ClientID string
+	Token    string
+	Revision int // last revision the client has seen
+}
+
+// Session is a document shared by its connections. All of its state is owned
+// by the go routine running HandleEvents: connections, timers and other code
+// only ever reach it by posting events.
 type Session struct {
+	ID          string // document id
 	nextConnID  int
 	Connections map[*Connection]struct{}
 
 	EventChan chan ConnEvent
 
-	lock sync.Mutex
+	// how long a dropped client keeps its identity, name and selection
+	GracePeriod time.Duration
+	ConnOptions ConnOptions
+	// Limits must not change once HandleEvents runs
+	Limits Limits
+	// how long edits must pause before the document is type checked; 0
+	// disables checking
+	DiagnosticsDelay time.Duration
+	RunOptions       RunOptions
+
+	initial      string               // the document at revision 0
+	authors      []string             // client id of the author of each operation
+	opBucket     *tokenBucket         // limits the op rate of the whole document
+	resumeTokens map[string]string    // client id -> token needed to resume
+	disconnected map[string]time.Time // client id -> when it was disconnected
+
+	spectators *spectatorHub
+
+	diagnostics []protocol.Diagnostic // of the current revision
+	checkTimer  *time.Timer           // runs the next check once edits pause
+	checkGen    int                   // tells outdated check timers apart
+	checkedRev  int                   // revision of the diagnostics
+
+	run *activeRun // the program running, if any
+
+	shutdown *protocol.Shutdown // sent to every connection once shutting down
+	drained  chan struct{}      // closed when the last connection is gone
+
+	done     chan struct{}
+	stopOnce sync.Once
 
 	*session.Session
 }
 
 func NewSession(document string) *Session {
 	return &Session{
-		Connections: map[*Connection]struct{}{},
-		EventChan:   make(chan ConnEvent),
-		Session:     session.New(document),
+		Connections:  map[*Connection]struct{}{},
+		EventChan:    make(chan ConnEvent),
+		GracePeriod:  10 * time.Second,
+		ConnOptions:  DefaultConnOptions,
+		Limits:       DefaultLimits,
+		RunOptions:   DefaultRunOptions,
+		initial:      document,
+		resumeTokens: map[string]string{},
+		disconnected: map[string]time.Time{},
+		spectators:   newSpectatorHub(),
+		done:         make(chan struct{}),
+		Session:      session.New(document),
 	}
 }
 
-func (s *Session) RegisterConnection(c *Connection) {
-	s.lock.Lock()
-	id := strconv.Itoa(s.nextConnID)
-	c.ID = id
-	s.nextConnID++
+// Stop makes HandleEvents return. Events posted afterwards are dropped.
+func (s *Session) Stop() {
+	s.stopOnce.Do(func() {
+		close(s.done)
+	})
+}
+
+// post hands e to the event loop. It returns false if the session has been
+// stopped.
+func (s *Session) post(e ConnEvent) bool {
+	select {
+	case s.EventChan <- e:
+		return true
+	case <-s.done:
+		return false
+	}
+}
+
+// Call runs f on the event loop and waits for it to return, so that f can
+// safely read and modify the session.
+func (s *Session) Call(f func()) error {
+	done := make(chan struct{})
+	ok := s.post(ConnEvent{Event: &Event{"call", func() {
+		f()
+		close(done)
+	}}, internal: true})
+	if !ok {
+		return ErrSessionClosed
+	}
+	select {
+	case <-done:
+		return nil
+	case <-s.done:
+		return ErrSessionClosed
+	}
+}
+
+// Shutdown sends every client a shutdown event telling it to retry after
+// retryAfter, and closes their connections once the events queued for them
+// are written. The events clients posted before their connections closed are
+// still handled. Once all connections are gone, or ctx is done, the event loop
+// is stopped and the final document is returned along with ctx's error, if
+// any.
+func (s *Session) Shutdown(ctx context.Context, retryAfter time.Duration) (string, error) {
+	snap, err := s.shutdownSnapshot(ctx, retryAfter)
+	if snap == nil {
+		return "", err
+	}
+	return snap.document, err
+}
+
+// snapshot is what is saved of a session once it is shut down
+type snapshot struct {
+	document    string
+	annotations []session.Annotation
+}
+
+// shutdownSnapshot is Shutdown, returning the annotations along with the
+// document
+func (s *Session) shutdownSnapshot(ctx context.Context, retryAfter time.Duration) (*snapshot, error) {
+	drained := make(chan struct{})
+	err := s.Call(func() {
+		s.shutdown = &protocol.Shutdown{RetryAfter: int64(retryAfter / time.Millisecond)}
+		if s.run != nil {
+			s.run.cancel(ErrSessionClosed)
+		}
+		s.drained = drained
+		enc := newEncoded(s.shutdown)
+		for c := range s.Connections {
+			if j, err := enc.in(c.Protocol); err == nil {
+				c.enqueue(j)
+			}
+			c.closeGoingAway()
+		}
+		s.spectators.send(spectatorCmd{kind: spectatorShutdown, msg: encodeAll(s.shutdown)}, s.done)
+		s.checkDrained()
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	select {
+	case <-drained:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+
+	snap := &snapshot{}
+	s.Call(func() {
+		snap.document = s.Document
+		snap.annotations = s.annotationList()
+	})
+	s.Stop()
+
+	return snap, err
+}
+
+func (s *Session) checkDrained() {
+	if s.drained != nil && len(s.Connections) == 0 {
+		close(s.drained)
+		s.drained = nil
+	}
+}
+
+// Spectators returns the number of spectators watching the document.
+func (s *Session) Spectators() int {
+	return s.spectators.Len()
+}
+
+// addSpectator sends c the document and hands it over to the spectator hub,
+// which sends it every later op, sel, join and quit event.
+func (s *Session) addSpectator(c *Connection) {
+	if s.shutdown != nil {
+		c.Send(s.shutdown)
+		c.closeGoingAway()
+		return
+	}
+	j, err := protocol.Encode(c.Protocol, s.docEvent("", "", c.Identity.Role))
+	if err != nil {
+		c.Close()
+		return
+	}
+	s.spectators.add(c, map[protocol.Protocol][]byte{c.Protocol: j}, s.done)
+}
+
+// registerConnection adds c to the session and brings it up to date, either
+// by replaying the operations it missed while resuming, or by sending the
+// whole document.
+func (s *Session) registerConnection(c *Connection, resume *Resume) {
+	if s.shutdown != nil {
+		c.Send(s.shutdown)
+		c.closeGoingAway()
+		return
+	}
+
+	if resume == nil || !s.resumeClient(c, resume) {
+		id := strconv.Itoa(s.nextConnID)
+		s.nextConnID++
+
+		token, err := newResumeToken()
+		if err != nil {
+			c.Close()
+			return
+		}
+
+		if err = c.Send(s.docEvent(id, token, c.Identity.Role)); err != nil {
+			return
+		}
+		s.sendDiagnostics(c)
+
+		c.ID = id
+		s.AddClient(id)
+		s.resumeTokens[id] = token
+	}
+	// resumed connections may have missed changes to them too
+	s.sendAnnotations(c)
+	if s.run != nil {
+		c.Send(s.runningEvent())
+	}
+
 	s.Connections[c] = struct{}{}
-	s.AddClient(c.ID)
-	s.lock.Unlock()
 }
 
-func (s *Session) UnregisterConnection(c *Connection) {
-	s.lock.Lock()
+// otherClients returns all clients except the given one
+func (s *Session) otherClients(id string) map[string]*session.Client {
+	clients := make(map[string]*session.Client, len(s.Clients))
+	for cid, cl := range s.Clients {
+		if cid != id {
+			clients[cid] = cl
+		}
+	}
+	return clients
+}
+
+func (s *Session) docEvent(id, token string, role Role) *protocol.Doc {
+	return &protocol.Doc{
+		Document:    s.Document,
+		Revision:    len(s.Operations),
+		Clients:     s.otherClients(id),
+		ClientID:    id,
+		ResumeToken: token,
+		Role:        role.String(),
+		Units:       protocol.Units(),
+	}
+}
+
+func (s *Session) resumeClient(c *Connection, resume *Resume) bool {
+	id := resume.ClientID
+	if token, ok := s.resumeTokens[id]; !ok || token != resume.Token {
+		return false
+	}
+	// a leaked resume token must not let someone else take over the client
+	if cl := s.Clients[id]; cl != nil && c.Identity.Name != "" && cl.Name != c.Identity.Name {
+		return false
+	}
+	ops, err := s.OperationsSince(resume.Revision)
+	if err != nil {
+		return false
+	}
+
+	// the server may not have noticed yet that the old connection dropped
+	for conn := range s.Connections {
+		if conn.ID == id {
+			delete(s.Connections, conn)
+			conn.Close()
+		}
+	}
+
+	c.ID = id
+	delete(s.disconnected, id)
+
+	// replay what the client missed; its own operations are acknowledged
+	for i, op := range ops {
+		author := s.authors[resume.Revision+i]
+		var err error
+		if author == id {
+			err = c.Send(&protocol.OK{})
+		} else {
+			sel, _ := op.Meta.(*selection.Selection)
+			err = c.Send(&protocol.RemoteOp{ClientID: author, Operation: op, Selection: sel})
+		}
+		if err != nil {
+			break
+		}
+	}
+
+	c.Send(&protocol.Resumed{
+		ClientID: id,
+		Revision: len(s.Operations),
+		Clients:  s.otherClients(id),
+	})
+
+	return true
+}
+
+// unregisterConnection removes c from the session. The client is only
+// removed once the grace period passes without it resuming.
+func (s *Session) unregisterConnection(c *Connection) {
+	if _, ok := s.Connections[c]; !ok {
+		// never registered, or replaced by a resumed connection
+		return
+	}
 	delete(s.Connections, c)
-	if c.ID != "" {
-		s.RemoveClient(c.ID)
+	s.checkDrained()
+
+	if s.GracePeriod <= 0 {
+		s.removeClient(c.ID)
+		return
+	}
+
+	e := expiry{c.ID, time.Now()}
+	s.disconnected[e.clientID] = e.at
+	time.AfterFunc(s.GracePeriod, func() {
+		s.post(ConnEvent{Event: &Event{"expire", e}, internal: true})
+	})
+}
+
+// expiry ends the grace period of a client that was disconnected at a time
+type expiry struct {
+	clientID string
+	at       time.Time
+}
+
+func (s *Session) expireClient(e expiry) {
+	// the client may have resumed and dropped again in the meantime
+	if at, ok := s.disconnected[e.clientID]; ok && at == e.at {
+		s.removeClient(e.clientID)
+	}
+}
+
+func (s *Session) removeClient(id string) {
+	delete(s.disconnected, id)
+	delete(s.resumeTokens, id)
+	s.RemoveClient(id)
+	s.broadcast(&protocol.Quit{ClientID: id}, nil)
+}
+
+// broadcast sends msg to every connection except the given one
+func (s *Session) broadcast(msg protocol.Message, except *Connection) {
+	enc := newEncoded(msg)
+	for conn := range s.Connections {
+		if conn == except {
+			continue
+		}
+		if j, err := enc.in(conn.Protocol); err == nil {
+			conn.enqueue(j)
+		}
+	}
+	if s.spectators.Len() > 0 {
+		s.spectators.send(spectatorCmd{kind: spectatorSend, msg: encodeAll(msg)}, s.done)
 	}
-	s.lock.Unlock()
+}
+
+func newResumeToken() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
 }
 
 func (s *Session) HandleEvents() {
 	// this method should run in a single go routine
+	s.MaxDocumentLength = s.Limits.MaxDocumentLength
+	s.opBucket = newTokenBucket(s.Limits.DocOpsPerSecond, s.Limits.DocOpBurst)
+	go s.spectators.run(s.done)
+	s.scheduleCheck()
+
 	for {
-		e, ok := <-s.EventChan
-		if !ok {
+		var e ConnEvent
+		select {
+		case e = <-s.EventChan:
+		case <-s.done:
 			return
 		}
 
 		c := e.Conn
-		switch e.Name {
-		case "join":
-			data, ok := e.Data.(map[string]interface{})
-			if !ok {
-				break
-			}
-			username, ok := data["username"].(string)
-			if !ok || username == "" {
-				break
+		if e.internal {
+			switch e.Name {
+			case "register":
+				resume, _ := e.Data.(*Resume)
+				s.registerConnection(c, resume)
+			case "unregister":
+				s.unregisterConnection(c)
+			case "spectate":
+				s.addSpectator(c)
+			case "expire":
+				s.expireClient(e.Data.(expiry))
+			case "resync":
+				s.handleResync(c)
+			case "formatted":
+				s.handleFormatted(e.Data.(*formatting))
+			case "check":
+				s.startCheck(e.Data.(int))
+			case "checked":
+				s.handleChecked(e.Data.(*diagnosis))
+			case "output":
+				s.broadcast(e.Data.(*protocol.Output), nil)
+			case "exited":
+				s.handleExited(e.Data.(*runResult))
+			case "call":
+				e.Data.(func())()
 			}
+			continue
+		}
+		if _, ok := s.Connections[c]; !ok {
+			// read before c was replaced by a resumed connection, whose
+			// client resends whatever is still unacknowledged
+			continue
+		}
 
-			s.SetName(c.ID, username)
+		var err *EventError
+		switch m := e.Data.(type) {
+		case *protocol.Join:
+			err = s.handleJoin(c, m)
+		case *protocol.Op:
+			err = s.handleOp(c, m)
+		case *protocol.Sel:
+			err = s.handleSel(c, m)
+		case *protocol.Resync:
+			s.handleResync(c)
+		case *protocol.Format:
+			err = s.handleFormat(c)
+		case *protocol.Run:
+			err = s.handleRun(c)
+		case *protocol.Stop:
+			err = s.handleStop(c)
+		case *protocol.Comment:
+			err = s.handleComment(c, m)
+		case *protocol.Reply:
+			err = s.handleReply(c, m)
+		case *protocol.Resolve:
+			err = s.handleResolve(c, m)
+		default:
+			err = newEventError(ErrCodeUnknownEvent, "unknown event")
+		}
 
-			err := c.Send(&Event{"registered", c.ID})
-			if err != nil {
-				break
-			}
-			c.Broadcast(&Event{"join", map[string]interface{}{
-				"client_id": c.ID,
-				"username":  username,
-			}})
-		case "op":
-			// data: [revision, ops, selection?]
-			data, ok := e.Data.([]interface{})
-			if !ok {
-				break
-			}
-			if len(data) < 2 {
-				break
-			}
-			// revision
-			revf, ok := data[0].(float64)
-			rev := int(revf)
-			if !ok {
-				break
-			}
-			// ops
-			ops, ok := data[1].([]interface{})
-			if !ok {
-				break
-			}
-			top, err := operation.Unmarshal(ops)
-			if err != nil {
-				break
-			}
-			// selection (optional)
-			if len(data) >= 3 {
-				selm, ok := data[2].(map[string]interface{})
-				if !ok {
-					break
-				}
-				sel, err := selection.Unmarshal(selm)
-				if err != nil {
-					break
-				}
-				top.Meta = sel
-			}
+		if err != nil {
+			err.Event = e.Name
+			c.Send(err.event())
+		}
+	}
+}
 
-			top2, err := s.AddOperation(rev, top)
-			if err != nil {
-				break
-			}
+func (s *Session) handleJoin(c *Connection, m *protocol.Join) *EventError {
+	username := m.Username
+	if c.Identity.Name != "" {
+		// verified by the authenticator
+		username = c.Identity.Name
+	}
 
-			err = c.Send(&Event{"ok", nil})
-			if err != nil {
-				break
-			}
+	s.SetName(c.ID, username)
 
-			if sel, ok := top2.Meta.(*selection.Selection); ok {
-				s.SetSelection(c.ID, sel)
-				c.Broadcast(&Event{"op", []interface{}{c.ID, top2.Marshal(), sel.Marshal()}})
-			} else {
-				c.Broadcast(&Event{"op", []interface{}{c.ID, top2.Marshal()}})
-			}
-		case "sel":
-			data, ok := e.Data.(map[string]interface{})
-			if !ok {
-				break
-			}
-			sel, err := selection.Unmarshal(data)
-			if err != nil {
-				break
-			}
-			s.SetSelection(c.ID, sel)
-			c.Broadcast(&Event{"sel", []interface{}{c.ID, sel.Marshal()}})
+	err := c.Send(&protocol.Registered{ClientID: c.ID})
+	if err != nil {
+		return nil
+	}
+	s.broadcast(&protocol.Joined{ClientID: c.ID, Username: username}, c)
+	return nil
+}
+
+func (s *Session) handleOp(c *Connection, m *protocol.Op) *EventError {
+	if !c.Identity.Role.CanEdit() {
+		return newEventError(ErrCodeForbidden, c.Identity.Role.String()+" may not edit the document")
+	}
+	if !s.allowOp(c) {
+		return newEventError(ErrCodeRateLimited, "too many operations, slow down")
+	}
+	if m.Selection != nil {
+		if eerr := s.checkSelection(m.Selection); eerr != nil {
+			return eerr
 		}
+		m.Operation.Meta = m.Selection
+	}
+
+	if _, eerr := s.applyOperation(c.ID, c, m.Revision, m.Operation); eerr != nil {
+		s.refundOp(c, eerr)
+		return eerr
+	}
+	c.Send(&protocol.OK{})
+	return nil
+}
+
+// allowOp reports whether c may submit another operation now
+func (s *Session) allowOp(c *Connection) bool {
+	if c.opBucket == nil {
+		c.opBucket = newTokenBucket(s.Limits.OpsPerSecond, s.Limits.OpBurst)
+	}
+	return c.opBucket.allow(time.Now())
+}
+
+// refundOp gives c back the token allowOp took if the document's rate limit
+// refused the operation, so that it does not count against c's own
+func (s *Session) refundOp(c *Connection, eerr *EventError) {
+	if eerr.Code == ErrCodeRateLimited {
+		c.opBucket.refund()
+	}
+}
+
+// applyOperation transforms op, which is based on revision, applies it and
+// broadcasts it to every connection but c. author is the id of the client
+// that made it, or empty for edits made through the http api.
+func (s *Session) applyOperation(author string, c *Connection, revision int, op *operation.Operation) (*operation.Operation, *EventError) {
+	if !s.opBucket.allow(time.Now()) {
+		return nil, newEventError(ErrCodeRateLimited, "too many operations on this document, slow down")
+	}
+
+	top, err := s.AddClientOperation(author, revision, op)
+	if err != nil {
+		return nil, operationError(err)
+	}
+
+	s.authors = append(s.authors, author)
+	if len(s.diagnostics) > 0 {
+		s.diagnostics = transformDiagnostics(s.diagnostics, top)
+	}
+	s.scheduleCheck()
+
+	sel, _ := top.Meta.(*selection.Selection)
+	if author == "" {
+		sel = nil
+	} else if sel != nil {
+		// a selection that cannot be repaired is dropped, not the edit
+		if sel, err = s.SetSelection(author, sel); err != nil {
+			sel, top.Meta = nil, nil
+		} else {
+			top.Meta = sel
+		}
+	}
+	s.broadcast(&protocol.RemoteOp{ClientID: author, Operation: top, Selection: sel}, c)
+	return top, nil
+}
+
+// handleResync sends the whole document to a client that fell behind or
+// asked for it
+func (s *Session) handleResync(c *Connection) {
+	if !c.Spectator {
+		c.sendResync(s.docEvent(c.ID, s.resumeTokens[c.ID], c.Identity.Role))
+		s.sendDiagnostics(c)
+		s.sendAnnotations(c)
+		return
+	}
+	// the hub may still hold events older than the snapshot
+	if j, err := protocol.Encode(c.Protocol, s.docEvent("", "", c.Identity.Role)); err == nil {
+		s.spectators.send(spectatorCmd{spectatorResync, c, map[protocol.Protocol][]byte{c.Protocol: j}}, s.done)
+	}
+}
+
+// handleSel moves c's selection. A nil selection, sent by ot.js when the
+// editor loses focus, clears it.
+func (s *Session) handleSel(c *Connection, m *protocol.Sel) *EventError {
+	sel, eerr := s.setSelection(c.ID, m.Selection)
+	if eerr != nil {
+		return eerr
+	}
+	s.broadcast(&protocol.RemoteSel{ClientID: c.ID, Selection: sel}, c)
+	return nil
+}
+
+// setSelection checks and normalizes sel, and makes it the selection of the
+// client id. A nil sel clears the selection. It returns the selection to
+// broadcast.
+func (s *Session) setSelection(id string, sel *selection.Selection) (*selection.Selection, *EventError) {
+	if sel == nil {
+		s.SetSelection(id, &selection.Selection{Ranges: []selection.Range{}})
+		return nil, nil
+	}
+	if eerr := s.checkSelection(sel); eerr != nil {
+		return nil, eerr
+	}
+	sel, err := s.SetSelection(id, sel)
+	if err != nil {
+		return nil, newEventError(ErrCodeInvalidRange, err.Error())
+	}
+	return sel, nil
+}
+
+func (s *Session) checkSelection(sel *selection.Selection) *EventError {
+	if max := s.Limits.MaxSelectionRanges; max > 0 && len(sel.Ranges) > max {
+		return newEventError(ErrCodeTooManyRanges, "selection has more than "+strconv.Itoa(max)+" ranges")
 	}
+	return nil
 }
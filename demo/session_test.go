@@ -0,0 +1,482 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/nitrous-io/ot.go/demo/protocol"
+	"github.com/nitrous-io/ot.go/demo/wsclient"
+	"github.com/nitrous-io/ot.go/ot/operation"
+	"github.com/nitrous-io/ot.go/ot/selection"
+	"github.com/nitrous-io/ot.go/ot/session"
+)
+
+func TestResume(t *testing.T) {
+	srv, _ := newTestServer(t, "hello", nil)
+	defer srv.Close()
+
+	alice := dialAndJoin(t, srv, "alice")
+	defer alice.Close()
+	bob := dialAndJoin(t, srv, "bob")
+	defer bob.Close()
+
+	aliceID := alice.ID()
+
+	// alice's connection drops
+	alice.Close()
+	if err := alice.Wait(testTimeout, func(c *wsclient.Client) bool { return c.Err() != nil }); err != nil {
+		t.Fatalf("expected alice's connection to be closed")
+	}
+
+	// bob keeps editing, alice edits offline
+	if err := bob.Submit(operation.New().Retain(5).Insert(" world"), nil); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if err := bob.WaitSynchronized(testTimeout); err != nil {
+		t.Fatalf("expected bob to synchronize, got %v", err)
+	}
+	if err := alice.Submit(operation.New().Delete(1).Insert("H").Retain(4), nil); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	if err := alice.Reconnect(); err != nil {
+		t.Fatalf("expected no error reconnecting, got %v", err)
+	}
+
+	for _, c := range []*wsclient.Client{alice, bob} {
+		if err := c.WaitRevision(2, testTimeout); err != nil {
+			t.Fatalf("expected client to reach revision 2, got %v", err)
+		}
+		if err := c.WaitSynchronized(testTimeout); err != nil {
+			t.Fatalf("expected client to synchronize, got %v", err)
+		}
+		if actual, expected := c.Document(), "Hello world"; actual != expected {
+			t.Errorf("expected document to be %s, got %s", expected, actual)
+		}
+	}
+
+	// alice kept the same identity, and bob never saw alice leave
+	if actual, expected := alice.ID(), aliceID; actual != expected {
+		t.Errorf("expected alice's id to be %s, got %s", expected, actual)
+	}
+	if actual, expected := bob.Clients()[aliceID].Name, "alice"; actual != expected {
+		t.Errorf("expected bob to still know alice as %s, got %q", expected, actual)
+	}
+	if actual, expected := alice.Clients()[bob.ID()].Name, "bob"; actual != expected {
+		t.Errorf("expected alice to still know bob as %s, got %q", expected, actual)
+	}
+
+	// an edit that was applied but whose acknowledgement was lost is not
+	// applied twice: the server replays it to its author as "ok"
+	alice.Submit(operation.New().Retain(11).Insert("!"), nil)
+	if err := bob.WaitRevision(3, testTimeout); err != nil {
+		t.Fatalf("expected bob to reach revision 3, got %v", err)
+	}
+	alice.Close()
+	alice.Wait(testTimeout, func(c *wsclient.Client) bool { return c.Err() != nil })
+
+	if err := alice.Reconnect(); err != nil {
+		t.Fatalf("expected no error reconnecting, got %v", err)
+	}
+	if err := alice.WaitSynchronized(testTimeout); err != nil {
+		t.Fatalf("expected alice to synchronize, got %v", err)
+	}
+	if actual, expected := alice.Document(), "Hello world!"; actual != expected {
+		t.Errorf("expected document to be %s, got %s", expected, actual)
+	}
+	if actual, expected := alice.Revision(), 3; actual != expected {
+		t.Errorf("expected revision to be %d, got %d", expected, actual)
+	}
+}
+
+func TestResumeAfterGracePeriod(t *testing.T) {
+	srv, _ := newTestServer(t, "hello", func(s *Session) {
+		s.GracePeriod = 50 * time.Millisecond
+	})
+	defer srv.Close()
+
+	alice := dialAndJoin(t, srv, "alice")
+	defer alice.Close()
+	bob := dialAndJoin(t, srv, "bob")
+	defer bob.Close()
+
+	aliceID := alice.ID()
+	alice.Close()
+
+	// bob sees alice quit once the grace period is over
+	err := bob.Wait(testTimeout, func(c *wsclient.Client) bool {
+		_, ok := c.Clients()[aliceID]
+		return !ok
+	})
+	if err != nil {
+		t.Fatalf("expected alice to quit, got %v", err)
+	}
+
+	if err = bob.Submit(operation.New().Retain(5).Insert("!"), nil); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if err = bob.WaitSynchronized(testTimeout); err != nil {
+		t.Fatalf("expected bob to synchronize, got %v", err)
+	}
+
+	// too late to resume, so alice starts over with the whole document
+	if err = alice.Reconnect(); err != nil {
+		t.Fatalf("expected no error reconnecting, got %v", err)
+	}
+	err = alice.Wait(testTimeout, func(c *wsclient.Client) bool {
+		return c.Revision() == 1
+	})
+	if err != nil {
+		t.Fatalf("expected alice to receive the document, got %v", err)
+	}
+	if actual, expected := alice.Document(), "hello!"; actual != expected {
+		t.Errorf("expected document to be %s, got %s", expected, actual)
+	}
+	if actual := alice.ID(); actual != "" {
+		t.Errorf("expected alice to have to join again, got id %s", actual)
+	}
+}
+
+func TestResumeIgnoresReplacedConnection(t *testing.T) {
+	srv, s := newTestServer(t, "hello", nil)
+	defer srv.Close()
+
+	alice := dialAndJoin(t, srv, "alice")
+	defer alice.Close()
+
+	var old *Connection
+	s.Call(func() {
+		for c := range s.Connections {
+			old = c
+		}
+	})
+
+	// alice's connection drops before the server handles her edit, which she
+	// resends after resuming
+	alice.Close()
+	alice.Wait(testTimeout, func(c *wsclient.Client) bool { return c.Err() != nil })
+	op := operation.New().Retain(5).Insert("!")
+	if err := alice.Submit(op, nil); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if err := alice.Reconnect(); err != nil {
+		t.Fatalf("expected no error reconnecting, got %v", err)
+	}
+	if err := alice.WaitSynchronized(testTimeout); err != nil {
+		t.Fatalf("expected alice to synchronize, got %v", err)
+	}
+
+	// the old connection had read the edit too
+	s.post(ConnEvent{Conn: old, Event: &Event{"op", &protocol.Op{Revision: 0, Operation: op}}})
+
+	s.Call(func() {
+		if actual, expected := s.Document, "hello!"; actual != expected {
+			t.Errorf("expected document %q, got %q", expected, actual)
+		}
+		if actual, expected := len(s.Operations), 1; actual != expected {
+			t.Errorf("expected %d operation, got %d", expected, actual)
+		}
+	})
+}
+
+// readOnlyObserver vetoes every operation
+type readOnlyObserver struct {
+	session.NopObserver
+}
+
+func (readOnlyObserver) Veto(revision int, author string, op *operation.Operation) error {
+	return errors.New("the document is frozen")
+}
+
+func TestVetoedOperation(t *testing.T) {
+	srv, s := newTestServer(t, "hello", nil)
+	defer srv.Close()
+	s.Call(func() { s.AddObserver(readOnlyObserver{}) })
+
+	ws := dialRaw(t, srv)
+	defer ws.Close()
+
+	if actual, expected := sendRaw(t, ws, `{"e": "op", "d": [0, [5, "!"]]}`), ErrCodeVetoed; actual != expected {
+		t.Errorf("expected %s, got %q", expected, actual)
+	}
+	s.Call(func() {
+		if actual, expected := s.Document, "hello"; actual != expected {
+			t.Errorf("expected document %q, got %q", expected, actual)
+		}
+	})
+}
+
+func TestErrorEvents(t *testing.T) {
+	srv, _ := newTestServer(t, "hello", nil)
+	defer srv.Close()
+
+	ws := dialRaw(t, srv)
+	defer ws.Close()
+
+	for _, tc := range []struct {
+		msg   string
+		code  string
+		event string
+	}{
+		{`not json`, ErrCodeMalformedEvent, ""},
+		{`{"e": "foo", "d": 1}`, ErrCodeUnknownEvent, "foo"},
+		{`{"e": "join", "d": "alice"}`, ErrCodeMalformedJoin, "join"},
+		{`{"e": "join", "d": {"username": ""}}`, ErrCodeMalformedJoin, "join"},
+		{`{"e": "op", "d": "abc"}`, ErrCodeMalformedOp, "op"},
+		{`{"e": "op", "d": [0]}`, ErrCodeMalformedOp, "op"},
+		{`{"e": "op", "d": [0, 5]}`, ErrCodeMalformedOp, "op"},
+		{`{"e": "op", "d": [0, [5, true]]}`, ErrCodeMalformedOp, "op"},
+		{`{"e": "op", "d": ["0", [5]]}`, ErrCodeInvalidRevision, "op"},
+		{`{"e": "op", "d": [0.5, [5]]}`, ErrCodeInvalidRevision, "op"},
+		{`{"e": "op", "d": [-1, [5]]}`, ErrCodeInvalidRevision, "op"},
+		{`{"e": "op", "d": [1, [5]]}`, ErrCodeInvalidRevision, "op"},
+		{`{"e": "op", "d": [0, [6]]}`, ErrCodeBaseLenMismatch, "op"},
+		{`{"e": "op", "d": [0, [5], "x"]}`, ErrCodeMalformedSelection, "op"},
+		{`{"e": "op", "d": [0, [5], {"ranges": [{"anchor": 1}]}]}`, ErrCodeMalformedSelection, "op"},
+		{`{"e": "sel", "d": [1, 2]}`, ErrCodeMalformedSelection, "sel"},
+		{`{"e": "sel", "d": {"ranges": 1}}`, ErrCodeMalformedSelection, "sel"},
+		// decoding is strict
+		{`{"e": "op", "d": [0, [5]], "x": 1}`, ErrCodeMalformedEvent, ""},
+		{`{"e": "op", "d": [0, [5]]} {}`, ErrCodeMalformedEvent, ""},
+		{`{"d": [0, [5]]}`, ErrCodeMalformedEvent, ""},
+		{`{"e": "join", "d": {"username": "alice", "admin": true}}`, ErrCodeMalformedJoin, "join"},
+		{`{"e": "op", "d": [0, [5, 0]]}`, ErrCodeMalformedOp, "op"},
+		{`{"e": "op", "d": [0, [5.5]]}`, ErrCodeMalformedOp, "op"},
+		{`{"e": "op", "d": [0, [5, ""]]}`, ErrCodeMalformedOp, "op"},
+		{`{"e": "op", "d": [0, [5], null, 1]}`, ErrCodeMalformedOp, "op"},
+		{`{"e": "sel", "d": {"ranges": [{"anchor": -2, "head": -1}]}}`, ErrCodeInvalidRange, "sel"},
+		{`{"e": "sel", "d": {"ranges": [], "primary": 0}}`, ErrCodeMalformedSelection, "sel"},
+		{`{"e": "sel", "d": {"ranges": [{"anchor": 6, "head": 9}]}}`, ErrCodeInvalidRange, "sel"},
+		{`{"e": "resync", "d": 1}`, ErrCodeMalformedEvent, "resync"},
+	} {
+		if err := ws.WriteMessage(websocket.TextMessage, []byte(tc.msg)); err != nil {
+			t.Fatalf("expected no error sending, got %v", err)
+		}
+
+		e := readRaw(t, ws)
+		if e.Name != "error" {
+			t.Errorf("expected error event for %s, got %s", tc.msg, e.Name)
+			continue
+		}
+
+		var eerr EventError
+		if err := json.Unmarshal(e.Data, &eerr); err != nil {
+			t.Fatalf("expected no error decoding error event, got %v", err)
+		}
+		if actual, expected := eerr.Code, tc.code; actual != expected {
+			t.Errorf("expected code %s for %s, got %s", expected, tc.msg, actual)
+		}
+		if actual, expected := eerr.Event, tc.event; actual != expected {
+			t.Errorf("expected event %q for %s, got %q", expected, tc.msg, actual)
+		}
+		if eerr.Message == "" {
+			t.Errorf("expected a message for %s, got none", tc.msg)
+		}
+	}
+
+	// the connection is still usable after errors
+	ws.WriteMessage(websocket.TextMessage, []byte(`{"e": "op", "d": [0, [5, "!"]]}`))
+	if e := readRaw(t, ws); e.Name != "ok" {
+		t.Errorf("expected ok event, got %s", e.Name)
+	}
+}
+
+// TestOtJSMessages checks messages the ot.js client sends that other clients
+// never do
+func TestOtJSMessages(t *testing.T) {
+	srv, _ := newTestServer(t, "hello", nil)
+	defer srv.Close()
+
+	bob := dialAndJoin(t, srv, "bob")
+	defer bob.Close()
+
+	ws := dialRaw(t, srv)
+	defer ws.Close()
+	ws.WriteMessage(websocket.TextMessage, []byte(`{"e": "join", "d": {"username": "alice"}}`))
+	for readRaw(t, ws).Name != "registered" {
+	}
+
+	// an op without a selection has null in its place
+	if code := sendRaw(t, ws, `{"e": "op", "d": [0, [5, "!"], null]}`); code != "" {
+		t.Errorf("expected op to be acknowledged, got %s", code)
+	}
+
+	ws.WriteMessage(websocket.TextMessage, []byte(`{"e": "sel", "d": {"ranges": [{"anchor": 1, "head": 3}]}}`))
+	var alice string
+	err := bob.Wait(testTimeout, func(c *wsclient.Client) bool {
+		for id, cl := range c.Clients() {
+			if cl.Name == "alice" && len(cl.Selection.Ranges) == 1 {
+				alice = id
+				return true
+			}
+		}
+		return false
+	})
+	if err != nil {
+		t.Fatalf("expected bob to see alice's selection, got %v", err)
+	}
+
+	// the editor losing focus clears the selection
+	ws.WriteMessage(websocket.TextMessage, []byte(`{"e": "sel", "d": null}`))
+	err = bob.Wait(testTimeout, func(c *wsclient.Client) bool {
+		return len(c.Clients()[alice].Selection.Ranges) == 0
+	})
+	if err != nil {
+		t.Errorf("expected alice's selection to be cleared, got %v", err)
+	}
+}
+
+func TestSelectionNormalized(t *testing.T) {
+	srv, _ := newTestServer(t, "hello", nil)
+	defer srv.Close()
+
+	alice := dialAndJoin(t, srv, "alice")
+	defer alice.Close()
+	bob := dialAndJoin(t, srv, "bob")
+	defer bob.Close()
+
+	// others see the selection clamped to the document, sorted and merged
+	if err := alice.SetSelection(&selection.Selection{Ranges: []selection.Range{{Anchor: 9, Head: 2}, {Anchor: 0, Head: 1}, {Anchor: 3, Head: 4}}}); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	expected := []selection.Range{{Anchor: 5, Head: 2}, {Anchor: 0, Head: 1}}
+	err := bob.Wait(testTimeout, func(c *wsclient.Client) bool {
+		return reflect.DeepEqual(c.Clients()[alice.ID()].Selection.Ranges, expected)
+	})
+	if err != nil {
+		t.Errorf("expected bob to see %+v, got %+v", expected, bob.Clients()[alice.ID()].Selection.Ranges)
+	}
+
+	// negative positions are clamped too
+	ws := dialRaw(t, srv)
+	defer ws.Close()
+	ws.WriteMessage(websocket.TextMessage, []byte(`{"e": "join", "d": {"username": "carol"}}`))
+	for readRaw(t, ws).Name != "registered" {
+	}
+	ws.WriteMessage(websocket.TextMessage, []byte(`{"e": "sel", "d": {"ranges": [{"anchor": -3, "head": 2}]}}`))
+	expected = []selection.Range{{Anchor: 0, Head: 2}}
+	err = bob.Wait(testTimeout, func(c *wsclient.Client) bool {
+		for _, cl := range c.Clients() {
+			if cl.Name == "carol" && reflect.DeepEqual(cl.Selection.Ranges, expected) {
+				return true
+			}
+		}
+		return false
+	})
+	if err != nil {
+		t.Errorf("expected bob to see carol's selection %+v, got %v", expected, err)
+	}
+}
+
+func TestClientSeesErrors(t *testing.T) {
+	srv, _ := newTestServer(t, "hello", nil)
+	defer srv.Close()
+
+	c, err := wsclient.Dial(wsURL(srv))
+	if err != nil {
+		t.Fatalf("expected no error dialing, got %v", err)
+	}
+	defer c.Close()
+
+	c.Join("", 100*time.Millisecond)
+
+	var errs []wsclient.ServerError
+	err = c.Wait(testTimeout, func(c *wsclient.Client) bool {
+		errs = c.ServerErrors()
+		return len(errs) > 0
+	})
+	if err != nil {
+		t.Fatalf("expected client to receive an error, got %v", err)
+	}
+	if actual, expected := errs[0], (wsclient.ServerError{
+		Code:    ErrCodeMalformedJoin,
+		Message: "username must be a non-empty string",
+		Event:   "join",
+	}); actual != expected {
+		t.Errorf("expected %+v, got %+v", expected, actual)
+	}
+}
+
+// TestConcurrentClients is most useful with go test -race
+func TestConcurrentClients(t *testing.T) {
+	r := NewRegistry(StaticSource(""))
+	r.GracePeriod = 0
+	srv := httptest.NewServer(newRouter(r))
+	defer srv.Close()
+
+	const n, edits = 20, 5
+
+	clients := make([]*wsclient.Client, n)
+	var wg sync.WaitGroup
+	for i := range clients {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			c, err := wsclient.Dial(wsURL(srv) + "/ws/concurrent")
+			if err != nil {
+				t.Errorf("expected no error dialing, got %v", err)
+				return
+			}
+			if err = c.Join("client", testTimeout); err != nil {
+				t.Errorf("expected no error joining, got %v", err)
+				c.Close()
+				return
+			}
+
+			for j := 0; j < edits; j++ {
+				op := operation.New().Insert("x").Retain(len(c.Document()))
+				sel := &selection.Selection{Ranges: []selection.Range{{Anchor: 1, Head: 1}}}
+				if err = c.Submit(op, sel); err != nil {
+					t.Errorf("expected no error submitting, got %v", err)
+				}
+				c.SetSelection(sel)
+			}
+
+			// every other client leaves as soon as its edits are acknowledged
+			if err = c.WaitSynchronized(testTimeout); err != nil {
+				t.Errorf("expected client to synchronize, got %v", err)
+			}
+			if i%2 == 1 {
+				c.Close()
+				return
+			}
+			clients[i] = c
+		}(i)
+	}
+	wg.Wait()
+
+	// edits composed while awaiting an acknowledgement share a revision, so
+	// compare with the server rather than counting
+	sess, _ := r.Acquire("concurrent")
+	defer r.Release("concurrent")
+
+	var doc string
+	var revision int
+	sess.Call(func() {
+		doc, revision = sess.Document, len(sess.Operations)
+	})
+	if actual, expected := len(doc), n*edits; actual != expected {
+		t.Errorf("expected document length %d, got %d", expected, actual)
+	}
+
+	for _, c := range clients {
+		if c == nil {
+			continue
+		}
+		defer c.Close()
+
+		if err := c.WaitRevision(revision, testTimeout); err != nil {
+			t.Fatalf("expected client to reach revision %d, got %v", revision, err)
+		}
+		if actual, expected := c.Document(), doc; actual != expected {
+			t.Errorf("expected document to be %s, got %s", expected, actual)
+		}
+	}
+}
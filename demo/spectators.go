@@ -0,0 +1,121 @@
+package main
+
+import (
+	"sync/atomic"
+
+	"github.com/nitrous-io/ot.go/demo/protocol"
+)
+
+// spectatorHub fans events out to the session's spectators in its own go
+// routine, so that the event loop only hands over each event once no matter
+// how many spectators there are.
+//
+// Commands are handled in the order the event loop sends them, which keeps a
+// spectator's document snapshot consistent with the events that follow it.
+type spectatorHub struct {
+	cmds  chan spectatorCmd
+	count int64 // number of spectators, counting those being added, read with atomic
+}
+
+type spectatorCmdKind int
+
+const (
+	spectatorAdd      spectatorCmdKind = iota // send msg to conn, then add it
+	spectatorRemove                           // remove conn
+	spectatorSend                             // send msg to every spectator
+	spectatorResync                           // end conn's resync with msg
+	spectatorShutdown                         // send msg to every spectator and close them
+)
+
+type spectatorCmd struct {
+	kind spectatorCmdKind
+	conn *Connection
+	msg  map[protocol.Protocol][]byte // the event in each protocol, see encodeAll
+}
+
+// msgFor returns the event in c's protocol
+func (cmd *spectatorCmd) msgFor(c *Connection) ([]byte, bool) {
+	msg, ok := cmd.msg[c.Protocol]
+	return msg, ok && msg != nil
+}
+
+func newSpectatorHub() *spectatorHub {
+	return &spectatorHub{
+		cmds: make(chan spectatorCmd, 1024),
+	}
+}
+
+// Len returns the number of spectators.
+func (h *spectatorHub) Len() int {
+	return int(atomic.LoadInt64(&h.count))
+}
+
+func (h *spectatorHub) run(done <-chan struct{}) {
+	spectators := map[*Connection]struct{}{}
+	remove := func(c *Connection) {
+		if _, ok := spectators[c]; ok {
+			delete(spectators, c)
+			atomic.AddInt64(&h.count, -1)
+		}
+	}
+
+	for {
+		var cmd spectatorCmd
+		select {
+		case cmd = <-h.cmds:
+		case <-done:
+			return
+		}
+
+		switch cmd.kind {
+		case spectatorAdd:
+			msg, ok := cmd.msgFor(cmd.conn)
+			if !ok {
+				cmd.conn.Close()
+			}
+			if ok && cmd.conn.enqueue(msg) == nil {
+				spectators[cmd.conn] = struct{}{}
+			} else {
+				atomic.AddInt64(&h.count, -1)
+			}
+		case spectatorRemove:
+			remove(cmd.conn)
+		case spectatorSend:
+			for c := range spectators {
+				if msg, ok := cmd.msgFor(c); ok && c.enqueue(msg) == ErrConnectionClosed {
+					remove(c)
+				}
+			}
+		case spectatorResync:
+			if _, ok := spectators[cmd.conn]; ok {
+				if msg, ok := cmd.msgFor(cmd.conn); ok {
+					cmd.conn.resynced(msg)
+				}
+			}
+		case spectatorShutdown:
+			for c := range spectators {
+				if msg, ok := cmd.msgFor(c); ok {
+					c.enqueue(msg)
+				}
+				c.closeGoingAway()
+				remove(c)
+			}
+		}
+	}
+}
+
+// add queues c for the hub, to be sent msg, the document in each protocol. c
+// counts as a spectator from then on, so that the events that follow msg are
+// sent to the hub.
+func (h *spectatorHub) add(c *Connection, msg map[protocol.Protocol][]byte, done <-chan struct{}) {
+	atomic.AddInt64(&h.count, 1)
+	h.send(spectatorCmd{spectatorAdd, c, msg}, done)
+}
+
+// send queues cmd for the hub, or drops it once done is closed.
+func (h *spectatorHub) send(cmd spectatorCmd, done <-chan struct{}) {
+	select {
+	case h.cmds <- cmd:
+	case <-done:
+	}
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nitrous-io/ot.go/demo/wsclient"
+	"github.com/nitrous-io/ot.go/ot/operation"
+	"github.com/nitrous-io/ot.go/ot/selection"
+)
+
+func TestSpectators(t *testing.T) {
+	srv, s := newTestServer(t, "hello", func(s *Session) {
+		s.GracePeriod = 0
+	})
+	defer srv.Close()
+
+	alice := dialAndJoin(t, srv, "alice")
+	defer alice.Close()
+
+	const n = 200
+
+	spectators := make([]*wsclient.Client, n)
+	var wg sync.WaitGroup
+	for i := range spectators {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			c, err := wsclient.Dial(wsURL(srv) + "?spectate=1")
+			if err != nil {
+				t.Errorf("expected no error dialing, got %v", err)
+				return
+			}
+			spectators[i] = c
+		}(i)
+	}
+	wg.Wait()
+	for _, c := range spectators {
+		if c == nil {
+			t.FailNow()
+		}
+		defer c.Close()
+	}
+
+	deadline := time.Now().Add(testTimeout)
+	for s.Spectators() != n {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected %d spectators, got %d", n, s.Spectators())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// spectators are not clients
+	var clients int
+	s.Call(func() {
+		clients = len(s.Clients)
+	})
+	if actual, expected := clients, 1; actual != expected {
+		t.Errorf("expected %d client, got %d", expected, actual)
+	}
+	if actual, expected := len(alice.Clients()), 0; actual != expected {
+		t.Errorf("expected alice to see %d other clients, got %d", expected, actual)
+	}
+
+	bob := dialAndJoin(t, srv, "bob")
+	bobID := bob.ID()
+
+	sel := &selection.Selection{Ranges: []selection.Range{{Anchor: 11, Head: 11}}}
+	if err := alice.Submit(operation.New().Retain(5).Insert(" world"), sel); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if err := alice.WaitSynchronized(testTimeout); err != nil {
+		t.Fatalf("expected alice to synchronize, got %v", err)
+	}
+	bob.Close()
+
+	// every spectator follows the edit, alice's cursor, and bob coming and
+	// going
+	for _, c := range spectators {
+		err := c.Wait(testTimeout, func(c *wsclient.Client) bool {
+			clients := c.Clients()
+			_, bobThere := clients[bobID]
+			return c.Document() == "hello world" && !bobThere &&
+				len(clients[alice.ID()].Selection.Ranges) == 1
+		})
+		if err != nil {
+			t.Fatalf("expected spectator to follow the session, got %v", err)
+		}
+	}
+
+	// spectators cannot send events
+	spectators[0].SetSelection(sel)
+	var errs []wsclient.ServerError
+	err := spectators[0].Wait(testTimeout, func(c *wsclient.Client) bool {
+		errs = c.ServerErrors()
+		return len(errs) > 0
+	})
+	if err != nil {
+		t.Fatalf("expected spectator to receive an error, got %v", err)
+	}
+	if actual, expected := errs[0].Code, ErrCodeForbidden; actual != expected {
+		t.Errorf("expected code %s, got %s", expected, actual)
+	}
+	if actual, expected := len(alice.Clients()), 0; actual != expected {
+		t.Errorf("expected alice to see %d other clients, got %d", expected, actual)
+	}
+
+	// closed spectators are forgotten
+	for _, c := range spectators {
+		c.Close()
+	}
+	deadline = time.Now().Add(testTimeout)
+	for s.Spectators() != 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected no spectators, got %d", s.Spectators())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
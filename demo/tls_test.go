@@ -0,0 +1,113 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/nitrous-io/ot.go/demo/wsclient"
+	"github.com/nitrous-io/ot.go/ot/operation"
+)
+
+func TestTLS(t *testing.T) {
+	cert, err := selfSignedCert([]string{"127.0.0.1", "localhost"}, time.Hour)
+	if err != nil {
+		t.Fatalf("expected no error generating certificate, got %v", err)
+	}
+
+	srv := httptest.NewUnstartedServer(newRouter(NewRegistry(StaticSource("hello"))))
+	srv.TLS = &tls.Config{Certificates: []tls.Certificate{cert}}
+	// the untrusted handshake below is logged otherwise
+	srv.Config.ErrorLog = log.New(ioutil.Discard, "", 0)
+	srv.StartTLS()
+	defer srv.Close()
+
+	url := wsURL(srv) + "/ws/foo"
+	if !strings.HasPrefix(url, "wss://") {
+		t.Fatalf("expected a wss url, got %s", url)
+	}
+
+	// the certificate is not trusted by default
+	if _, err = wsclient.Dial(url); err == nil {
+		t.Errorf("expected dialing with an untrusted certificate to fail")
+	}
+
+	pool := x509.NewCertPool()
+	pool.AddCert(cert.Leaf)
+	dialer := &websocket.Dialer{TLSClientConfig: &tls.Config{RootCAs: pool}}
+
+	c, err := wsclient.DialWith(dialer, url)
+	if err != nil {
+		t.Fatalf("expected no error dialing, got %v", err)
+	}
+	defer c.Close()
+
+	if err = c.Join("alice", testTimeout); err != nil {
+		t.Fatalf("expected no error joining, got %v", err)
+	}
+	if err = c.Submit(operation.New().Retain(5).Insert("!"), nil); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if err = c.WaitSynchronized(testTimeout); err != nil {
+		t.Fatalf("expected edit to be acknowledged, got %v", err)
+	}
+
+	// reconnecting keeps using TLS
+	if err = c.Reconnect(); err != nil {
+		t.Fatalf("expected no error reconnecting, got %v", err)
+	}
+	if err = c.WaitRevision(1, testTimeout); err != nil {
+		t.Fatalf("expected client to resume at revision 1, got %v", err)
+	}
+}
+
+func TestCheckOrigin(t *testing.T) {
+	check := checkOrigin([]string{"https://example.com"})
+
+	for _, tc := range []struct {
+		origin  string
+		allowed bool
+	}{
+		{"", true},
+		{"http://demo.test:8080", true},
+		{"https://example.com", true},
+		{"https://EXAMPLE.com", true},
+		{"https://evil.example", false},
+		{"http://example.com", false},
+		{"::", false},
+	} {
+		r := httptest.NewRequest("GET", "http://demo.test:8080/ws", nil)
+		if tc.origin != "" {
+			r.Header.Set("Origin", tc.origin)
+		}
+		if actual, expected := check(r), tc.allowed; actual != expected {
+			t.Errorf("expected origin %q to be allowed: %v, got %v", tc.origin, expected, actual)
+		}
+	}
+
+	r := httptest.NewRequest("GET", "http://demo.test:8080/ws", nil)
+	r.Header.Set("Origin", "https://anything.example")
+	if !checkOrigin([]string{"*"})(r) {
+		t.Errorf("expected * to allow any origin")
+	}
+}
+
+func TestForeignOriginIsRejected(t *testing.T) {
+	srv := httptest.NewServer(newRouter(NewRegistry(StaticSource(""))))
+	defer srv.Close()
+
+	_, resp, err := websocket.DefaultDialer.Dial(wsURL(srv)+"/ws", http.Header{"Origin": {"https://evil.example"}})
+	if err == nil {
+		t.Fatalf("expected dialing from a foreign origin to fail")
+	}
+	if actual, expected := resp.StatusCode, http.StatusForbidden; actual != expected {
+		t.Errorf("expected status %d, got %d", expected, actual)
+	}
+}
@@ -0,0 +1,552 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/gorilla/websocket"
+	"github.com/nitrous-io/ot.go/demo/protocol"
+)
+
+var (
+	ErrWriteTimeout = errors.New("demo: write timed out")
+	ErrPollTimeout  = errors.New("demo: client stopped polling")
+	ErrInvalidAck   = errors.New("demo: acknowledged events that were not sent")
+)
+
+// maxUnacked is the most events a long polling client can leave
+// unacknowledged; later ones wait in the connection's send queue
+const maxUnacked = 256
+
+// Transport carries a connection's events, one json message each. Besides
+// websockets, clients behind proxies that break them can use server-sent
+// events or long polling, see addTransportRoutes.
+//
+// ReadMessage is called from the connection's reading go routine, the write
+// methods from its writing go routine, and Close from either.
+type Transport interface {
+	// ReadMessage blocks until the client sends a message.
+	ReadMessage() ([]byte, error)
+	// WriteMessage sends msg, failing if the client does not take it
+	// before deadline.
+	WriteMessage(msg []byte, deadline time.Time) error
+	// Ping checks that the client is still there.
+	Ping(deadline time.Time) error
+	// CloseGoingAway tells the client that the server is going away. The
+	// connection is closed afterwards.
+	CloseGoingAway(deadline time.Time) error
+	Close() error
+}
+
+type websocketTransport struct {
+	ws          *websocket.Conn
+	messageType int           // websocket.TextMessage or BinaryMessage
+	pongTimeout time.Duration // 0 disables read deadlines
+}
+
+func newWebsocketTransport(ws *websocket.Conn, p protocol.Protocol, pongTimeout time.Duration) *websocketTransport {
+	t := &websocketTransport{ws: ws, messageType: websocket.TextMessage, pongTimeout: pongTimeout}
+	if p.Binary() {
+		t.messageType = websocket.BinaryMessage
+	}
+
+	// any message or pong proves that the peer is still there
+	t.extendReadDeadline()
+	ws.SetPongHandler(func(string) error {
+		t.extendReadDeadline()
+		return nil
+	})
+	return t
+}
+
+func (t *websocketTransport) extendReadDeadline() {
+	if t.pongTimeout > 0 {
+		t.ws.SetReadDeadline(time.Now().Add(t.pongTimeout))
+	}
+}
+
+func (t *websocketTransport) ReadMessage() ([]byte, error) {
+	_, msg, err := t.ws.ReadMessage()
+	if err == nil {
+		t.extendReadDeadline()
+	}
+	return msg, err
+}
+
+func (t *websocketTransport) WriteMessage(msg []byte, deadline time.Time) error {
+	t.ws.SetWriteDeadline(deadline)
+	return t.ws.WriteMessage(t.messageType, msg)
+}
+
+func (t *websocketTransport) Ping(deadline time.Time) error {
+	return t.ws.WriteControl(websocket.PingMessage, nil, deadline)
+}
+
+// CloseGoingAway sends a close frame; the client's answer ends the read loop.
+func (t *websocketTransport) CloseGoingAway(deadline time.Time) error {
+	msg := websocket.FormatCloseMessage(websocket.CloseGoingAway, "server shutting down")
+	return t.ws.WriteControl(websocket.CloseMessage, msg, deadline)
+}
+
+func (t *websocketTransport) Close() error {
+	return t.ws.Close()
+}
+
+// upstream receives the messages a client of an http transport POSTs to
+// /conn/{id}.
+type upstream struct {
+	id        string
+	readLimit int64 // 0 for no limit
+	messages  chan []byte
+	closed    chan struct{}
+	closeOnce sync.Once
+	table     *transportTable
+}
+
+func (u *upstream) ReadMessage() ([]byte, error) {
+	select {
+	case msg := <-u.messages:
+		return msg, nil
+	case <-u.closed:
+		return nil, io.EOF
+	}
+}
+
+// CloseGoingAway closes right away; everything queued before has been
+// written already.
+func (u *upstream) CloseGoingAway(deadline time.Time) error {
+	return u.Close()
+}
+
+func (u *upstream) Close() error {
+	u.closeOnce.Do(func() {
+		close(u.closed)
+		u.table.remove(u.id)
+	})
+	return nil
+}
+
+// deliver hands msg to the reading go routine
+func (u *upstream) deliver(msg []byte, cancel <-chan struct{}) error {
+	select {
+	case u.messages <- msg:
+		return nil
+	case <-u.closed:
+		return ErrConnectionClosed
+	case <-cancel:
+		return ErrConnectionClosed
+	}
+}
+
+// sseTransport streams events to the client as server-sent events.
+type sseTransport struct {
+	*upstream
+
+	lock sync.Mutex
+	w    http.ResponseWriter
+	rc   *http.ResponseController
+	done bool // the http handler returned, w must not be used anymore
+}
+
+// write sends s to the client by deadline, so that a client that stops
+// reading cannot hold the lock that finish waits for.
+func (t *sseTransport) write(s string, deadline time.Time) error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if t.done {
+		return ErrConnectionClosed
+	}
+	if err := t.rc.SetWriteDeadline(deadline); err != nil {
+		return err
+	}
+	if _, err := io.WriteString(t.w, s); err != nil {
+		return err
+	}
+	return t.rc.Flush()
+}
+
+func (t *sseTransport) WriteMessage(msg []byte, deadline time.Time) error {
+	// json never contains raw newlines, so msg fits in one data line
+	return t.write("data: "+string(msg)+"\n\n", deadline)
+}
+
+func (t *sseTransport) Ping(deadline time.Time) error {
+	return t.write(": ping\n\n", deadline)
+}
+
+func (t *sseTransport) finish() {
+	t.lock.Lock()
+	t.done = true
+	t.lock.Unlock()
+}
+
+// pollTransport hands events to the client's pending GET /conn/{id}
+// requests. Events are numbered from 1 and kept until the client acknowledges
+// them, so that those of an answer lost on the way are sent again.
+type pollTransport struct {
+	*upstream
+
+	downstream  chan []byte
+	pongTimeout time.Duration
+	lastPoll    int64 // unix nanoseconds, read with atomic
+	polling     int32 // number of pending polls, read with atomic
+
+	lock    sync.Mutex
+	acked   int      // number of the last event the client acknowledged
+	unacked [][]byte // the events after it
+}
+
+func (t *pollTransport) WriteMessage(msg []byte, deadline time.Time) error {
+	timer := time.NewTimer(deadline.Sub(time.Now()))
+	defer timer.Stop()
+
+	select {
+	case t.downstream <- msg:
+		return nil
+	case <-timer.C:
+		return ErrWriteTimeout
+	case <-t.closed:
+		return ErrConnectionClosed
+	}
+}
+
+func (t *pollTransport) Ping(deadline time.Time) error {
+	if t.pongTimeout <= 0 || atomic.LoadInt32(&t.polling) > 0 {
+		return nil
+	}
+	last := time.Unix(0, atomic.LoadInt64(&t.lastPoll))
+	if time.Now().Sub(last) > t.pongTimeout {
+		return ErrPollTimeout
+	}
+	return nil
+}
+
+// poll answers with the events the client has not acknowledged, waiting up
+// to timeout if there are none, and with all others that are ready. The
+// X-Seq header holds the number of the last event of the answer.
+func (t *pollTransport) poll(w http.ResponseWriter, r *http.Request, timeout time.Duration) {
+	atomic.AddInt32(&t.polling, 1)
+	defer func() {
+		atomic.StoreInt64(&t.lastPoll, time.Now().UnixNano())
+		atomic.AddInt32(&t.polling, -1)
+	}()
+
+	if err := t.ack(r.URL.Query().Get("ack")); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if t.pending() == 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+
+		select {
+		case msg := <-t.downstream:
+			t.lock.Lock()
+			t.unacked = append(t.unacked, msg)
+			t.lock.Unlock()
+		case <-timer.C:
+		case <-r.Context().Done():
+			return
+		case <-t.closed:
+			http.Error(w, ErrConnectionClosed.Error(), http.StatusGone)
+			return
+		}
+	}
+	// hand over whatever else is ready in the same response
+	for t.take() {
+	}
+
+	t.lock.Lock()
+	seq := t.acked + len(t.unacked)
+	msgs := make([]json.RawMessage, len(t.unacked))
+	for i, msg := range t.unacked {
+		msgs[i] = msg
+	}
+	t.lock.Unlock()
+
+	w.Header().Set("X-Seq", strconv.Itoa(seq))
+	writeJSON(w, http.StatusOK, msgs)
+}
+
+// ack drops the events up to the one numbered s. A client that does not pass
+// s does not number events, and has received all that were sent before.
+func (t *pollTransport) ack(s string) error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	n := t.acked + len(t.unacked)
+	if s != "" {
+		var err error
+		if n, err = strconv.Atoi(s); err != nil || n > t.acked+len(t.unacked) {
+			return ErrInvalidAck
+		}
+	}
+	if n > t.acked {
+		t.unacked = t.unacked[n-t.acked:]
+		t.acked = n
+	}
+	return nil
+}
+
+// pending returns the number of unacknowledged events
+func (t *pollTransport) pending() int {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return len(t.unacked)
+}
+
+// take adds an event that is ready to the unacknowledged ones, unless there
+// are too many
+func (t *pollTransport) take() bool {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if len(t.unacked) >= maxUnacked {
+		return false
+	}
+	select {
+	case msg := <-t.downstream:
+		t.unacked = append(t.unacked, msg)
+		return true
+	default:
+		return false
+	}
+}
+
+// transportTable finds the connections of http transports by id.
+type transportTable struct {
+	PollTimeout time.Duration // longest a GET /conn/{id} waits for events
+
+	lock    sync.Mutex
+	entries map[string]Transport
+}
+
+func newTransportTable() *transportTable {
+	return &transportTable{
+		PollTimeout: 25 * time.Second,
+		entries:     map[string]Transport{},
+	}
+}
+
+func (tt *transportTable) newUpstream(readLimit int64) (*upstream, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return nil, err
+	}
+	return &upstream{
+		id:        hex.EncodeToString(b),
+		readLimit: readLimit,
+		messages:  make(chan []byte, 16),
+		closed:    make(chan struct{}),
+		table:     tt,
+	}, nil
+}
+
+func (tt *transportTable) add(id string, t Transport) {
+	tt.lock.Lock()
+	defer tt.lock.Unlock()
+	tt.entries[id] = t
+}
+
+func (tt *transportTable) get(id string) Transport {
+	tt.lock.Lock()
+	defer tt.lock.Unlock()
+	return tt.entries[id]
+}
+
+func (tt *transportTable) remove(id string) {
+	tt.lock.Lock()
+	defer tt.lock.Unlock()
+	delete(tt.entries, id)
+}
+
+// addTransportRoutes serves the http transports:
+//
+//	GET    /sse/{docID}   event stream, the first event is
+//	                      {"e": "transport", "d": {"id": id}}
+//	POST   /poll/{docID}  opens a long polling connection, answers
+//	                      {"id": id, "protocol": name}
+//	GET    /conn/{id}     long polling: waits for events, answers [event, ...]
+//	                      with the number of the last one in X-Seq; ack is
+//	                      the last number received, unacknowledged events
+//	                      are sent again
+//	POST   /conn/{id}     sends one event to the server, for both transports
+//	DELETE /conn/{id}     closes the connection
+//
+// The query parameters of /ws, e.g. spectate and the resume parameters, work
+// on /sse and /poll too, as does protocol, which lists the protocols the
+// client speaks like the websocket subprotocols do.
+func addTransportRoutes(r *mux.Router, registry *Registry, table *transportTable) {
+	r.Handle("/sse", documentHandler(registry, table.serveSSE)).Methods("GET")
+	r.Handle("/sse/{docID:[A-Za-z0-9_-]+}", documentHandler(registry, table.serveSSE)).Methods("GET")
+
+	openPoll := documentHandler(registry, func(s *Session, identity *Identity, w http.ResponseWriter, r *http.Request) {
+		// the connection outlives the request, so it needs its own reference
+		if _, err := registry.Acquire(s.ID); err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		table.openPoll(s, identity, w, r, func() {
+			registry.Release(s.ID)
+		})
+	})
+	r.Handle("/poll", openPoll).Methods("POST")
+	r.Handle("/poll/{docID:[A-Za-z0-9_-]+}", openPoll).Methods("POST")
+
+	r.HandleFunc("/conn/{id}", table.serveUpstream).Methods("POST")
+	r.HandleFunc("/conn/{id}", table.servePoll).Methods("GET")
+	r.HandleFunc("/conn/{id}", table.serveClose).Methods("DELETE")
+}
+
+// negotiateQuery picks the protocol of an http transport from its protocol
+// query parameter, a comma separated list of protocol names. Binary
+// encodings are left out: events are carried as text.
+func negotiateQuery(r *http.Request) (protocol.Protocol, error) {
+	offered := splitList(r.URL.Query().Get("protocol"))
+	text := offered[:0]
+	for _, name := range offered {
+		if p, err := protocol.Parse(name); err == nil && !p.Binary() {
+			text = append(text, name)
+		}
+	}
+	if len(offered) > 0 && len(text) == 0 {
+		return protocol.Protocol{}, protocol.ErrUnsupportedProtocol
+	}
+	return protocol.Negotiate(text)
+}
+
+func (tt *transportTable) serveSSE(s *Session, identity *Identity, w http.ResponseWriter, r *http.Request) {
+	rc := http.NewResponseController(w)
+	if err := rc.SetWriteDeadline(time.Time{}); err != nil {
+		http.Error(w, "streaming not supported", http.StatusInternalServerError)
+		return
+	}
+	p, err := negotiateQuery(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	u, err := tt.newUpstream(s.Limits.MaxMessageBytes)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	t := &sseTransport{upstream: u, w: w, rc: rc}
+	tt.add(u.id, t)
+	defer t.finish()
+	defer t.Close()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	hello, err := protocol.Encode(p, &protocol.Transport{ID: u.id})
+	if err != nil {
+		return
+	}
+	if err = t.WriteMessage(hello, time.Now().Add(s.ConnOptions.WriteTimeout)); err != nil {
+		return
+	}
+
+	go func() {
+		select {
+		case <-r.Context().Done():
+			t.Close()
+		case <-u.closed:
+		}
+	}()
+
+	c := NewConnection(s, t)
+	c.Identity = identity
+	c.Protocol = p.Wire()
+	runConnection(c, r)
+}
+
+func (tt *transportTable) openPoll(s *Session, identity *Identity, w http.ResponseWriter, r *http.Request, release func()) {
+	p, err := negotiateQuery(r)
+	if err != nil {
+		release()
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	u, err := tt.newUpstream(s.Limits.MaxMessageBytes)
+	if err != nil {
+		release()
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	t := &pollTransport{
+		upstream:    u,
+		downstream:  make(chan []byte),
+		pongTimeout: s.ConnOptions.PongTimeout,
+		lastPoll:    time.Now().UnixNano(),
+	}
+	tt.add(u.id, t)
+
+	c := NewConnection(s, t)
+	c.Identity = identity
+	c.Protocol = p.Wire()
+	go func() {
+		defer release()
+		runConnection(c, r)
+	}()
+
+	writeJSON(w, http.StatusOK, map[string]string{"id": u.id, "protocol": p.String()})
+}
+
+func (tt *transportTable) serveUpstream(w http.ResponseWriter, r *http.Request) {
+	var u *upstream
+	switch t := tt.get(mux.Vars(r)["id"]).(type) {
+	case *sseTransport:
+		u = t.upstream
+	case *pollTransport:
+		u = t.upstream
+	default:
+		http.Error(w, "no such connection", http.StatusNotFound)
+		return
+	}
+
+	body := r.Body
+	if u.readLimit > 0 {
+		body = http.MaxBytesReader(w, r.Body, u.readLimit)
+	}
+	msg, err := ioutil.ReadAll(body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+		return
+	}
+	if err = u.deliver(msg, r.Context().Done()); err != nil {
+		http.Error(w, err.Error(), http.StatusGone)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (tt *transportTable) servePoll(w http.ResponseWriter, r *http.Request) {
+	t, ok := tt.get(mux.Vars(r)["id"]).(*pollTransport)
+	if !ok {
+		http.Error(w, "no such connection", http.StatusNotFound)
+		return
+	}
+	t.poll(w, r, tt.PollTimeout)
+}
+
+func (tt *transportTable) serveClose(w http.ResponseWriter, r *http.Request) {
+	t := tt.get(mux.Vars(r)["id"])
+	if t == nil {
+		http.Error(w, "no such connection", http.StatusNotFound)
+		return
+	}
+	t.Close()
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,366 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nitrous-io/ot.go/demo/wsclient"
+	"github.com/nitrous-io/ot.go/ot/operation"
+)
+
+type rawEvent struct {
+	Name string          `json:"e"`
+	Data json.RawMessage `json:"d"`
+}
+
+// nextEvent skips events until one called name arrives
+func nextEvent(t *testing.T, events <-chan *rawEvent, name string) *rawEvent {
+	timeout := time.After(testTimeout)
+	for {
+		select {
+		case e, ok := <-events:
+			if !ok {
+				t.Fatalf("expected %s event, got end of stream", name)
+			}
+			if e.Name == name {
+				return e
+			}
+		case <-timeout:
+			t.Fatalf("timed out waiting for %s event", name)
+		}
+	}
+}
+
+func postEvent(t *testing.T, srv *httptest.Server, id, event string) int {
+	resp, err := http.Post(srv.URL+"/conn/"+id, "application/json", strings.NewReader(event))
+	if err != nil {
+		t.Fatalf("expected no error posting %s, got %v", event, err)
+	}
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+func deleteConn(t *testing.T, srv *httptest.Server, id string) int {
+	req, _ := http.NewRequest("DELETE", srv.URL+"/conn/"+id, nil)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("expected no error closing, got %v", err)
+	}
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+func TestSSETransport(t *testing.T) {
+	srv := httptest.NewServer(newRouter(NewRegistry(StaticSource("hello"))))
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL + "/sse/foo")
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	defer resp.Body.Close()
+	if actual, expected := resp.Header.Get("Content-Type"), "text/event-stream"; actual != expected {
+		t.Errorf("expected content type %s, got %s", expected, actual)
+	}
+
+	events := make(chan *rawEvent, 16)
+	go func() {
+		defer close(events)
+		scanner := bufio.NewScanner(resp.Body)
+		for scanner.Scan() {
+			line := scanner.Text()
+			if !strings.HasPrefix(line, "data: ") {
+				continue
+			}
+			e := &rawEvent{}
+			if json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), e) == nil {
+				events <- e
+			}
+		}
+	}()
+
+	var transport struct {
+		ID string `json:"id"`
+	}
+	e := <-events
+	if e == nil || e.Name != "transport" {
+		t.Fatalf("expected transport event first, got %+v", e)
+	}
+	json.Unmarshal(e.Data, &transport)
+
+	var doc struct {
+		Document string `json:"document"`
+		Revision int    `json:"revision"`
+	}
+	json.Unmarshal(nextEvent(t, events, "doc").Data, &doc)
+	if actual, expected := doc.Document, "hello"; actual != expected {
+		t.Errorf("expected document %s, got %s", expected, actual)
+	}
+
+	if actual, expected := postEvent(t, srv, transport.ID, `{"e": "join", "d": {"username": "alice"}}`), http.StatusNoContent; actual != expected {
+		t.Fatalf("expected status %d, got %d", expected, actual)
+	}
+	nextEvent(t, events, "registered")
+
+	// websocket and sse clients share the session
+	bob, err := wsclient.Dial(wsURL(srv) + "/ws/foo")
+	if err != nil {
+		t.Fatalf("expected no error dialing, got %v", err)
+	}
+	defer bob.Close()
+	if err = bob.Submit(operation.New().Retain(5).Insert("!"), nil); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	nextEvent(t, events, "op")
+
+	postEvent(t, srv, transport.ID, `{"e": "op", "d": [1, [6, "?"]]}`)
+	nextEvent(t, events, "ok")
+	if err = bob.WaitRevision(2, testTimeout); err != nil {
+		t.Fatalf("expected bob to receive the sse edit, got %v", err)
+	}
+	if actual, expected := bob.Document(), "hello!?"; actual != expected {
+		t.Errorf("expected document %s, got %s", expected, actual)
+	}
+
+	if actual, expected := deleteConn(t, srv, transport.ID), http.StatusNoContent; actual != expected {
+		t.Errorf("expected status %d, got %d", expected, actual)
+	}
+	for range events {
+	}
+	if actual, expected := postEvent(t, srv, transport.ID, `{"e": "sel"}`), http.StatusNotFound; actual != expected {
+		t.Errorf("expected status %d after closing, got %d", expected, actual)
+	}
+}
+
+// poll answers the events of a long polling connection, and the number of
+// the last one. ack is the ack parameter, if not empty.
+func poll(t *testing.T, srv *httptest.Server, id, ack string) (int, []*rawEvent, int) {
+	u := srv.URL + "/conn/" + id
+	if ack != "" {
+		u += "?ack=" + ack
+	}
+	resp, err := http.Get(u)
+	if err != nil {
+		t.Fatalf("expected no error polling, got %v", err)
+	}
+	defer resp.Body.Close()
+	var events []*rawEvent
+	var seq int
+	if resp.StatusCode == http.StatusOK {
+		if err = json.NewDecoder(resp.Body).Decode(&events); err != nil {
+			t.Fatalf("expected json, got %v", err)
+		}
+		if seq, err = strconv.Atoi(resp.Header.Get("X-Seq")); err != nil {
+			t.Fatalf("expected a sequence number, got %v", err)
+		}
+	}
+	return resp.StatusCode, events, seq
+}
+
+func TestPollTransport(t *testing.T) {
+	srv := httptest.NewServer(newRouter(NewRegistry(StaticSource("hello"))))
+	defer srv.Close()
+
+	var opened struct {
+		ID       string `json:"id"`
+		Protocol string `json:"protocol"`
+	}
+	if status := apiRequest(t, "POST", srv.URL+"/poll/foo?protocol=ot.v1.json", "", &opened); status != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", status)
+	}
+	if actual, expected := opened.Protocol, "ot.v1.json"; actual != expected {
+		t.Errorf("expected protocol %s, got %s", expected, actual)
+	}
+
+	resp, err := http.Post(srv.URL+"/poll/foo?protocol=ot.v9.json", "", nil)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	resp.Body.Close()
+	if actual, expected := resp.StatusCode, http.StatusBadRequest; actual != expected {
+		t.Errorf("expected status %d for an unsupported protocol, got %d", expected, actual)
+	}
+
+	status, events, seq := poll(t, srv, opened.ID, "")
+	if status != http.StatusOK || len(events) != 1 || events[0].Name != "doc" || seq != 1 {
+		t.Fatalf("expected the doc event numbered 1, got %d %+v %d", status, events, seq)
+	}
+
+	// an answer the client did not get is sent again
+	status, events, seq = poll(t, srv, opened.ID, "0")
+	if status != http.StatusOK || len(events) != 1 || events[0].Name != "doc" || seq != 1 {
+		t.Fatalf("expected the doc event again, got %d %+v %d", status, events, seq)
+	}
+	if status, _, _ = poll(t, srv, opened.ID, "2"); status != http.StatusBadRequest {
+		t.Errorf("expected status %d acknowledging an event not sent, got %d", http.StatusBadRequest, status)
+	}
+
+	if actual, expected := postEvent(t, srv, opened.ID, `{"e": "join", "d": {"username": "alice"}}`), http.StatusNoContent; actual != expected {
+		t.Fatalf("expected status %d, got %d", expected, actual)
+	}
+	status, events, seq = poll(t, srv, opened.ID, "1")
+	if status != http.StatusOK || len(events) == 0 || events[0].Name != "registered" || seq != 1+len(events) {
+		t.Fatalf("expected the registered event, got %d %+v %d", status, events, seq)
+	}
+
+	if actual, expected := deleteConn(t, srv, opened.ID), http.StatusNoContent; actual != expected {
+		t.Errorf("expected status %d, got %d", expected, actual)
+	}
+	if status, _, _ = poll(t, srv, opened.ID, ""); status != http.StatusNotFound {
+		t.Errorf("expected status %d after closing, got %d", http.StatusNotFound, status)
+	}
+}
+
+func TestDeadPollClientIsRemoved(t *testing.T) {
+	r := NewRegistry(StaticSource("hello"))
+	r.ConnOptions.PingInterval = 10 * time.Millisecond
+	r.ConnOptions.PongTimeout = 200 * time.Millisecond
+	r.ConnOptions.WriteTimeout = 200 * time.Millisecond
+	srv := httptest.NewServer(newRouter(r))
+	defer srv.Close()
+
+	var opened struct {
+		ID string `json:"id"`
+	}
+	if status := apiRequest(t, "POST", srv.URL+"/poll/foo", "", &opened); status != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", status)
+	}
+
+	s, err := r.Acquire("foo")
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	defer r.Release("foo")
+
+	// the client never polls, so it is registered and then removed
+	deadline := time.Now().Add(testTimeout)
+	registered := false
+	for {
+		var n int
+		s.Call(func() {
+			n = len(s.Connections)
+		})
+		if n > 0 {
+			registered = true
+		} else if registered {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the connection to be removed")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if status, _, _ := poll(t, srv, opened.ID, ""); status != http.StatusNotFound {
+		t.Errorf("expected status %d, got %d", http.StatusNotFound, status)
+	}
+}
+
+func TestStalledSSEClientIsRemoved(t *testing.T) {
+	r := NewRegistry(StaticSource(""))
+	r.GracePeriod = 0
+	r.Limits = Limits{}
+	// the queue never fills, only the write timeout can end the stall
+	r.ConnOptions = ConnOptions{
+		SendQueueSize: 1024,
+		WriteTimeout:  200 * time.Millisecond,
+	}
+	srv := httptest.NewUnstartedServer(newRouter(r))
+	srv.Listener = smallBufListener{srv.Listener}
+	srv.Start()
+	defer srv.Close()
+
+	// the stalled client reads the response header and then stops reading
+	conn, err := net.Dial("tcp", srv.Listener.Addr().String())
+	if err != nil {
+		t.Fatalf("expected no error dialing, got %v", err)
+	}
+	defer conn.Close()
+	conn.(*net.TCPConn).SetReadBuffer(32 * 1024)
+	fmt.Fprintf(conn, "GET /sse/foo HTTP/1.1\r\nHost: %s\r\n\r\n", srv.Listener.Addr())
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatalf("expected no error reading the response, got %v", err)
+	}
+	if actual, expected := resp.StatusCode, http.StatusOK; actual != expected {
+		t.Fatalf("expected status %d, got %d", expected, actual)
+	}
+
+	bob, err := wsclient.Dial(wsURL(srv) + "/ws/foo")
+	if err != nil {
+		t.Fatalf("expected no error dialing, got %v", err)
+	}
+	defer bob.Close()
+	submitLargeEdits(t, bob, 20)
+
+	s, err := r.Acquire("foo")
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	defer r.Release("foo")
+
+	deadline := time.Now().Add(testTimeout)
+	for {
+		var n int
+		s.Call(func() {
+			n = len(s.Connections)
+		})
+		if n == 1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the stalled connection to be removed, got %d connections", n)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestShutdownEndsStreams(t *testing.T) {
+	r := NewRegistry(StaticSource("hello"))
+	srv := httptest.NewServer(newRouter(r))
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL + "/sse/foo")
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	defer resp.Body.Close()
+
+	var opened struct {
+		ID string `json:"id"`
+	}
+	if status := apiRequest(t, "POST", srv.URL+"/poll/foo", "", &opened); status != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", status)
+	}
+	poll(t, srv, opened.ID, "")
+	polled := make(chan []*rawEvent)
+	go func() {
+		_, events, _ := poll(t, srv, opened.ID, "")
+		polled <- events
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+	if err = r.Shutdown(ctx, 0); err != nil {
+		t.Fatalf("expected no error shutting down the registry, got %v", err)
+	}
+
+	// neither stream keeps the http server from shutting down
+	ctx, cancel = context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err = srv.Config.Shutdown(ctx); err != nil {
+		t.Fatalf("expected no error shutting down the server, got %v", err)
+	}
+	// the pending poll took the shutdown event
+	if events := <-polled; len(events) != 1 || events[0].Name != "shutdown" {
+		t.Errorf("expected the shutdown event, got %+v", events)
+	}
+}
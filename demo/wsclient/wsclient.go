@@ -0,0 +1,737 @@
+// Package wsclient is a Go client for the demo's websocket protocol. It keeps
+// a live copy of the document and the other users' selections, and submits
+// local edits through the ot client state machine.
+package wsclient
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/nitrous-io/ot.go/demo/protocol"
+	"github.com/nitrous-io/ot.go/ot/client"
+	"github.com/nitrous-io/ot.go/ot/operation"
+	"github.com/nitrous-io/ot.go/ot/selection"
+	"github.com/nitrous-io/ot.go/ot/session"
+)
+
+var (
+	ErrUnexpectedEvent = errors.New("demo/wsclient: unexpected event")
+	ErrTimeout         = errors.New("demo/wsclient: timed out")
+	ErrUnits           = errors.New("demo/wsclient: the server counts text in other units")
+)
+
+type Event struct {
+	Name string          `json:"e"`
+	Data json.RawMessage `json:"d,omitempty"`
+}
+
+// ServerError is received in an "error" event when the server could not
+// handle one of the client's events.
+type ServerError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+	Event   string `json:"event"`
+}
+
+func (e *ServerError) Error() string {
+	return "demo/wsclient: server error: " + e.Code + ": " + e.Message
+}
+
+type Client struct {
+	url    string
+	dialer *websocket.Dialer
+
+	lock      sync.Mutex
+	ws        *websocket.Conn
+	onEvent   func(e *Event)    // see OnEvent
+	proto     protocol.Protocol // negotiated with the server
+	changed   chan struct{}     // closed and replaced whenever the state changes
+	document  string
+	selection *selection.Selection
+	clients   map[string]*session.Client
+	ot        *client.Client
+	id        string
+	role      string
+	err       error
+	errors    []ServerError
+	formatted *protocol.Formatted // the answer to the last format request
+	// diagnostics of the local document
+	diagnostics []protocol.Diagnostic
+	running     *protocol.Running // the program running, if any
+	output      string            // of the last run, both streams
+	exit        *protocol.Exit    // how the last run ended
+	// annotations by id, relative to the local document
+	annotations map[string]*session.Annotation
+
+	retryAfter time.Duration // announced by the server when shutting down
+
+	// issued by the server with the document, used to resume after reconnecting
+	resumeID    string
+	resumeToken string
+}
+
+// Dial connects to the demo websocket endpoint at url and waits for the
+// initial document. The client speaks the most compact protocol the server
+// supports, and counts text in the units of ot.TextEncoding, which must be
+// those of the server.
+func Dial(url string) (*Client, error) {
+	return DialWith(websocket.DefaultDialer, url)
+}
+
+// DialWith is like Dial but uses the given dialer.
+func DialWith(dialer *websocket.Dialer, url string) (*Client, error) {
+	ws, p, err := dial(dialer, url)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &Client{
+		url:     url,
+		dialer:  dialer,
+		ws:      ws,
+		proto:   p,
+		clients: map[string]*session.Client{},
+		changed: make(chan struct{}),
+	}
+
+	_, m, err := readEvent(ws, p)
+	if err != nil {
+		ws.Close()
+		return nil, err
+	}
+	doc, ok := m.(*protocol.Doc)
+	if !ok {
+		ws.Close()
+		return nil, ErrUnexpectedEvent
+	}
+	if err = c.handleDoc(doc); err != nil {
+		ws.Close()
+		return nil, err
+	}
+
+	go c.readLoop(ws)
+
+	return c, nil
+}
+
+// Reconnect replaces a dropped connection. The server replays the operations
+// the client missed and the client resends its pending operation, keeping its
+// id, name and selection. If the server no longer knows the client, it sends
+// the whole document instead and unacknowledged local edits are discarded.
+func (c *Client) Reconnect() error {
+	u, err := url.Parse(c.url)
+	if err != nil {
+		return err
+	}
+	// keep other parameters, e.g. an access token
+	q := u.Query()
+
+	c.lock.Lock()
+	q.Set("client_id", c.resumeID)
+	q.Set("token", c.resumeToken)
+	q.Set("revision", strconv.Itoa(c.ot.Revision))
+	old := c.ws
+	c.lock.Unlock()
+
+	old.Close()
+
+	u.RawQuery = q.Encode()
+
+	ws, p, err := dial(c.dialer, u.String())
+	if err != nil {
+		return err
+	}
+
+	c.lock.Lock()
+	c.ws = ws
+	c.proto = p
+	c.err = nil
+	c.lock.Unlock()
+
+	go c.readLoop(ws)
+
+	return nil
+}
+
+// OnEvent sets a function the read loop calls for every event received from
+// then on, after the client state has been updated. Its data is json whatever
+// the protocol.
+func (c *Client) OnEvent(f func(e *Event)) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.onEvent = f
+}
+
+// Join registers the client under the given username and waits until the
+// server confirms it.
+func (c *Client) Join(username string, timeout time.Duration) error {
+	c.lock.Lock()
+	err := c.send(&protocol.Join{Username: username})
+	c.lock.Unlock()
+	if err != nil {
+		return err
+	}
+	return c.Wait(timeout, func(c *Client) bool {
+		return c.ID() != ""
+	})
+}
+
+// Submit applies op to the local document and sends it to the server. sel is
+// the client's selection after the edit and may be nil. Edits made while
+// disconnected are sent after Reconnect.
+func (c *Client) Submit(op *operation.Operation, sel *selection.Selection) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	doc, err := op.Apply(c.document)
+	if err != nil {
+		return err
+	}
+	c.document = doc
+
+	if sel != nil {
+		c.selection = sel
+	} else if c.selection != nil {
+		c.selection = c.selection.Transform(op)
+	}
+	// the others' cursors stay in front of what we typed, as on the server
+	for _, cl := range c.clients {
+		cl.Selection = *cl.Selection.TransformWithBias(op, selection.BiasBefore)
+	}
+	c.transformDiagnostics(op)
+	c.transformAnnotations(op)
+
+	return c.ot.ApplyClient(op)
+}
+
+// SetSelection sends the client's selection to the server.
+func (c *Client) SetSelection(sel *selection.Selection) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.selection = sel
+	return c.send(&protocol.Sel{Selection: sel})
+}
+
+// Resync asks the server for the whole document. Edits that have not been
+// acknowledged are discarded. The client resyncs by itself when the server
+// rejects an edit.
+func (c *Client) Resync() error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.send(&protocol.Resync{})
+}
+
+// Format asks the server to gofmt the document. The formatted document
+// arrives as an edit; Formatted tells when the server has answered.
+func (c *Client) Format() error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.formatted = nil
+	return c.send(&protocol.Format{})
+}
+
+// Formatted returns the syntax errors that prevented the last Format, and
+// whether the server has answered it yet.
+func (c *Client) Formatted() ([]protocol.SyntaxError, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.formatted == nil {
+		return nil, false
+	}
+	return append([]protocol.SyntaxError{}, c.formatted.Errors...), true
+}
+
+// Run asks the server to run the document. Running tells who started the
+// program; Exit tells how it ended.
+func (c *Client) Run() error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.send(&protocol.Run{})
+}
+
+// Stop asks the server to kill the running program.
+func (c *Client) Stop() error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.send(&protocol.Stop{})
+}
+
+// Running returns the program running in the session, and whether there is
+// one.
+func (c *Client) Running() (protocol.Running, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.running == nil {
+		return protocol.Running{}, false
+	}
+	return *c.running, true
+}
+
+// Output returns what the last program wrote to stdout and stderr.
+func (c *Client) Output() string {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.output
+}
+
+// Exit returns how the last program ended, and whether it has.
+func (c *Client) Exit() (protocol.Exit, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.exit == nil {
+		return protocol.Exit{}, false
+	}
+	return *c.exit, true
+}
+
+// Comment starts a thread on the text between from and to. The positions are
+// those of the document at Revision, which is the local document only while
+// Synchronized.
+func (c *Client) Comment(from, to int, text string) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.send(&protocol.Comment{Revision: c.ot.Revision, From: from, To: to, Text: text})
+}
+
+// Reply adds a comment to the thread of the annotation id.
+func (c *Client) Reply(id, text string) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.send(&protocol.Reply{ID: id, Text: text})
+}
+
+// Resolve marks the annotation id as resolved.
+func (c *Client) Resolve(id string) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.send(&protocol.Resolve{ID: id})
+}
+
+// Annotations returns a copy of the annotations in the order of their ranges,
+// which are relative to the local document.
+func (c *Client) Annotations() []session.Annotation {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	annotations := make([]session.Annotation, 0, len(c.annotations))
+	for _, a := range c.annotations {
+		cp := *a
+		cp.Comments = append([]session.Comment{}, a.Comments...)
+		annotations = append(annotations, cp)
+	}
+	sort.Slice(annotations, func(i, j int) bool {
+		a, b := annotations[i], annotations[j]
+		if a.From != b.From {
+			return a.From < b.From
+		}
+		if a.To != b.To {
+			return a.To < b.To
+		}
+		return a.ID < b.ID
+	})
+	return annotations
+}
+
+// Diagnostics returns the problems the server found in the document, moved
+// along with the edits made since.
+func (c *Client) Diagnostics() []protocol.Diagnostic {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return append([]protocol.Diagnostic{}, c.diagnostics...)
+}
+
+// Protocol returns the name of the protocol negotiated with the server.
+func (c *Client) Protocol() string {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.proto.String()
+}
+
+// ID returns the client id assigned by the server after joining.
+func (c *Client) ID() string {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.id
+}
+
+// Role returns the role the server gave the client, e.g. "editor".
+func (c *Client) Role() string {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.role
+}
+
+// Document returns the local copy of the document.
+func (c *Client) Document() string {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.document
+}
+
+// Revision returns the last server revision the client knows about.
+func (c *Client) Revision() int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.ot.Revision
+}
+
+// Synchronized reports whether all local edits have been acknowledged.
+func (c *Client) Synchronized() bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	_, ok := c.ot.State.(*client.Synchronized)
+	return ok
+}
+
+// Clients returns a copy of the other users, keyed by client id. Their
+// selections are relative to the local document.
+func (c *Client) Clients() map[string]session.Client {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	clients := make(map[string]session.Client, len(c.clients))
+	for id, cl := range c.clients {
+		clients[id] = *cl
+	}
+	return clients
+}
+
+// ServerErrors returns the errors the server has reported so far.
+func (c *Client) ServerErrors() []ServerError {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return append([]ServerError{}, c.errors...)
+}
+
+// RetryAfter returns how long the server asked clients to wait before
+// reconnecting when it shut down, or 0 if it did not.
+func (c *Client) RetryAfter() time.Duration {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.retryAfter
+}
+
+// Err returns the error that stopped the read loop, if any.
+func (c *Client) Err() error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.err
+}
+
+// Wait blocks until cond returns true or timeout elapses. cond is evaluated
+// again every time an event has been handled.
+func (c *Client) Wait(timeout time.Duration, cond func(c *Client) bool) error {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	for {
+		c.lock.Lock()
+		changed, err := c.changed, c.err
+		c.lock.Unlock()
+
+		if cond(c) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		select {
+		case <-changed:
+		case <-timer.C:
+			return ErrTimeout
+		}
+	}
+}
+
+// WaitSynchronized blocks until all local edits have been acknowledged.
+func (c *Client) WaitSynchronized(timeout time.Duration) error {
+	return c.Wait(timeout, (*Client).Synchronized)
+}
+
+// WaitRevision blocks until the client has caught up to the given revision.
+func (c *Client) WaitRevision(revision int, timeout time.Duration) error {
+	return c.Wait(timeout, func(c *Client) bool {
+		return c.Revision() >= revision
+	})
+}
+
+func (c *Client) Close() error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.ws.Close()
+}
+
+func (c *Client) readLoop(ws *websocket.Conn) {
+	c.lock.Lock()
+	p := c.proto
+	c.lock.Unlock()
+
+	for {
+		e, m, err := readEvent(ws, p)
+		c.lock.Lock()
+		if ws != c.ws {
+			// replaced by Reconnect
+			c.lock.Unlock()
+			return
+		}
+		if err == nil && m != nil {
+			err = c.handleEvent(m)
+		}
+		if err != nil && c.err == nil {
+			c.err = err
+		}
+		c.notify()
+		onEvent := c.onEvent
+		c.lock.Unlock()
+
+		if err != nil {
+			ws.Close()
+			return
+		}
+		if onEvent != nil {
+			onEvent(e)
+		}
+	}
+}
+
+// notify wakes up waiters. It should be called with c.lock held
+func (c *Client) notify() {
+	close(c.changed)
+	c.changed = make(chan struct{})
+}
+
+// handleDoc starts over from d. The client's operations count text in the
+// units of ot.TextEncoding, which must be the server's.
+func (c *Client) handleDoc(d *protocol.Doc) error {
+	if d.Units != "" && d.Units != protocol.Units() {
+		return ErrUnits
+	}
+	c.document = d.Document
+	c.diagnostics = nil
+	c.annotations = map[string]*session.Annotation{}
+	c.clients = d.Clients
+	if c.clients == nil {
+		c.clients = map[string]*session.Client{}
+	}
+	c.ot = client.New(d.Revision, (*handler)(c))
+	if d.ClientID != c.resumeID {
+		// a new identity; a resync keeps the old one
+		c.id = ""
+	}
+	c.resumeID = d.ClientID
+	c.resumeToken = d.ResumeToken
+	c.role = d.Role
+	return nil
+}
+
+// handleEvent should be called with c.lock held
+func (c *Client) handleEvent(m protocol.Message) error {
+	switch m := m.(type) {
+	case *protocol.Doc:
+		// the server could not resume the session and starts over
+		return c.handleDoc(m)
+	case *protocol.Resumed:
+		c.id = m.ClientID
+		c.clients = map[string]*session.Client{}
+		for id, cl := range m.Clients {
+			cl.Selection = *c.ot.TransformSelection(&cl.Selection)
+			c.clients[id] = cl
+		}
+		return c.ot.ServerReconnect()
+	case *protocol.Error:
+		c.errors = append(c.errors, ServerError(*m))
+		if _, ok := c.ot.State.(*client.Synchronized); m.Event == "op" && !ok {
+			// the server dropped the outstanding operation, which would never
+			// be acknowledged; start over from its document. a failed send
+			// means a broken connection, which the read loop notices.
+			c.send(&protocol.Resync{})
+		}
+	case *protocol.Formatted:
+		c.formatted = m
+	case *protocol.Running:
+		// resumed connections are told about the same run again
+		if c.running == nil || *c.running != *m {
+			c.output, c.exit = "", nil
+		}
+		c.running = m
+	case *protocol.Output:
+		c.output += m.Data
+	case *protocol.Exit:
+		c.running, c.exit = nil, m
+	case *protocol.Diagnostics:
+		// like selections, they are relative to the server's document
+		sel := &selection.Selection{Ranges: make([]selection.Range, len(m.Diagnostics))}
+		for i, d := range m.Diagnostics {
+			sel.Ranges[i] = selection.Range{Anchor: d.From, Head: d.To}
+		}
+		sel = c.ot.TransformSelection(sel)
+		c.diagnostics = make([]protocol.Diagnostic, len(m.Diagnostics))
+		for i, d := range m.Diagnostics {
+			d.From, d.To = sel.Ranges[i].Anchor, sel.Ranges[i].Head
+			c.diagnostics[i] = d
+		}
+	case *protocol.Annotated:
+		c.setAnnotation(m.Annotation)
+	case *protocol.Annotations:
+		for _, a := range m.Annotations {
+			c.setAnnotation(a)
+		}
+	case *protocol.Shutdown:
+		c.retryAfter = time.Duration(m.RetryAfter) * time.Millisecond
+	case *protocol.Registered:
+		c.id = m.ClientID
+	case *protocol.Joined:
+		c.client(m.ClientID).Name = m.Username
+	case *protocol.Quit:
+		delete(c.clients, m.ClientID)
+	case *protocol.OK:
+		return c.ot.ServerAck()
+	case *protocol.RemoteOp:
+		if err := c.ot.ApplyServer(m.Operation); err != nil {
+			return err
+		}
+		if m.Selection != nil {
+			c.client(m.ClientID).Selection = *c.ot.TransformSelection(m.Selection)
+		}
+	case *protocol.RemoteSel:
+		if m.Selection == nil {
+			c.client(m.ClientID).Selection = selection.Selection{Ranges: []selection.Range{}}
+		} else {
+			c.client(m.ClientID).Selection = *c.ot.TransformSelection(m.Selection)
+		}
+	}
+	return nil
+}
+
+// client returns the client with the given id, adding it if it is unknown
+func (c *Client) client(id string) *session.Client {
+	cl := c.clients[id]
+	if cl == nil {
+		cl = &session.Client{Selection: selection.Selection{Ranges: []selection.Range{}}}
+		c.clients[id] = cl
+	}
+	return cl
+}
+
+// dial connects to url, offering the protocols the client speaks. Servers
+// that do not negotiate speak protocol.Default.
+func dial(dialer *websocket.Dialer, url string) (*websocket.Conn, protocol.Protocol, error) {
+	header := http.Header{"Sec-WebSocket-Protocol": protocol.Subprotocols()}
+	ws, _, err := dialer.Dial(url, header)
+	if err != nil {
+		return nil, protocol.Protocol{}, err
+	}
+	if ws.Subprotocol() == "" {
+		return ws, protocol.Default, nil
+	}
+	p, err := protocol.Parse(ws.Subprotocol())
+	if err != nil {
+		ws.Close()
+		return nil, protocol.Protocol{}, err
+	}
+	return ws, p, nil
+}
+
+// readEvent reads the next event. Its message is nil for events the client
+// does not know, which newer servers may send.
+func readEvent(ws *websocket.Conn, p protocol.Protocol) (*Event, protocol.Message, error) {
+	_, msg, err := ws.ReadMessage()
+	if err != nil {
+		return nil, nil, err
+	}
+	m, err := protocol.DecodeServer(p, msg)
+	if derr, ok := err.(*protocol.DecodeError); ok && derr.Code == protocol.CodeUnknownEvent {
+		return &Event{Name: derr.Event}, nil, nil
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	if p.Binary() {
+		// OnEvent sees json either way
+		if msg, err = protocol.Encode(protocol.Default, m); err != nil {
+			return nil, nil, err
+		}
+	}
+	e := &Event{}
+	if err = json.Unmarshal(msg, e); err != nil {
+		return nil, nil, err
+	}
+	return e, m, nil
+}
+
+// send should be called with c.lock held
+func (c *Client) send(m protocol.Message) error {
+	j, err := protocol.Encode(c.proto, m)
+	if err != nil {
+		return err
+	}
+	if c.proto.Binary() {
+		return c.ws.WriteMessage(websocket.BinaryMessage, j)
+	}
+	return c.ws.WriteMessage(websocket.TextMessage, j)
+}
+
+// handler connects the ot client state machine to the websocket. Its methods
+// are called with c.lock held.
+type handler Client
+
+func (h *handler) SendOperation(revision int, op *operation.Operation) error {
+	c := (*Client)(h)
+	// a failed send leaves the operation outstanding; the read loop notices
+	// the broken connection and the operation is resent after Reconnect
+	c.send(&protocol.Op{Revision: revision, Operation: op, Selection: c.selection})
+	return nil
+}
+
+func (h *handler) ApplyOperation(op *operation.Operation) error {
+	c := (*Client)(h)
+	doc, err := op.Apply(c.document)
+	if err != nil {
+		return err
+	}
+	c.document = doc
+	// op is someone else's, so cursors stay in front of what it inserted.
+	// its author's selection comes along with it.
+	if c.selection != nil {
+		c.selection = c.selection.TransformWithBias(op, selection.BiasBefore)
+	}
+	for _, cl := range c.clients {
+		cl.Selection = *cl.Selection.TransformWithBias(op, selection.BiasBefore)
+	}
+	c.transformDiagnostics(op)
+	c.transformAnnotations(op)
+	return nil
+}
+
+// transformDiagnostics moves the diagnostics past op
+func (c *Client) transformDiagnostics(op *operation.Operation) {
+	for i, d := range c.diagnostics {
+		r := (&selection.Range{Anchor: d.From, Head: d.To}).Transform(op)
+		c.diagnostics[i].From, c.diagnostics[i].To = r.Anchor, r.Head
+	}
+}
+
+// setAnnotation keeps a, which is relative to the server's document, like
+// selections
+func (c *Client) setAnnotation(a session.Annotation) {
+	sel := c.ot.TransformSelection(&selection.Selection{Ranges: []selection.Range{{Anchor: a.From, Head: a.To}}})
+	r := sel.Ranges[0]
+	if r.Anchor == r.Head && a.From < a.To {
+		a.Orphaned = true
+	}
+	a.From, a.To = r.Anchor, r.Head
+	c.annotations[a.ID] = &a
+}
+
+// transformAnnotations moves the annotations past op
+func (c *Client) transformAnnotations(op *operation.Operation) {
+	for _, a := range c.annotations {
+		a.Transform(op)
+	}
+}
@@ -0,0 +1,205 @@
+package client
+
+import (
+	"errors"
+
+	"github.com/nitrous-io/ot.go/ot/operation"
+	"github.com/nitrous-io/ot.go/ot/selection"
+)
+
+var (
+	ErrNoPendingOperation = errors.New("ot/client: no pending operation")
+)
+
+// Handler is implemented by whatever connects the client to the server and
+// the local document.
+type Handler interface {
+	// SendOperation sends an operation based on the given revision to the server
+	SendOperation(revision int, op *operation.Operation) error
+	// ApplyOperation applies an operation coming from the server to the local document
+	ApplyOperation(op *operation.Operation) error
+}
+
+// Client is the client side of the ot.js protocol. It keeps track of the
+// operations that have been sent to the server but not yet acknowledged.
+type Client struct {
+	Revision int // the next expected revision number
+	State    State
+
+	handler Handler
+}
+
+func New(revision int, handler Handler) *Client {
+	return &Client{
+		Revision: revision,
+		State:    synchronized,
+		handler:  handler,
+	}
+}
+
+// ApplyClient should be called when the user changes the document
+func (c *Client) ApplyClient(op *operation.Operation) error {
+	state, err := c.State.applyClient(c, op)
+	if err != nil {
+		return err
+	}
+	c.State = state
+	return nil
+}
+
+// ApplyServer should be called with a new operation from the server
+func (c *Client) ApplyServer(op *operation.Operation) error {
+	state, err := c.State.applyServer(c, op)
+	if err != nil {
+		return err
+	}
+	c.Revision++
+	c.State = state
+	return nil
+}
+
+// ServerAck should be called when the server acknowledges the pending operation
+func (c *Client) ServerAck() error {
+	c.Revision++
+	state, err := c.State.serverAck(c)
+	if err != nil {
+		c.Revision--
+		return err
+	}
+	c.State = state
+	return nil
+}
+
+// ServerReconnect resends the outstanding operation, if any
+func (c *Client) ServerReconnect() error {
+	return c.State.resend(c)
+}
+
+// TransformSelection transforms a selection from the latest known server
+// state to the current client state.
+func (c *Client) TransformSelection(sel *selection.Selection) *selection.Selection {
+	return c.State.transformSelection(sel)
+}
+
+type State interface {
+	applyClient(c *Client, op *operation.Operation) (State, error)
+	applyServer(c *Client, op *operation.Operation) (State, error)
+	serverAck(c *Client) (State, error)
+	resend(c *Client) error
+	transformSelection(sel *selection.Selection) *selection.Selection
+}
+
+// Synchronized is the state where there is no pending operation that the
+// client has sent to the server.
+type Synchronized struct{}
+
+var synchronized = &Synchronized{}
+
+func (s *Synchronized) applyClient(c *Client, op *operation.Operation) (State, error) {
+	// send the operation to the server and wait for its acknowledgement
+	if err := c.handler.SendOperation(c.Revision, op); err != nil {
+		return nil, err
+	}
+	return &AwaitingConfirm{op}, nil
+}
+
+func (s *Synchronized) applyServer(c *Client, op *operation.Operation) (State, error) {
+	// the operation can simply be applied to the current document
+	if err := c.handler.ApplyOperation(op); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *Synchronized) serverAck(c *Client) (State, error) {
+	return nil, ErrNoPendingOperation
+}
+
+func (s *Synchronized) resend(c *Client) error {
+	return nil
+}
+
+func (s *Synchronized) transformSelection(sel *selection.Selection) *selection.Selection {
+	return sel
+}
+
+// AwaitingConfirm is the state where there is one operation the client has
+// sent to the server that is still waiting for an acknowledgement.
+type AwaitingConfirm struct {
+	Outstanding *operation.Operation
+}
+
+func (s *AwaitingConfirm) applyClient(c *Client, op *operation.Operation) (State, error) {
+	// buffer the operation instead of sending it right away
+	return &AwaitingWithBuffer{s.Outstanding, op}, nil
+}
+
+func (s *AwaitingConfirm) applyServer(c *Client, op *operation.Operation) (State, error) {
+	outstanding, op1, err := operation.Transform(s.Outstanding, op)
+	if err != nil {
+		return nil, err
+	}
+	if err = c.handler.ApplyOperation(op1); err != nil {
+		return nil, err
+	}
+	return &AwaitingConfirm{outstanding}, nil
+}
+
+func (s *AwaitingConfirm) serverAck(c *Client) (State, error) {
+	return synchronized, nil
+}
+
+func (s *AwaitingConfirm) resend(c *Client) error {
+	return c.handler.SendOperation(c.Revision, s.Outstanding)
+}
+
+func (s *AwaitingConfirm) transformSelection(sel *selection.Selection) *selection.Selection {
+	return sel.Transform(s.Outstanding)
+}
+
+// AwaitingWithBuffer is the state where the client is waiting for an
+// operation to be acknowledged while buffering the edits the user makes.
+type AwaitingWithBuffer struct {
+	Outstanding *operation.Operation
+	Buffer      *operation.Operation
+}
+
+func (s *AwaitingWithBuffer) applyClient(c *Client, op *operation.Operation) (State, error) {
+	// compose the user's changes onto the buffer
+	buffer, err := operation.Compose(s.Buffer, op)
+	if err != nil {
+		return nil, err
+	}
+	return &AwaitingWithBuffer{s.Outstanding, buffer}, nil
+}
+
+func (s *AwaitingWithBuffer) applyServer(c *Client, op *operation.Operation) (State, error) {
+	outstanding, op1, err := operation.Transform(s.Outstanding, op)
+	if err != nil {
+		return nil, err
+	}
+	buffer, op2, err := operation.Transform(s.Buffer, op1)
+	if err != nil {
+		return nil, err
+	}
+	if err = c.handler.ApplyOperation(op2); err != nil {
+		return nil, err
+	}
+	return &AwaitingWithBuffer{outstanding, buffer}, nil
+}
+
+func (s *AwaitingWithBuffer) serverAck(c *Client) (State, error) {
+	// the outstanding operation has been acknowledged -> send the buffer
+	if err := c.handler.SendOperation(c.Revision, s.Buffer); err != nil {
+		return nil, err
+	}
+	return &AwaitingConfirm{s.Buffer}, nil
+}
+
+func (s *AwaitingWithBuffer) resend(c *Client) error {
+	return c.handler.SendOperation(c.Revision, s.Outstanding)
+}
+
+func (s *AwaitingWithBuffer) transformSelection(sel *selection.Selection) *selection.Selection {
+	return sel.Transform(s.Outstanding).Transform(s.Buffer)
+}
@@ -0,0 +1,170 @@
+package client_test
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/nitrous-io/ot.go/ot/client"
+	"github.com/nitrous-io/ot.go/ot/operation"
+	"github.com/nitrous-io/ot.go/ot/selection"
+)
+
+type sentOp struct {
+	revision int
+	op       *operation.Operation
+}
+
+type testHandler struct {
+	doc  string
+	sent []sentOp
+}
+
+func (h *testHandler) SendOperation(revision int, op *operation.Operation) error {
+	h.sent = append(h.sent, sentOp{revision, op})
+	return nil
+}
+
+func (h *testHandler) ApplyOperation(op *operation.Operation) error {
+	doc, err := op.Apply(h.doc)
+	if err != nil {
+		return err
+	}
+	h.doc = doc
+	return nil
+}
+
+func TestNew(t *testing.T) {
+	c := client.New(3, &testHandler{})
+
+	if actual, expected := c.Revision, 3; actual != expected {
+		t.Errorf("expected revision to be %d, got %d", expected, actual)
+	}
+
+	if _, ok := c.State.(*client.Synchronized); !ok {
+		t.Errorf("expected state to be Synchronized, got %T", c.State)
+	}
+}
+
+func TestClient(t *testing.T) {
+	h := &testHandler{doc: "lorem"}
+	c := client.New(1, h)
+
+	// server op while synchronized is applied as is
+	if err := c.ApplyServer(operation.New().Retain(5).Insert(" ipsum")); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	if actual, expected := h.doc, "lorem ipsum"; actual != expected {
+		t.Errorf("expected document to be %s, got %s", expected, actual)
+	}
+
+	if actual, expected := c.Revision, 2; actual != expected {
+		t.Errorf("expected revision to be %d, got %d", expected, actual)
+	}
+
+	if err := c.ServerAck(); err != client.ErrNoPendingOperation {
+		t.Errorf("expected ErrNoPendingOperation, got %v", err)
+	}
+
+	if actual, expected := c.Revision, 2; actual != expected {
+		t.Errorf("expected revision to be %d, got %d", expected, actual)
+	}
+
+	// user edit is sent right away
+	op1 := operation.New().Delete(1).Insert("L").Retain(10)
+	if err := c.ApplyClient(op1); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	if actual, expected := h.sent, []sentOp{{2, op1}}; !reflect.DeepEqual(actual, expected) {
+		t.Errorf("expected sent operations to equal %+v, got %+v", expected, actual)
+	}
+
+	if s, ok := c.State.(*client.AwaitingConfirm); !ok || s.Outstanding != op1 {
+		t.Errorf("expected state to be AwaitingConfirm with outstanding %+v, got %+v", op1, c.State)
+	}
+
+	// further user edits are buffered
+	op2 := operation.New().Retain(11).Insert(" dolor")
+	if err := c.ApplyClient(op2); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	op3 := operation.New().Retain(17).Insert("!")
+	if err := c.ApplyClient(op3); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	if actual, expected := len(h.sent), 1; actual != expected {
+		t.Errorf("expected %d sent operations, got %d", expected, actual)
+	}
+
+	s, ok := c.State.(*client.AwaitingWithBuffer)
+	if !ok {
+		t.Fatalf("expected state to be AwaitingWithBuffer, got %T", c.State)
+	}
+
+	if expected := operation.New().Retain(11).Insert(" dolor!"); !reflect.DeepEqual(s.Buffer, expected) {
+		t.Errorf("expected buffer to equal %+v, got %+v", expected, s.Buffer)
+	}
+
+	// local document is "Lorem ipsum dolor!"; server doc is still "lorem ipsum"
+	h.doc = "Lorem ipsum dolor!"
+
+	// a concurrent server op is transformed against outstanding and buffer;
+	// selections from the server are transformed to the local document
+	sel := &selection.Selection{Ranges: []selection.Range{{Anchor: 7, Head: 12}}}
+	if err := c.ApplyServer(operation.New().Retain(5).Insert(",").Retain(6)); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	if actual, expected := h.doc, "Lorem, ipsum dolor!"; actual != expected {
+		t.Errorf("expected document to be %s, got %s", expected, actual)
+	}
+
+	if actual, expected := c.Revision, 3; actual != expected {
+		t.Errorf("expected revision to be %d, got %d", expected, actual)
+	}
+
+	if actual, expected := c.TransformSelection(sel), (&selection.Selection{Ranges: []selection.Range{{Anchor: 7, Head: 19}}}); !reflect.DeepEqual(actual, expected) {
+		t.Errorf("expected transformed selection to equal %+v, got %+v", expected, actual)
+	}
+
+	// reconnecting resends the outstanding operation
+	if err := c.ServerReconnect(); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	if actual, expected := len(h.sent), 2; actual != expected {
+		t.Fatalf("expected %d sent operations, got %d", expected, actual)
+	}
+
+	if actual, expected := h.sent[1].op, operation.New().Delete(1).Insert("L").Retain(11); !reflect.DeepEqual(actual, expected) {
+		t.Errorf("expected resent operation to equal %+v, got %+v", expected, actual)
+	}
+
+	// ack sends the buffer
+	if err := c.ServerAck(); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	if actual, expected := c.Revision, 4; actual != expected {
+		t.Errorf("expected revision to be %d, got %d", expected, actual)
+	}
+
+	if actual, expected := h.sent[2], (sentOp{4, operation.New().Retain(12).Insert(" dolor!")}); !reflect.DeepEqual(actual, expected) {
+		t.Errorf("expected sent operation to equal %+v, got %+v", expected, actual)
+	}
+
+	if _, ok := c.State.(*client.AwaitingConfirm); !ok {
+		t.Errorf("expected state to be AwaitingConfirm, got %T", c.State)
+	}
+
+	if err := c.ServerAck(); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	if _, ok := c.State.(*client.Synchronized); !ok {
+		t.Errorf("expected state to be Synchronized, got %T", c.State)
+	}
+}
@@ -11,6 +11,7 @@ import (
 var (
 	ErrBaseLenMismatch = errors.New("ot/operation: base length mismatch")
 	ErrTransformFailed = errors.New("ot/operation: transform failed")
+	ErrComposeFailed   = errors.New("ot/operation: compose failed")
 	ErrMarshalFailed   = errors.New("ot/operation: marshal failed")
 	ErrUnmarshalFailed = errors.New("ot/operation: unmarshal failed")
 )
@@ -78,6 +79,17 @@ func (t *Operation) Insert(s string) *Operation {
 	if ot.TextEncoding == ot.TextEncodingTypeUTF16 {
 		r = uint16sToRunes(utf16.Encode(r))
 	}
+
+	return t.insertRunes(r)
+}
+
+// insertRunes inserts chars that are already in the current text encoding
+func (t *Operation) insertRunes(r []rune) *Operation {
+	if len(r) == 0 {
+		return t
+	}
+	// copy so that merging later inserts never writes into the caller's slice
+	r = append([]rune{}, r...)
 	t.TargetLen += len(r)
 
 	last := t.LastOp()
@@ -318,6 +330,124 @@ func Transform(a, b *Operation) (*Operation, *Operation, error) {
 	return a1, b1, nil
 }
 
+// Compose merges two consecutive operations into one operation that has the
+// same effect as applying a and then b.
+func Compose(a, b *Operation) (*Operation, error) {
+	if a.TargetLen != b.BaseLen {
+		return nil, ErrBaseLenMismatch
+	}
+
+	ab := New()
+	iA, iB := 0, 0
+	opA, opB := a.At(iA), b.At(iB)
+
+	nextOpA := func() {
+		iA++
+		opA = a.At(iA)
+	}
+	nextOpB := func() {
+		iB++
+		opB = b.At(iB)
+	}
+
+	for !(opA == nil && opB == nil) {
+		// deletes in A and inserts in B are not affected by the other op
+		if opA != nil && IsDelete(opA) {
+			ab.Delete(-opA.N)
+			nextOpA()
+			continue
+		} else if opB != nil && IsInsert(opB) {
+			ab.insertRunes(opB.S)
+			nextOpB()
+			continue
+		}
+
+		if opA == nil || opB == nil {
+			return nil, ErrComposeFailed
+		}
+
+		// retain/retain
+		if IsRetain(opA) && IsRetain(opB) {
+			min, nA, nB := 0, opA.N, opB.N
+			if nA > nB {
+				min = nB
+				opA = &Op{N: nA - nB}
+				nextOpB()
+			} else if nA < nB {
+				min = nA
+				nextOpA()
+				opB = &Op{N: nB - nA}
+			} else {
+				min = nA
+				nextOpA()
+				nextOpB()
+			}
+			ab.Retain(min)
+			continue
+		}
+
+		// insert/delete
+		// B deletes what A inserted, so neither makes it into the result
+		if IsInsert(opA) && IsDelete(opB) {
+			nA, nB := len(opA.S), -opB.N
+			if nA > nB {
+				opA = &Op{S: opA.S[nB:]}
+				nextOpB()
+			} else if nA < nB {
+				nextOpA()
+				opB = &Op{N: -(nB - nA)}
+			} else {
+				nextOpA()
+				nextOpB()
+			}
+			continue
+		}
+
+		// insert/retain
+		if IsInsert(opA) && IsRetain(opB) {
+			nA, nB := len(opA.S), opB.N
+			if nA > nB {
+				ab.insertRunes(opA.S[:nB])
+				opA = &Op{S: opA.S[nB:]}
+				nextOpB()
+			} else if nA < nB {
+				ab.insertRunes(opA.S)
+				nextOpA()
+				opB = &Op{N: nB - nA}
+			} else {
+				ab.insertRunes(opA.S)
+				nextOpA()
+				nextOpB()
+			}
+			continue
+		}
+
+		// retain/delete
+		if IsRetain(opA) && IsDelete(opB) {
+			min, nA, nB := 0, opA.N, -opB.N
+			if nA > nB {
+				min = nB
+				opA = &Op{N: nA - nB}
+				nextOpB()
+			} else if nA < nB {
+				min = nA
+				nextOpA()
+				opB = &Op{N: -(nB - nA)}
+			} else {
+				min = nA
+				nextOpA()
+				nextOpB()
+			}
+			ab.Delete(min)
+			continue
+		}
+
+		return nil, ErrComposeFailed
+	}
+
+	return ab, nil
+}
+
 func Unmarshal(ops []interface{}) (*Operation, error) {
 	top := &Operation{}
 	for _, o := range ops {
@@ -450,6 +450,93 @@ func TestTransform(t *testing.T) {
 	testTransform(s, o, a, b)
 }
 
+func TestCompose(t *testing.T) {
+	ot.TextEncoding = ot.TextEncodingTypeUTF8
+	defer func() {
+		ot.TextEncoding = ot.TextEncodingTypeUTF8
+	}()
+
+	a := operation.New().Retain(1)
+
+	b := operation.New().Retain(2)
+
+	_, err := operation.Compose(a, b)
+
+	if err != operation.ErrBaseLenMismatch {
+		t.Errorf("expected ErrBaseLenMismatch, got %v", err)
+	}
+
+	// apply(S, compose(A, B)) = apply(apply(S, A), B)
+
+	testCompose := func(s, o string, a, b *operation.Operation) {
+		ab, err := operation.Compose(a, b)
+
+		if err != nil {
+			t.Fatalf("expected no error composing, got %v", err)
+		}
+
+		if actual, expected := ab.BaseLen, a.BaseLen; actual != expected {
+			t.Errorf("expected base length of %d, got %d", expected, actual)
+		}
+
+		if actual, expected := ab.TargetLen, b.TargetLen; actual != expected {
+			t.Errorf("expected target length of %d, got %d", expected, actual)
+		}
+
+		as, err := a.Apply(s)
+		if err != nil {
+			t.Fatalf("expected no error applying A, got %v", err)
+		}
+
+		bs, err := b.Apply(as)
+		if err != nil {
+			t.Fatalf("expected no error applying B, got %v", err)
+		}
+
+		if actual, expected := bs, o; actual != expected {
+			t.Fatalf("expected %s, got %s", expected, actual)
+		}
+
+		abs, err := ab.Apply(s)
+		if err != nil {
+			t.Fatalf("expected no error applying composed op, got %v", err)
+		}
+
+		if actual, expected := abs, o; actual != expected {
+			t.Fatalf("expected %s, got %s", expected, actual)
+		}
+	}
+
+	s := "She is a girl!!!"
+	o := "He was 정말로 a beautiful girl."
+	a = operation.New().Delete(2).Insert("H").Retain(2).Delete(2).Insert("was").Retain(8).Delete(2)
+	b = operation.New().Retain(7).Insert("정말로 ").Retain(2).Insert("beautiful ").Retain(4).Delete(1).Insert(".")
+
+	testCompose(s, o, a, b)
+
+	// B deletes part of what A inserted
+	s = "abc"
+	o = "aXc"
+	a = operation.New().Retain(1).Insert("XYZ").Retain(2)
+	b = operation.New().Retain(2).Delete(3).Retain(1)
+
+	testCompose(s, o, a, b)
+
+	if actual, expected := a, operation.New().Retain(1).Insert("XYZ").Retain(2); !reflect.DeepEqual(actual, expected) {
+		t.Errorf("expected composing not to modify %+v, got %+v", expected, actual)
+	}
+
+	// utf-16
+	ot.TextEncoding = ot.TextEncodingTypeUTF16
+
+	s = "She is 😝 girl👧!"
+	o = "He is 👍👍 girl!"
+	a = operation.New().Delete(2).Insert("H").Retain(5).Delete(2).Insert("👍").Retain(5).Delete(2).Retain(1)
+	b = operation.New().Retain(8).Insert("👍").Retain(6)
+
+	testCompose(s, o, a, b)
+}
+
 func TestMarshal(t *testing.T) {
 	ot.TextEncoding = ot.TextEncodingTypeUTF8
 	defer func() {
@@ -0,0 +1,230 @@
+package position
+
+import (
+	"errors"
+	"sort"
+	"unicode"
+	"unicode/utf16"
+
+	"github.com/nitrous-io/ot.go/ot"
+	"github.com/nitrous-io/ot.go/ot/operation"
+)
+
+var (
+	ErrInvalidOffset   = errors.New("ot/position: invalid offset")
+	ErrInvalidPosition = errors.New("ot/position: invalid position")
+)
+
+// Position is a zero based line and column in a document.
+type Position struct {
+	Line   int `json:"line"`
+	Column int `json:"column"`
+}
+
+// Index converts offsets into a document to positions and back. Offsets count
+// units of ot.TextEncoding as it was when the index was made, like operations
+// and selections do. Columns count units of the index's column encoding,
+// which for LSP is usually ot.TextEncodingTypeUTF16.
+//
+// Lines end with LF or CRLF. The line break is not part of the line, so
+// columns past the end of a line are moved to its end.
+type Index struct {
+	offsets ot.TextEncodingType
+	columns ot.TextEncodingType
+
+	// lines hold the units of each line, including the line break
+	lines [][]rune
+	// starts are the offsets at which the lines start
+	starts []int
+}
+
+// New returns an index of doc whose columns count units of columns.
+func New(doc string, columns ot.TextEncodingType) *Index {
+	x := &Index{
+		offsets: ot.TextEncodingType(ot.TextEncoding),
+		columns: columns,
+	}
+	units := []rune(doc)
+	if x.offsets == ot.TextEncodingTypeUTF16 {
+		units = uint16sToRunes(utf16.Encode(units))
+	}
+	x.lines = splitLines(units, true)
+	x.starts = make([]int, len(x.lines))
+	for i := 1; i < len(x.lines); i++ {
+		x.starts[i] = x.starts[i-1] + len(x.lines[i-1])
+	}
+	return x
+}
+
+// Len returns the length of the document.
+func (x *Index) Len() int {
+	last := len(x.lines) - 1
+	return x.starts[last] + len(x.lines[last])
+}
+
+// Lines returns the number of lines of the document, which is one more than
+// the number of line breaks.
+func (x *Index) Lines() int {
+	return len(x.lines)
+}
+
+// Position returns the position of offset.
+func (x *Index) Position(offset int) (Position, error) {
+	if offset < 0 || offset > x.Len() {
+		return Position{}, ErrInvalidOffset
+	}
+	i := x.lineAt(offset)
+	line := content(x.lines[i])
+	n := offset - x.starts[i]
+	if n > len(line) {
+		// in the middle of a CRLF
+		n = len(line)
+	}
+	return Position{i, x.toColumns(line[:n])}, nil
+}
+
+// Offset returns the offset of p. A column past the end of its line is the
+// end of the line.
+func (x *Index) Offset(p Position) (int, error) {
+	if p.Line < 0 || p.Line >= len(x.lines) || p.Column < 0 {
+		return 0, ErrInvalidPosition
+	}
+	return x.starts[p.Line] + x.fromColumns(content(x.lines[p.Line]), p.Column), nil
+}
+
+// Apply updates the index for op, which is applied to the document. Only the
+// lines op changes are split again.
+func (x *Index) Apply(op *operation.Operation) error {
+	if op.BaseLen != x.Len() {
+		return operation.ErrBaseLenMismatch
+	}
+	// i is the offset in the document as changed so far
+	i := 0
+	for _, o := range op.Ops {
+		if operation.IsRetain(o) {
+			i += o.N
+		} else if operation.IsInsert(o) {
+			x.splice(i, i, o.S)
+			i += len(o.S)
+		} else if operation.IsDelete(o) {
+			x.splice(i, i-o.N, nil) // N is negative
+		}
+	}
+	return nil
+}
+
+// splice replaces the units between from and to with s
+func (x *Index) splice(from, to int, s []rune) {
+	i, j := x.lineAt(from), x.lineAt(to)
+	text := append([]rune{}, x.lines[i][:from-x.starts[i]]...)
+	text = append(text, s...)
+	text = append(text, x.lines[j][to-x.starts[j]:]...)
+	lines := splitLines(text, j == len(x.lines)-1)
+
+	starts := make([]int, len(lines))
+	starts[0] = x.starts[i]
+	for k := 1; k < len(lines); k++ {
+		starts[k] = starts[k-1] + len(lines[k-1])
+	}
+	// the lines after the change only move
+	delta := len(s) - (to - from)
+	rest := x.starts[j+1:]
+	for k := range rest {
+		rest[k] += delta
+	}
+
+	x.lines = append(x.lines[:i], append(lines, x.lines[j+1:]...)...)
+	x.starts = append(x.starts[:i], append(starts, rest...)...)
+}
+
+// lineAt returns the line offset is in. The offset after a line break is in
+// the next line.
+func (x *Index) lineAt(offset int) int {
+	return sort.Search(len(x.starts), func(i int) bool { return x.starts[i] > offset }) - 1
+}
+
+// toColumns returns the number of column units in units
+func (x *Index) toColumns(units []rune) int {
+	if x.offsets == x.columns {
+		return len(units)
+	}
+	if x.offsets == ot.TextEncodingTypeUTF16 {
+		return len(utf16.Decode(runesToUint16s(units)))
+	}
+	return len(utf16.Encode(units))
+}
+
+// fromColumns returns the number of units in the first n column units of
+// line, or all of them if there are fewer. A column in the middle of a
+// character is moved to its start.
+func (x *Index) fromColumns(line []rune, n int) int {
+	if x.offsets == x.columns {
+		if n > len(line) {
+			return len(line)
+		}
+		return n
+	}
+	i := 0
+	for n > 0 && i < len(line) {
+		units, width := 1, 1
+		if x.offsets == ot.TextEncodingTypeUTF16 {
+			if i+1 < len(line) && utf16.IsSurrogate(line[i]) && utf16.DecodeRune(line[i], line[i+1]) != unicode.ReplacementChar {
+				units = 2
+			}
+		} else if line[i] >= 0x10000 && line[i] <= unicode.MaxRune {
+			// encoded as a surrogate pair
+			width = 2
+		}
+		if width > n {
+			break
+		}
+		i += units
+		n -= width
+	}
+	return i
+}
+
+// splitLines splits units after each LF. The text after the last one is a
+// line only if it is not empty, or if units end the document.
+func splitLines(units []rune, last bool) [][]rune {
+	var lines [][]rune
+	start := 0
+	for i, u := range units {
+		if u == '\n' {
+			lines = append(lines, units[start:i+1:i+1])
+			start = i + 1
+		}
+	}
+	if start < len(units) || last {
+		lines = append(lines, units[start:len(units):len(units)])
+	}
+	return lines
+}
+
+// content returns line without its line break
+func content(line []rune) []rune {
+	n := len(line)
+	if n > 0 && line[n-1] == '\n' {
+		n--
+		if n > 0 && line[n-1] == '\r' {
+			n--
+		}
+	}
+	return line[:n]
+}
+
+func uint16sToRunes(s []uint16) []rune {
+	r := make([]rune, len(s))
+	for i, c := range s {
+		r[i] = rune(c)
+	}
+	return r
+}
+
+func runesToUint16s(r []rune) []uint16 {
+	s := make([]uint16, len(r))
+	for i, c := range r {
+		s[i] = uint16(c)
+	}
+	return s
+}
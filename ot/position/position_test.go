@@ -0,0 +1,186 @@
+package position_test
+
+import (
+	"testing"
+
+	"github.com/nitrous-io/ot.go/ot"
+	"github.com/nitrous-io/ot.go/ot/operation"
+	"github.com/nitrous-io/ot.go/ot/position"
+)
+
+const doc = "ab\r\ncd\n\nü😀x"
+
+func TestPosition(t *testing.T) {
+	x := position.New(doc, ot.TextEncodingTypeUTF16)
+	if actual, expected := x.Len(), 11; actual != expected {
+		t.Errorf("expected length %d, got %d", expected, actual)
+	}
+	if actual, expected := x.Lines(), 4; actual != expected {
+		t.Errorf("expected %d lines, got %d", expected, actual)
+	}
+
+	for _, tc := range []struct {
+		offset   int
+		expected position.Position
+	}{
+		{0, position.Position{0, 0}},
+		{2, position.Position{0, 2}},
+		// between CR and LF
+		{3, position.Position{0, 2}},
+		{4, position.Position{1, 0}},
+		{7, position.Position{2, 0}},
+		{8, position.Position{3, 0}},
+		{9, position.Position{3, 1}},
+		// the emoji takes two UTF-16 columns
+		{10, position.Position{3, 3}},
+		{11, position.Position{3, 4}},
+	} {
+		actual, err := x.Position(tc.offset)
+		if err != nil {
+			t.Errorf("expected no error for %d, got %v", tc.offset, err)
+		}
+		if actual != tc.expected {
+			t.Errorf("expected %+v for %d, got %+v", tc.expected, tc.offset, actual)
+		}
+	}
+	for _, offset := range []int{-1, 12} {
+		if _, err := x.Position(offset); err != position.ErrInvalidOffset {
+			t.Errorf("expected ErrInvalidOffset for %d, got %v", offset, err)
+		}
+	}
+}
+
+func TestOffset(t *testing.T) {
+	x := position.New(doc, ot.TextEncodingTypeUTF16)
+
+	for _, tc := range []struct {
+		position position.Position
+		expected int
+	}{
+		{position.Position{0, 1}, 1},
+		// past the end of the line, which does not include the CRLF
+		{position.Position{0, 5}, 2},
+		{position.Position{1, 2}, 6},
+		{position.Position{2, 0}, 7},
+		{position.Position{3, 1}, 9},
+		// in the middle of the emoji
+		{position.Position{3, 2}, 9},
+		{position.Position{3, 3}, 10},
+		{position.Position{3, 9}, 11},
+	} {
+		actual, err := x.Offset(tc.position)
+		if err != nil {
+			t.Errorf("expected no error for %+v, got %v", tc.position, err)
+		}
+		if actual != tc.expected {
+			t.Errorf("expected %d for %+v, got %d", tc.expected, tc.position, actual)
+		}
+	}
+	for _, p := range []position.Position{{-1, 0}, {4, 0}, {0, -1}} {
+		if _, err := x.Offset(p); err != position.ErrInvalidPosition {
+			t.Errorf("expected ErrInvalidPosition for %+v, got %v", p, err)
+		}
+	}
+}
+
+func TestEncodings(t *testing.T) {
+	defer func() {
+		ot.TextEncoding = ot.TextEncodingTypeUTF8
+	}()
+
+	for _, tc := range []struct {
+		offsets, columns int
+		length           int
+		offset           int
+		expected         position.Position
+	}{
+		{ot.TextEncodingTypeUTF8, ot.TextEncodingTypeUTF8, 11, 10, position.Position{3, 2}},
+		{ot.TextEncodingTypeUTF8, ot.TextEncodingTypeUTF16, 11, 10, position.Position{3, 3}},
+		{ot.TextEncodingTypeUTF16, ot.TextEncodingTypeUTF8, 12, 11, position.Position{3, 2}},
+		{ot.TextEncodingTypeUTF16, ot.TextEncodingTypeUTF16, 12, 11, position.Position{3, 3}},
+	} {
+		ot.TextEncoding = tc.offsets
+		x := position.New(doc, ot.TextEncodingType(tc.columns))
+		if actual := x.Len(); actual != tc.length {
+			t.Errorf("expected length %d in encoding %d, got %d", tc.length, tc.offsets, actual)
+		}
+		if actual, _ := x.Position(tc.offset); actual != tc.expected {
+			t.Errorf("expected %+v for %d in encodings %d/%d, got %+v", tc.expected, tc.offset, tc.offsets, tc.columns, actual)
+		}
+		if actual, _ := x.Offset(tc.expected); actual != tc.offset {
+			t.Errorf("expected %d for %+v in encodings %d/%d, got %d", tc.offset, tc.expected, tc.offsets, tc.columns, actual)
+		}
+	}
+}
+
+func TestApply(t *testing.T) {
+	defer func() {
+		ot.TextEncoding = ot.TextEncodingTypeUTF8
+	}()
+
+	for _, encoding := range []int{ot.TextEncodingTypeUTF8, ot.TextEncodingTypeUTF16} {
+		ot.TextEncoding = encoding
+		d := "ab\r\ncd\n\nef"
+		x := position.New(d, ot.TextEncodingTypeUTF16)
+
+		for _, op := range []*operation.Operation{
+			// within a line
+			operation.New().Retain(1).Insert("ü").Retain(9),
+			// a new line, and one more at the end
+			operation.New().Retain(6).Insert("\n").Retain(5).Insert("\r\n"),
+			// a lone CR is not a line break
+			operation.New().Retain(1).Insert("x\r").Retain(13),
+			// until a LF is inserted after it
+			operation.New().Retain(3).Insert("\n").Retain(13),
+			// deleting across lines joins them
+			operation.New().Retain(2).Delete(9).Retain(6),
+			// the CR of a CRLF
+			operation.New().Retain(6).Delete(1).Retain(1),
+			// a CR inserted before a LF, and deleting what is between them
+			operation.New().Retain(6).Insert("\r").Retain(1),
+			operation.New().Retain(5).Insert("\r").Retain(3),
+			operation.New().Retain(6).Delete(1).Retain(2),
+			// everything
+			operation.New().Delete(8).Insert("\n\n"),
+			operation.New().Retain(1).Insert("😀").Retain(1),
+		} {
+			var err error
+			if d, err = op.Apply(d); err != nil {
+				t.Fatalf("expected no error applying %v, got %v", op, err)
+			}
+			if err = x.Apply(op); err != nil {
+				t.Fatalf("expected no error applying %v to the index, got %v", op, err)
+			}
+			compare(t, x, position.New(d, ot.TextEncodingTypeUTF16), d)
+		}
+	}
+
+	x := position.New("abc", ot.TextEncodingTypeUTF8)
+	if err := x.Apply(operation.New().Retain(4)); err != operation.ErrBaseLenMismatch {
+		t.Errorf("expected ErrBaseLenMismatch, got %v", err)
+	}
+}
+
+// compare checks that x, updated by operations, agrees with expected, which
+// was made from d
+func compare(t *testing.T, x, expected *position.Index, d string) {
+	if x.Len() != expected.Len() || x.Lines() != expected.Lines() {
+		t.Errorf("expected %d units in %d lines for %q, got %d in %d", expected.Len(), expected.Lines(), d, x.Len(), x.Lines())
+		return
+	}
+	for i := 0; i <= x.Len(); i++ {
+		actual, _ := x.Position(i)
+		if p, _ := expected.Position(i); actual != p {
+			t.Errorf("expected %+v for %d in %q, got %+v", p, i, d, actual)
+		}
+	}
+	for line := 0; line < x.Lines(); line++ {
+		for column := 0; column < 6; column++ {
+			p := position.Position{line, column}
+			actual, _ := x.Offset(p)
+			if offset, _ := expected.Offset(p); actual != offset {
+				t.Errorf("expected %d for %+v in %q, got %d", offset, p, d, actual)
+			}
+		}
+	}
+}
@@ -7,17 +7,36 @@ type Range struct {
 	Head   int `json:"head"`
 }
 
+// Bias decides where an index goes when text is inserted exactly at it.
+type Bias int
+
+const (
+	// BiasAfter moves the index past the inserted text, which is where the
+	// author of the insert wants their own cursor.
+	BiasAfter Bias = iota
+	// BiasBefore keeps the index in front of the inserted text, which is
+	// where other users want theirs.
+	BiasBefore
+)
+
 func (r *Range) Transform(op *operation.Operation) *Range {
-	return &Range{transformIndex(r.Anchor, op), transformIndex(r.Head, op)}
+	return r.TransformWithBias(op, BiasAfter)
+}
+
+// TransformWithBias is Transform with the given bias for inserts at either
+// end of the range.
+func (r *Range) TransformWithBias(op *operation.Operation, bias Bias) *Range {
+	return &Range{transformIndex(r.Anchor, op, bias), transformIndex(r.Head, op, bias)}
 }
 
-func transformIndex(i int, op *operation.Operation) int {
+func transformIndex(i int, op *operation.Operation, bias Bias) int {
 	// start cursor at index 0
 	j := 0
 
 	for _, op := range op.Ops {
-		// if cursor index is greater than i, the rest of the ops are irrelevant
-		if j > i {
+		// if cursor index is greater than i, the rest of the ops are irrelevant.
+		// so are inserts at i if the index stays before them.
+		if j > i || j == i && bias == BiasBefore {
 			break
 		}
 		if operation.IsRetain(op) {
@@ -43,3 +62,16 @@ func max(a, b int) int {
 		return b
 	}
 }
+
+func min(a, b int) int {
+	if a < b {
+		return a
+	} else {
+		return b
+	}
+}
+
+// clamp returns i limited to the indexes of a document of n units
+func clamp(i, n int) int {
+	return max(0, min(i, n))
+}
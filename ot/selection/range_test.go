@@ -100,3 +100,35 @@ func TestRangeTransform(t *testing.T) {
 		t.Errorf("expected %+v, got %+v", expected, actual)
 	}
 }
+
+func TestRangeTransformWithBias(t *testing.T) {
+	r := &selection.Range{5, 9}
+
+	for _, tc := range []struct {
+		op     *operation.Operation
+		after  selection.Range
+		before selection.Range
+	}{
+		// inserts at either end
+		{operation.New().Retain(5).Insert("abc").Retain(5), selection.Range{8, 12}, selection.Range{5, 12}},
+		{operation.New().Retain(9).Insert("abc").Retain(1), selection.Range{5, 12}, selection.Range{5, 9}},
+		// inserts elsewhere are not affected
+		{operation.New().Retain(4).Insert("abc").Retain(6), selection.Range{8, 12}, selection.Range{8, 12}},
+		{operation.New().Retain(6).Insert("abc").Retain(4), selection.Range{5, 12}, selection.Range{5, 12}},
+		// an insert where a delete moved the anchor to
+		{operation.New().Delete(2).Retain(3).Insert("abc").Retain(5), selection.Range{6, 10}, selection.Range{3, 10}},
+	} {
+		if actual, expected := r.TransformWithBias(tc.op, selection.BiasAfter), &tc.after; !reflect.DeepEqual(actual, expected) {
+			t.Errorf("expected %+v after %v, got %+v", expected, tc.op, actual)
+		}
+		if actual, expected := r.TransformWithBias(tc.op, selection.BiasBefore), &tc.before; !reflect.DeepEqual(actual, expected) {
+			t.Errorf("expected %+v before %v, got %+v", expected, tc.op, actual)
+		}
+	}
+
+	// Transform moves the range after inserts
+	top := operation.New().Insert("abc").Retain(10)
+	if actual, expected := r.Transform(top), r.TransformWithBias(top, selection.BiasAfter); !reflect.DeepEqual(actual, expected) {
+		t.Errorf("expected %+v, got %+v", expected, actual)
+	}
+}
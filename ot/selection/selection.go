@@ -2,12 +2,14 @@ package selection
 
 import (
 	"errors"
+	"sort"
 
 	"github.com/nitrous-io/ot.go/ot/operation"
 )
 
 var (
 	ErrUnmarshalFailed = errors.New("ot/selection: unmarshal failed")
+	ErrOutOfRange      = errors.New("ot/selection: range outside of the document")
 )
 
 type Selection struct {
@@ -15,13 +17,78 @@ type Selection struct {
 }
 
 func (s *Selection) Transform(op *operation.Operation) *Selection {
+	return s.TransformWithBias(op, BiasAfter)
+}
+
+// TransformWithBias is Transform with the given bias for inserts at the ends
+// of the ranges.
+func (s *Selection) TransformWithBias(op *operation.Operation, bias Bias) *Selection {
 	tr := make([]Range, len(s.Ranges))
 	for i, r := range s.Ranges {
-		tr[i] = *r.Transform(op)
+		tr[i] = *r.TransformWithBias(op, bias)
 	}
 	return &Selection{tr}
 }
 
+// Normalize returns s repaired for a document of docLen units. Indexes are
+// clamped to the document, and ranges are sorted by where they start, those
+// that overlap or touch merged into one. The first range given is the primary
+// one, which editors keep in view, so the range it ends up in comes first,
+// followed by the others in order. A range that lies entirely outside of the
+// document cannot be repaired and is an ErrOutOfRange.
+func (s *Selection) Normalize(docLen int) (*Selection, error) {
+	type span struct {
+		from, to          int
+		backward, primary bool
+	}
+
+	spans := make([]span, len(s.Ranges))
+	for i, r := range s.Ranges {
+		if r.Anchor < 0 && r.Head < 0 || r.Anchor > docLen && r.Head > docLen {
+			return nil, ErrOutOfRange
+		}
+		a, h := clamp(r.Anchor, docLen), clamp(r.Head, docLen)
+		spans[i] = span{min(a, h), max(a, h), h < a, i == 0}
+	}
+	sort.SliceStable(spans, func(i, j int) bool {
+		if spans[i].from != spans[j].from {
+			return spans[i].from < spans[j].from
+		}
+		return spans[i].to < spans[j].to
+	})
+
+	merged := make([]span, 0, len(spans))
+	for _, sp := range spans {
+		n := len(merged)
+		if n == 0 || sp.from > merged[n-1].to {
+			merged = append(merged, sp)
+			continue
+		}
+		// the merged range keeps the direction of the first, unless it was
+		// only a cursor
+		prev := &merged[n-1]
+		if prev.from == prev.to {
+			prev.backward = sp.backward
+		}
+		prev.to = max(prev.to, sp.to)
+		prev.primary = prev.primary || sp.primary
+	}
+
+	ranges := make([]Range, 0, len(merged))
+	for _, sp := range merged {
+		r := Range{sp.from, sp.to}
+		if sp.backward {
+			r = Range{sp.to, sp.from}
+		}
+		if sp.primary {
+			ranges = append([]Range{r}, ranges...)
+		} else {
+			ranges = append(ranges, r)
+		}
+	}
+	return &Selection{ranges}, nil
+}
+
 func (s *Selection) Marshal() map[string]interface{} {
 	mr := make([]map[string]interface{}, len(s.Ranges))
 	for i, r := range s.Ranges {
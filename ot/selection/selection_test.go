@@ -21,6 +21,68 @@ func TestSelectionTransform(t *testing.T) {
 	}
 }
 
+func TestSelectionTransformWithBias(t *testing.T) {
+	s := &selection.Selection{[]selection.Range{{3, 3}, {0, 3}}}
+
+	top := operation.New().Retain(3).Insert("abc").Retain(2)
+
+	if actual, expected := s.TransformWithBias(top, selection.BiasAfter), (&selection.Selection{
+		[]selection.Range{{6, 6}, {0, 6}},
+	}); !reflect.DeepEqual(actual, expected) {
+		t.Errorf("expected %+v, got %+v", expected, actual)
+	}
+	if actual, expected := s.TransformWithBias(top, selection.BiasBefore), (&selection.Selection{
+		[]selection.Range{{3, 3}, {0, 3}},
+	}); !reflect.DeepEqual(actual, expected) {
+		t.Errorf("expected %+v, got %+v", expected, actual)
+	}
+}
+
+func TestNormalize(t *testing.T) {
+	for _, tc := range []struct {
+		ranges   []selection.Range
+		expected []selection.Range
+	}{
+		{[]selection.Range{}, []selection.Range{}},
+		{[]selection.Range{{2, 5}}, []selection.Range{{2, 5}}},
+		// clamped to the document
+		{[]selection.Range{{-2, 3}, {12, 6}}, []selection.Range{{0, 3}, {10, 6}}},
+		// sorted, the primary range first
+		{[]selection.Range{{8, 9}, {0, 1}, {4, 4}}, []selection.Range{{8, 9}, {0, 1}, {4, 4}}},
+		{[]selection.Range{{0, 1}, {8, 9}, {4, 4}}, []selection.Range{{0, 1}, {4, 4}, {8, 9}}},
+		// duplicates, overlapping and touching ranges are merged
+		{[]selection.Range{{3, 3}, {3, 3}}, []selection.Range{{3, 3}}},
+		{[]selection.Range{{1, 4}, {6, 2}}, []selection.Range{{1, 6}}},
+		{[]selection.Range{{4, 1}, {2, 6}}, []selection.Range{{6, 1}}},
+		{[]selection.Range{{0, 2}, {2, 3}, {9, 8}}, []selection.Range{{0, 3}, {9, 8}}},
+		// into the range of the primary one
+		{[]selection.Range{{5, 5}, {0, 1}, {7, 3}}, []selection.Range{{7, 3}, {0, 1}}},
+		// a cursor takes the direction of what it merges with
+		{[]selection.Range{{2, 2}, {5, 2}}, []selection.Range{{5, 2}}},
+	} {
+		s := &selection.Selection{tc.ranges}
+		actual, err := s.Normalize(10)
+		if err != nil {
+			t.Errorf("expected no error normalizing %+v, got %v", tc.ranges, err)
+			continue
+		}
+		if expected := (&selection.Selection{tc.expected}); !reflect.DeepEqual(actual, expected) {
+			t.Errorf("expected %+v normalized to %+v, got %+v", tc.ranges, expected, actual)
+		}
+	}
+
+	for _, ranges := range [][]selection.Range{
+		{{-2, -1}},
+		{{11, 12}},
+		{{0, 5}, {11, 11}},
+	} {
+		s := &selection.Selection{ranges}
+		if _, err := s.Normalize(10); err != selection.ErrOutOfRange {
+			t.Errorf("expected ErrOutOfRange for %+v, got %v", ranges, err)
+		}
+	}
+}
+
 func TestMarshal(t *testing.T) {
 	for _, tc := range []struct {
 		input  *selection.Selection
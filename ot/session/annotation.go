@@ -0,0 +1,143 @@
+package session
+
+import (
+	"errors"
+	"sort"
+	"strconv"
+	"unicode/utf16"
+	"unicode/utf8"
+
+	"github.com/nitrous-io/ot.go/ot"
+	"github.com/nitrous-io/ot.go/ot/operation"
+	"github.com/nitrous-io/ot.go/ot/selection"
+)
+
+var (
+	ErrInvalidRange      = errors.New("ot/session: invalid range")
+	ErrUnknownAnnotation = errors.New("ot/session: unknown annotation")
+)
+
+// Annotation is a thread of comments on the text between From and To, which
+// count units of ot.TextEncoding. The range moves along with the operations
+// applied to the document. It shrinks as its text is deleted; once all of it
+// is gone, the range collapses to where the text was and the annotation is
+// Orphaned.
+type Annotation struct {
+	ID       string    `json:"id"`
+	From     int       `json:"from"`
+	To       int       `json:"to"`
+	Orphaned bool      `json:"orphaned,omitempty"`
+	Resolved bool      `json:"resolved,omitempty"`
+	Comments []Comment `json:"comments"`
+}
+
+// Comment is one message of an annotation's thread.
+type Comment struct {
+	Author string `json:"author"`
+	Text   string `json:"text"`
+}
+
+// Transform moves the range of a past op.
+func (a *Annotation) Transform(op *operation.Operation) {
+	r := (&selection.Range{Anchor: a.From, Head: a.To}).Transform(op)
+	if r.Anchor == r.Head && a.From < a.To {
+		a.Orphaned = true
+	}
+	a.From, a.To = r.Anchor, r.Head
+}
+
+// AddAnnotation starts a thread with a comment by author on the text between
+// from and to in the document at revision. The range is transformed against
+// the operations applied since.
+func (s *Session) AddAnnotation(revision, from, to int, author, text string) (*Annotation, error) {
+	ops, err := s.OperationsSince(revision)
+	if err != nil {
+		return nil, err
+	}
+	length := s.length()
+	if len(ops) > 0 {
+		length = ops[0].BaseLen
+	}
+	if from < 0 || from > to || to > length {
+		return nil, ErrInvalidRange
+	}
+
+	a := &Annotation{From: from, To: to, Comments: []Comment{{Author: author, Text: text}}}
+	for _, op := range ops {
+		a.Transform(op)
+	}
+	for a.ID == "" || s.Annotations[a.ID] != nil {
+		s.lastAnnotationID++
+		a.ID = strconv.Itoa(s.lastAnnotationID)
+	}
+	s.Annotations[a.ID] = a
+	return a, nil
+}
+
+// ReplyToAnnotation adds a comment by author to the thread of the annotation
+// id.
+func (s *Session) ReplyToAnnotation(id, author, text string) (*Annotation, error) {
+	a := s.Annotations[id]
+	if a == nil {
+		return nil, ErrUnknownAnnotation
+	}
+	a.Comments = append(a.Comments, Comment{Author: author, Text: text})
+	return a, nil
+}
+
+// ResolveAnnotation marks the annotation id as resolved. Resolved annotations
+// are kept, and still move along with the document.
+func (s *Session) ResolveAnnotation(id string) (*Annotation, error) {
+	a := s.Annotations[id]
+	if a == nil {
+		return nil, ErrUnknownAnnotation
+	}
+	a.Resolved = true
+	return a, nil
+}
+
+// RestoreAnnotation adds an annotation saved earlier, keeping its id. If the
+// document has been changed since and is too short for the range, the range
+// is clamped to the end of the document and the annotation orphaned.
+func (s *Session) RestoreAnnotation(a *Annotation) {
+	if length := s.length(); a.To > length {
+		a.To, a.Orphaned = length, true
+	}
+	if a.From < 0 || a.From > a.To {
+		a.From, a.Orphaned = a.To, true
+	}
+	s.Annotations[a.ID] = a
+}
+
+// SortedAnnotations returns the annotations in the order of their ranges.
+func (s *Session) SortedAnnotations() []*Annotation {
+	annotations := make([]*Annotation, 0, len(s.Annotations))
+	for _, a := range s.Annotations {
+		annotations = append(annotations, a)
+	}
+	sort.Slice(annotations, func(i, j int) bool {
+		a, b := annotations[i], annotations[j]
+		if a.From != b.From {
+			return a.From < b.From
+		}
+		if a.To != b.To {
+			return a.To < b.To
+		}
+		return a.ID < b.ID
+	})
+	return annotations
+}
+
+func (s *Session) transformAnnotations(op *operation.Operation) {
+	for _, a := range s.Annotations {
+		a.Transform(op)
+	}
+}
+
+// length returns the length of the document in units of ot.TextEncoding
+func (s *Session) length() int {
+	if ot.TextEncoding == ot.TextEncodingTypeUTF16 {
+		return len(utf16.Encode([]rune(s.Document)))
+	}
+	return utf8.RuneCountInString(s.Document)
+}
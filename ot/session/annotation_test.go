@@ -0,0 +1,150 @@
+package session_test
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/nitrous-io/ot.go/ot/operation"
+	"github.com/nitrous-io/ot.go/ot/session"
+)
+
+func TestAddAnnotation(t *testing.T) {
+	s := session.New("Lorem Ipsum Dolor")
+	if _, err := s.AddOperation(0, operation.New().Insert(">> ").Retain(17)); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	// Ipsum at revision 0 is moved past the insert
+	a, err := s.AddAnnotation(0, 6, 11, "alice", "typo?")
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	expected := &session.Annotation{ID: "1", From: 9, To: 14, Comments: []session.Comment{{Author: "alice", Text: "typo?"}}}
+	if actual := a; !reflect.DeepEqual(actual, expected) {
+		t.Errorf("expected %+v, got %+v", expected, actual)
+	}
+	if actual := s.Annotations["1"]; actual != a {
+		t.Errorf("expected the annotation to be kept, got %+v", actual)
+	}
+
+	b, err := s.AddAnnotation(1, 0, 0, "bob", "intro")
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if actual, expected := b.ID, "2"; actual != expected {
+		t.Errorf("expected id %q, got %q", expected, actual)
+	}
+	if actual, expected := s.SortedAnnotations(), []*session.Annotation{b, a}; !reflect.DeepEqual(actual, expected) {
+		t.Errorf("expected %+v, got %+v", expected, actual)
+	}
+
+	for _, tc := range []struct {
+		revision, from, to int
+		expected           error
+	}{
+		{2, 0, 0, session.ErrInvalidRevision},
+		{1, -1, 2, session.ErrInvalidRange},
+		{1, 3, 2, session.ErrInvalidRange},
+		{1, 0, 21, session.ErrInvalidRange},
+		// the document was shorter at revision 0
+		{0, 0, 18, session.ErrInvalidRange},
+	} {
+		if _, err := s.AddAnnotation(tc.revision, tc.from, tc.to, "alice", "x"); err != tc.expected {
+			t.Errorf("expected %v for %d..%d at %d, got %v", tc.expected, tc.from, tc.to, tc.revision, err)
+		}
+	}
+}
+
+func TestAnnotationsFollowEdits(t *testing.T) {
+	s := session.New("Lorem Ipsum Dolor")
+	a, _ := s.AddAnnotation(0, 6, 11, "alice", "Ipsum")
+	b, _ := s.AddAnnotation(0, 12, 17, "alice", "Dolor")
+
+	// deleting part of Ipsum shrinks its range
+	if _, err := s.AddOperation(0, operation.New().Retain(4).Delete(4).Retain(9)); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if actual, expected := [2]int{a.From, a.To}, [2]int{4, 7}; actual != expected || a.Orphaned {
+		t.Errorf("expected %v, got %v, orphaned %v", expected, actual, a.Orphaned)
+	}
+	if actual, expected := [2]int{b.From, b.To}, [2]int{8, 13}; actual != expected {
+		t.Errorf("expected %v, got %v", expected, actual)
+	}
+
+	// deleting the rest orphans it
+	if _, err := s.AddOperation(1, operation.New().Retain(3).Delete(5).Retain(5)); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if actual, expected := [2]int{a.From, a.To}, [2]int{3, 3}; actual != expected || !a.Orphaned {
+		t.Errorf("expected %v orphaned, got %v, orphaned %v", expected, actual, a.Orphaned)
+	}
+
+	// the collapsed range still moves along
+	if _, err := s.AddOperation(2, operation.New().Insert("ab").Retain(8)); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if actual, expected := [2]int{a.From, a.To}, [2]int{5, 5}; actual != expected {
+		t.Errorf("expected %v, got %v", expected, actual)
+	}
+	if actual, expected := s.Document, "abLorDolor"; actual != expected {
+		t.Errorf("expected %q, got %q", expected, actual)
+	}
+	if actual, expected := s.Document[b.From:b.To], "Dolor"; actual != expected {
+		t.Errorf("expected %q, got %q", expected, actual)
+	}
+
+	// annotations that were empty to begin with are not orphaned
+	c, _ := s.AddAnnotation(3, 2, 2, "bob", "here")
+	if _, err := s.AddOperation(3, operation.New().Delete(4).Retain(6)); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if c.Orphaned {
+		t.Errorf("expected %+v not to be orphaned", c)
+	}
+}
+
+func TestReplyAndResolve(t *testing.T) {
+	s := session.New("Lorem Ipsum")
+	a, _ := s.AddAnnotation(0, 0, 5, "alice", "Latin?")
+
+	if _, err := s.ReplyToAnnotation(a.ID, "bob", "sort of"); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if _, err := s.ResolveAnnotation(a.ID); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	expected := &session.Annotation{ID: a.ID, From: 0, To: 5, Resolved: true, Comments: []session.Comment{
+		{Author: "alice", Text: "Latin?"},
+		{Author: "bob", Text: "sort of"},
+	}}
+	if actual := s.Annotations[a.ID]; !reflect.DeepEqual(actual, expected) {
+		t.Errorf("expected %+v, got %+v", expected, actual)
+	}
+
+	if _, err := s.ReplyToAnnotation("nope", "bob", "hi"); err != session.ErrUnknownAnnotation {
+		t.Errorf("expected %v, got %v", session.ErrUnknownAnnotation, err)
+	}
+	if _, err := s.ResolveAnnotation("nope"); err != session.ErrUnknownAnnotation {
+		t.Errorf("expected %v, got %v", session.ErrUnknownAnnotation, err)
+	}
+}
+
+func TestRestoreAnnotation(t *testing.T) {
+	s := session.New("Lorem")
+	s.RestoreAnnotation(&session.Annotation{ID: "1", From: 1, To: 3})
+	s.RestoreAnnotation(&session.Annotation{ID: "8", From: 4, To: 9})
+
+	if actual, expected := *s.Annotations["1"], (session.Annotation{ID: "1", From: 1, To: 3}); !reflect.DeepEqual(actual, expected) {
+		t.Errorf("expected %+v, got %+v", expected, actual)
+	}
+	// the document got shorter since
+	if actual, expected := *s.Annotations["8"], (session.Annotation{ID: "8", From: 4, To: 5, Orphaned: true}); !reflect.DeepEqual(actual, expected) {
+		t.Errorf("expected %+v, got %+v", expected, actual)
+	}
+
+	// new annotations get ids that are not taken
+	a, _ := s.AddAnnotation(0, 0, 0, "alice", "x")
+	if actual, expected := a.ID, "2"; actual != expected {
+		t.Errorf("expected id %q, got %q", expected, actual)
+	}
+}
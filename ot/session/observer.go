@@ -0,0 +1,107 @@
+package session
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/nitrous-io/ot.go/ot/operation"
+	"github.com/nitrous-io/ot.go/ot/selection"
+)
+
+// Observer is notified of changes to a session, for indexing, autosaving,
+// linting and the like. Observers are called after the session has been
+// changed, in the order they were added, and must not modify the session.
+// They get copies of operations and selections, and an observer that panics
+// is logged and skipped, so they cannot break the session.
+type Observer interface {
+	ClientAdded(id string)
+	ClientRemoved(id string)
+	NameSet(id, name string)
+	SelectionSet(id string, sel selection.Selection)
+	// OperationApplied is called with the transformed operation, the revision
+	// it created and the id of its author, which is empty for operations
+	// added with AddOperation.
+	OperationApplied(revision int, author string, op *operation.Operation)
+}
+
+// Vetoer can be implemented by an Observer to reject operations. Veto is
+// called with a copy of an operation that has been transformed and would
+// apply cleanly, before the session is changed. A non-nil error rejects it,
+// and so does a panic.
+type Vetoer interface {
+	Veto(revision int, author string, op *operation.Operation) error
+}
+
+// VetoError is returned for operations rejected by a Vetoer.
+type VetoError struct {
+	Reason string
+}
+
+func (e *VetoError) Error() string {
+	return "ot/session: operation vetoed: " + e.Reason
+}
+
+// NopObserver can be embedded to implement only some of Observer.
+type NopObserver struct{}
+
+func (NopObserver) ClientAdded(id string)                                                 {}
+func (NopObserver) ClientRemoved(id string)                                               {}
+func (NopObserver) NameSet(id, name string)                                               {}
+func (NopObserver) SelectionSet(id string, sel selection.Selection)                       {}
+func (NopObserver) OperationApplied(revision int, author string, op *operation.Operation) {}
+
+// AddObserver adds o to the observers of s.
+func (s *Session) AddObserver(o Observer) {
+	s.observers = append(s.observers, o)
+}
+
+func (s *Session) veto(revision int, author string, op *operation.Operation) error {
+	for _, o := range s.observers {
+		if v, ok := o.(Vetoer); ok {
+			if err := callVeto(v, revision, author, copyOperation(op)); err != nil {
+				return &VetoError{err.Error()}
+			}
+		}
+	}
+	return nil
+}
+
+// callVeto calls v, turning a panic into an error
+func callVeto(v Vetoer, revision int, author string, op *operation.Operation) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("veto panicked: %v", r)
+		}
+	}()
+	return v.Veto(revision, author, op)
+}
+
+func (s *Session) notify(f func(o Observer)) {
+	// observers added while notifying are notified of later changes only
+	for _, o := range s.observers {
+		notifyOne(o, f)
+	}
+}
+
+// notifyOne calls f with o, logging the panic if o panics
+func notifyOne(o Observer, f func(o Observer)) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("ot/session: observer %T panicked: %v", o, r)
+		}
+	}()
+	f(o)
+}
+
+// copyOperation returns a deep copy of op, for observers to do with as they
+// please. Meta is copied if it is a selection, the only kind sessions know.
+func copyOperation(op *operation.Operation) *operation.Operation {
+	c := &operation.Operation{Ops: make([]*operation.Op, len(op.Ops)), BaseLen: op.BaseLen, TargetLen: op.TargetLen, Meta: op.Meta}
+	for i, o := range op.Ops {
+		c.Ops[i] = &operation.Op{N: o.N, S: append([]rune(nil), o.S...)}
+	}
+	if sel, ok := op.Meta.(*selection.Selection); ok && sel != nil {
+		c.Meta = &selection.Selection{Ranges: append([]selection.Range{}, sel.Ranges...)}
+	}
+	return c
+}
@@ -0,0 +1,204 @@
+package session_test
+
+import (
+	"bytes"
+	"errors"
+	"log"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/nitrous-io/ot.go/ot/operation"
+	"github.com/nitrous-io/ot.go/ot/selection"
+	"github.com/nitrous-io/ot.go/ot/session"
+)
+
+type recorder struct {
+	session.NopObserver
+	events []string
+	sels   []selection.Selection
+	ops    []*operation.Operation
+}
+
+func (r *recorder) ClientAdded(id string)   { r.events = append(r.events, "added "+id) }
+func (r *recorder) ClientRemoved(id string) { r.events = append(r.events, "removed "+id) }
+func (r *recorder) NameSet(id, name string) { r.events = append(r.events, "name "+id+" "+name) }
+
+func (r *recorder) SelectionSet(id string, sel selection.Selection) {
+	r.events = append(r.events, "sel "+id)
+	r.sels = append(r.sels, sel)
+}
+
+func (r *recorder) OperationApplied(revision int, author string, op *operation.Operation) {
+	r.events = append(r.events, "op "+strconv.Itoa(revision)+" "+author)
+	r.ops = append(r.ops, op)
+}
+
+type vetoer struct {
+	session.NopObserver
+	vetoed bool
+}
+
+func (v *vetoer) Veto(revision int, author string, op *operation.Operation) error {
+	if author == "mallory" {
+		v.vetoed = true
+		return errors.New("mallory may not edit")
+	}
+	return nil
+}
+
+func TestObserver(t *testing.T) {
+	s := session.New("hello")
+	r := &recorder{}
+	s.AddObserver(r)
+
+	s.AddClient("foo")
+	s.SetName("foo", "alice")
+	s.SetName("nobody", "bob")
+	sel := &selection.Selection{Ranges: []selection.Range{{Anchor: 1, Head: 2}}}
+	s.SetSelection("foo", sel)
+	if _, err := s.AddClientOperation("foo", 0, operation.New().Retain(5).Insert("!")); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if _, err := s.AddOperation(1, operation.New().Insert(">").Retain(6)); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	s.RemoveClient("foo")
+	s.RemoveClient("foo")
+
+	expected := []string{"added foo", "name foo alice", "sel foo", "op 1 foo", "op 2 ", "removed foo"}
+	if actual := r.events; !reflect.DeepEqual(actual, expected) {
+		t.Errorf("expected events %v, got %v", expected, actual)
+	}
+
+	// observers cannot change the selections of clients
+	r.sels[0].Ranges[0].Head = 5
+	if actual, expected := sel.Ranges[0].Head, 2; actual != expected {
+		t.Errorf("expected head %d, got %d", expected, actual)
+	}
+
+	// they get a copy of the applied operation
+	if actual, expected := r.ops[1], s.Operations[1]; actual == expected || !reflect.DeepEqual(actual, expected) {
+		t.Errorf("expected a copy of the applied operation, got %v", actual)
+	}
+}
+
+// meddler changes the operations it is given, and panics if told to
+type meddler struct {
+	session.NopObserver
+	panics, vetoPanics bool
+}
+
+func (m *meddler) Veto(revision int, author string, op *operation.Operation) error {
+	meddle(op)
+	if m.vetoPanics {
+		panic("meddled")
+	}
+	return nil
+}
+
+func (m *meddler) OperationApplied(revision int, author string, op *operation.Operation) {
+	meddle(op)
+	if m.panics {
+		panic("meddled")
+	}
+}
+
+func meddle(op *operation.Operation) {
+	op.Ops[0].N = 1
+	op.Ops = append(op.Ops, operation.New().Insert("x").Ops...)
+	op.TargetLen++
+}
+
+func TestObserversCannotBreakSession(t *testing.T) {
+	s := session.New("hello")
+	m, r := &meddler{}, &recorder{}
+	s.AddObserver(m)
+	s.AddObserver(r)
+
+	top, err := s.AddClientOperation("alice", 0, operation.New().Retain(5).Insert("!"))
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if actual, expected := s.Document, "hello!"; actual != expected {
+		t.Errorf("expected document %q, got %q", expected, actual)
+	}
+	expected := operation.New().Retain(5).Insert("!")
+	for _, actual := range []*operation.Operation{top, s.Operations[0], r.ops[0]} {
+		if !reflect.DeepEqual(actual, expected) {
+			t.Errorf("expected %v, got %v", expected, actual)
+		}
+	}
+
+	// an observer that panics is logged and skipped, and the others still
+	// notified
+	var logged bytes.Buffer
+	log.SetOutput(&logged)
+	defer log.SetOutput(os.Stderr)
+	m.panics = true
+	if _, err := s.AddOperation(1, operation.New().Retain(6).Insert("?")); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if actual, expected := logged.String(), "observer *session_test.meddler panicked: meddled"; !strings.Contains(actual, expected) {
+		t.Errorf("expected the log to contain %q, got %q", expected, actual)
+	}
+	if actual, expected := s.Document, "hello!?"; actual != expected {
+		t.Errorf("expected document %q, got %q", expected, actual)
+	}
+	if actual, expected := r.events, []string{"op 1 alice", "op 2 "}; !reflect.DeepEqual(actual, expected) {
+		t.Errorf("expected events %v, got %v", expected, actual)
+	}
+
+	// a vetoer that panics rejects the operation
+	m.vetoPanics = true
+	_, err = s.AddOperation(2, operation.New().Delete(7))
+	if verr, ok := err.(*session.VetoError); !ok || verr.Reason != "veto panicked: meddled" {
+		t.Errorf("expected a veto error, got %v", err)
+	}
+	if actual, expected := s.Document, "hello!?"; actual != expected {
+		t.Errorf("expected document %q, got %q", expected, actual)
+	}
+	if actual, expected := len(s.Operations), 2; actual != expected {
+		t.Errorf("expected %d operations, got %d", expected, actual)
+	}
+}
+
+func TestVeto(t *testing.T) {
+	s := session.New("hello")
+	r, v := &recorder{}, &vetoer{}
+	s.AddObserver(v)
+	s.AddObserver(r)
+
+	_, err := s.AddClientOperation("mallory", 0, operation.New().Delete(5))
+	verr, ok := err.(*session.VetoError)
+	if !ok {
+		t.Fatalf("expected a veto error, got %v", err)
+	}
+	if actual, expected := verr.Reason, "mallory may not edit"; actual != expected {
+		t.Errorf("expected reason %q, got %q", expected, actual)
+	}
+	if actual, expected := s.Document, "hello"; actual != expected {
+		t.Errorf("expected document %q, got %q", expected, actual)
+	}
+	if actual := len(s.Operations); actual != 0 {
+		t.Errorf("expected no operations, got %d", actual)
+	}
+	if actual := r.events; len(actual) != 0 {
+		t.Errorf("expected no events, got %v", actual)
+	}
+
+	// operations that do not apply are rejected before they are vetoed
+	v.vetoed = false
+	if _, err := s.AddClientOperation("mallory", 0, operation.New().Delete(6)); err != operation.ErrBaseLenMismatch {
+		t.Errorf("expected %v, got %v", operation.ErrBaseLenMismatch, err)
+	}
+	if v.vetoed {
+		t.Errorf("expected the operation not to be vetoed")
+	}
+
+	if _, err := s.AddClientOperation("alice", 0, operation.New().Delete(5)); err != nil {
+		t.Errorf("expected no error, got %v", err)
+	}
+}
@@ -9,50 +9,98 @@ import (
 
 var (
 	ErrInvalidRevision = errors.New("ot/session: invalid revision")
+	ErrDocumentTooLong = errors.New("ot/session: document too long")
 )
 
 type Session struct {
 	Document   string
 	Operations []*operation.Operation
 	Clients    map[string]*Client
+	// Annotations are keyed by their id
+	Annotations map[string]*Annotation
+
+	// MaxDocumentLength, if not 0, is the longest the document may grow, in
+	// units of ot.TextEncoding
+	MaxDocumentLength int
+
+	lastAnnotationID int
+	observers        []Observer
 }
 
 func New(document string) *Session {
 	return &Session{
-		Document:   document,
-		Operations: []*operation.Operation{},
-		Clients:    map[string]*Client{},
+		Document:    document,
+		Operations:  []*operation.Operation{},
+		Clients:     map[string]*Client{},
+		Annotations: map[string]*Annotation{},
 	}
 }
 
 func (s *Session) AddClient(id string) {
 	s.Clients[id] = &Client{Selection: selection.Selection{[]selection.Range{}}}
+	s.notify(func(o Observer) { o.ClientAdded(id) })
 }
 
 func (s *Session) RemoveClient(id string) {
+	if _, ok := s.Clients[id]; !ok {
+		return
+	}
 	delete(s.Clients, id)
+	s.notify(func(o Observer) { o.ClientRemoved(id) })
 }
 
 func (s *Session) SetName(id, name string) {
 	c := s.Clients[id]
 	if c != nil {
 		c.Name = name
+		s.notify(func(o Observer) { o.NameSet(id, name) })
 	}
 }
 
-func (s *Session) SetSelection(id string, sel *selection.Selection) {
+// SetSelection normalizes sel for the document and makes it the selection of
+// the client id. It returns the normalized selection, or an error if sel
+// cannot be repaired.
+func (s *Session) SetSelection(id string, sel *selection.Selection) (*selection.Selection, error) {
+	sel, err := sel.Normalize(s.length())
+	if err != nil {
+		return nil, err
+	}
 	c := s.Clients[id]
 	if c != nil {
 		c.Selection = *sel
+		s.notify(func(o Observer) {
+			// each observer gets its own copy of the ranges
+			ranges := append([]selection.Range{}, sel.Ranges...)
+			o.SelectionSet(id, selection.Selection{Ranges: ranges})
+		})
 	}
+	return sel, nil
 }
 
-func (s *Session) AddOperation(revision int, op *operation.Operation) (*operation.Operation, error) {
+// OperationsSince returns the operations that have been applied after the
+// given revision.
+func (s *Session) OperationsSince(revision int) ([]*operation.Operation, error) {
 	if revision < 0 || len(s.Operations) < revision {
 		return nil, ErrInvalidRevision
 	}
+	return s.Operations[revision:], nil
+}
+
+// AddOperation transforms op, which is based on revision, against the
+// operations applied since and applies it. It returns the transformed
+// operation.
+func (s *Session) AddOperation(revision int, op *operation.Operation) (*operation.Operation, error) {
+	return s.AddClientOperation("", revision, op)
+}
+
+// AddClientOperation is AddOperation for an operation by the client id, whom
+// observers are told is its author.
+func (s *Session) AddClientOperation(id string, revision int, op *operation.Operation) (*operation.Operation, error) {
 	// find concurrent operations client isn't yet aware of
-	otherOps := s.Operations[revision:]
+	otherOps, err := s.OperationsSince(revision)
+	if err != nil {
+		return nil, err
+	}
 
 	// transform given operation against these operations
 	for _, otherOp := range otherOps {
@@ -62,13 +110,29 @@ func (s *Session) AddOperation(revision int, op *operation.Operation) (*operatio
 		}
 		if op.Meta != nil {
 			if m, ok := op.Meta.(*selection.Selection); ok {
-				op1.Meta = m.Transform(otherOp)
+				// otherOp is someone else's, so the client's cursor stays
+				// in front of what it inserted
+				op1.Meta = m.TransformWithBias(otherOp, selection.BiasBefore)
 			}
 		}
 
 		op = op1
 	}
 
+	// operations that shrink the document are always fine
+	if s.MaxDocumentLength > 0 && op.TargetLen > s.MaxDocumentLength && op.TargetLen > op.BaseLen {
+		return nil, ErrDocumentTooLong
+	}
+
+	// vetoers only see operations that apply, but the document is changed
+	// only once they agree
+	if op.BaseLen != s.length() {
+		return nil, operation.ErrBaseLenMismatch
+	}
+	if err := s.veto(len(s.Operations)+1, id, op); err != nil {
+		return nil, err
+	}
+
 	// apply transformed op on the doc
 	doc, err := op.Apply(s.Document)
 	if err != nil {
@@ -77,6 +141,22 @@ func (s *Session) AddOperation(revision int, op *operation.Operation) (*operatio
 
 	s.Document = doc
 	s.Operations = append(s.Operations, op)
+	s.transformSelections(id, op)
+	s.transformAnnotations(op)
+	s.notify(func(o Observer) { o.OperationApplied(len(s.Operations), id, copyOperation(op)) })
 
 	return op, nil
 }
+
+// transformSelections moves the selections of the clients past op by the
+// client id. Its author's cursor ends up after the text it inserted, while
+// the cursors of the others at the same spot stay in front of it.
+func (s *Session) transformSelections(id string, op *operation.Operation) {
+	for clientID, c := range s.Clients {
+		bias := selection.BiasBefore
+		if clientID == id {
+			bias = selection.BiasAfter
+		}
+		c.Selection = *c.Selection.TransformWithBias(op, bias)
+	}
+}
@@ -98,7 +98,7 @@ func TestSetName(t *testing.T) {
 }
 
 func TestSetSelection(t *testing.T) {
-	s := session.New("")
+	s := session.New("Lorem Ipsum")
 	s.AddClient("foo")
 	s.AddClient("bar")
 	s.AddClient("baz")
@@ -122,6 +122,31 @@ func TestSetSelection(t *testing.T) {
 	s.SetSelection("qux", sel)
 }
 
+func TestSetSelectionNormalizes(t *testing.T) {
+	s := session.New("Lorem Ipsum")
+	s.AddClient("foo")
+
+	sel, err := s.SetSelection("foo", &selection.Selection{Ranges: []selection.Range{{Anchor: 20, Head: 8}, {Anchor: -3, Head: 2}, {Anchor: 1, Head: 4}}})
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	expected := &selection.Selection{Ranges: []selection.Range{{Anchor: 11, Head: 8}, {Anchor: 0, Head: 4}}}
+	if actual := sel; !reflect.DeepEqual(actual, expected) {
+		t.Errorf("expected %+v, got %+v", expected, actual)
+	}
+	if actual := s.Clients["foo"].Selection; !reflect.DeepEqual(&actual, expected) {
+		t.Errorf("expected foo's selection to be %+v, got %+v", expected, &actual)
+	}
+
+	// a range past the end of the document is left alone
+	if _, err := s.SetSelection("foo", &selection.Selection{Ranges: []selection.Range{{Anchor: 12, Head: 15}}}); err != selection.ErrOutOfRange {
+		t.Errorf("expected ErrOutOfRange, got %v", err)
+	}
+	if actual := s.Clients["foo"].Selection; !reflect.DeepEqual(&actual, expected) {
+		t.Errorf("expected foo's selection to stay %+v, got %+v", expected, &actual)
+	}
+}
+
 func TestAddOperation(t *testing.T) {
 	s := session.New("I love you.")
 
@@ -203,3 +228,95 @@ func TestAddOperation(t *testing.T) {
 		t.Errorf("expected returned operation to equal %v, got %v", expected, retOp)
 	}
 }
+
+func TestSelectionsFollowOperations(t *testing.T) {
+	s := session.New("Lorem Ipsum")
+	s.AddClient("foo")
+	s.AddClient("bar")
+	cursor := &selection.Selection{Ranges: []selection.Range{{Anchor: 5, Head: 5}}}
+	s.SetSelection("foo", cursor)
+	s.SetSelection("bar", cursor)
+
+	// foo types at the cursor both of them share
+	op := operation.New().Retain(5).Insert(" dolor").Retain(6)
+	if _, err := s.AddClientOperation("foo", 0, op); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	// foo's cursor follows the text foo typed, bar's stays in front of it
+	for id, expected := range map[string][]selection.Range{"foo": {{Anchor: 11, Head: 11}}, "bar": {{Anchor: 5, Head: 5}}} {
+		if actual := s.Clients[id].Selection.Ranges; !reflect.DeepEqual(actual, expected) {
+			t.Errorf("expected %s's selection to be %+v, got %+v", id, expected, actual)
+		}
+	}
+
+	// bar's concurrent edit, which did not move its cursor, leaves it in
+	// front of foo's text too
+	op = operation.New().Retain(11).Insert("!")
+	op.Meta = &selection.Selection{Ranges: []selection.Range{{Anchor: 5, Head: 5}}}
+	top, err := s.AddClientOperation("bar", 0, op)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if actual, expected := s.Document, "Lorem dolor Ipsum!"; actual != expected {
+		t.Errorf("expected %q, got %q", expected, actual)
+	}
+	if actual, expected := top.Meta, (&selection.Selection{Ranges: []selection.Range{{Anchor: 5, Head: 5}}}); !reflect.DeepEqual(actual, expected) {
+		t.Errorf("expected bar's selection to be %+v, got %+v", expected, actual)
+	}
+}
+
+func TestOperationsSince(t *testing.T) {
+	s := session.New("abc")
+
+	op1 := operation.New().Retain(3).Insert("d")
+	op2 := operation.New().Retain(4).Insert("e")
+	s.AddOperation(0, op1)
+	s.AddOperation(1, op2)
+
+	for _, rev := range []int{-1, 3} {
+		if _, err := s.OperationsSince(rev); err != session.ErrInvalidRevision {
+			t.Errorf("expected ErrInvalidRevision for revision %d, got %v", rev, err)
+		}
+	}
+
+	for _, tc := range []struct {
+		revision int
+		ops      []*operation.Operation
+	}{
+		{0, []*operation.Operation{op1, op2}},
+		{1, []*operation.Operation{op2}},
+		{2, []*operation.Operation{}},
+	} {
+		ops, err := s.OperationsSince(tc.revision)
+		if err != nil {
+			t.Errorf("expected no error, got %v", err)
+		}
+		if actual, expected := ops, tc.ops; !reflect.DeepEqual(actual, expected) {
+			t.Errorf("expected operations since %d to equal %v, got %v", tc.revision, expected, actual)
+		}
+	}
+}
+
+func TestMaxDocumentLength(t *testing.T) {
+	s := session.New("hello")
+	s.MaxDocumentLength = 8
+
+	if _, err := s.AddOperation(0, operation.New().Retain(5).Insert("!!!")); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	if _, err := s.AddOperation(1, operation.New().Retain(8).Insert("!")); err != session.ErrDocumentTooLong {
+		t.Errorf("expected ErrDocumentTooLong, got %v", err)
+	}
+
+	if actual, expected := s.Document, "hello!!!"; actual != expected {
+		t.Errorf("expected document to be %s, got %s", expected, actual)
+	}
+
+	// a document that is already too long can still shrink
+	s.MaxDocumentLength = 4
+	if _, err := s.AddOperation(1, operation.New().Retain(5).Delete(3)); err != nil {
+		t.Errorf("expected no error, got %v", err)
+	}
+}